@@ -0,0 +1,200 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a single command published to a device, or rejected before the publish
+// (denied, rate limited, open circuit or device offline) with the reason in Error.
+// Result is the response of the device for commands that wait for one, Error is empty when the command succeeded.
+// DryRun marks commands recorded in dry-run mode, which were not published and whose Result is synthesized.
+type AuditRecord struct {
+	Time     time.Time     `json:"time"`
+	Caller   string        `json:"caller,omitempty"`
+	DeviceID string        `json:"device_id"`
+	Command  string        `json:"command"`
+	Payload  string        `json:"payload"`
+	Result   string        `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Latency  time.Duration `json:"latency"`
+	DryRun   bool          `json:"dry_run,omitempty"`
+}
+
+// AuditSink receives an AuditRecord for every command published, rejected or recorded in dry-run mode by SonoffBasicR2.
+// Record is called synchronously, so implementations must be fast and safe for concurrent use.
+type AuditSink interface {
+	Record(record AuditRecord) error
+}
+
+// AuditQuery filters audit records. Zero fields match everything.
+type AuditQuery struct {
+	Caller   string
+	DeviceID string
+	Command  string
+	Since    time.Time
+	Until    time.Time
+
+	// Limit is the maximum number of records returned, keeping the most recent ones. Zero means no limit.
+	Limit int
+}
+
+// Match reports whether the record matches the query.
+func (query AuditQuery) Match(record AuditRecord) bool {
+	switch {
+	case query.Caller != "" && record.Caller != query.Caller:
+		return false
+	case query.DeviceID != "" && record.DeviceID != query.DeviceID:
+		return false
+	case query.Command != "" && record.Command != query.Command:
+		return false
+	case !query.Since.IsZero() && record.Time.Before(query.Since):
+		return false
+	case !query.Until.IsZero() && !record.Time.Before(query.Until):
+		return false
+	default:
+		return true
+	}
+}
+
+// callerKey is the context key of the caller identity.
+type callerKey struct{}
+
+// WithCaller returns a context that identifies the caller of the commands, e.g. the name of a service or a user.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller identity set with WithCaller.
+func CallerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+
+	return caller, ok
+}
+
+// JSONLinesAuditSink writes audit records to a file, one JSON object per line.
+type JSONLinesAuditSink struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// NewJSONLinesAuditSink opens (or creates) the file and appends the audit records to it.
+func NewJSONLinesAuditSink(path string) (*JSONLinesAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONLinesAuditSink{path: path, file: file}, nil
+}
+
+// Record appends the record to the file.
+func (sink *JSONLinesAuditSink) Record(record AuditRecord) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	_, err = sink.file.Write(append(data, '\n'))
+
+	return err
+}
+
+// Query reads the file and returns the records matching the query in the order they were written.
+func (sink *JSONLinesAuditSink) Query(query AuditQuery) ([]AuditRecord, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	file, err := os.Open(sink.path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	result := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		var record AuditRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+
+		if !query.Match(record) {
+			continue
+		}
+
+		result = append(result, record)
+
+		if query.Limit > 0 && len(result) > query.Limit {
+			result = result[1:]
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// Close closes the file.
+func (sink *JSONLinesAuditSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return sink.file.Close()
+}
+
+// GetAuditSink returns the sink of the audit records.
+func (sonoffBasicR2 SonoffBasicR2) GetAuditSink() AuditSink {
+	return sonoffBasicR2.getSettings().auditSink
+}
+
+// SetAuditSink sets the sink that receives an AuditRecord for every command published to a device or rejected before the publish.
+// The caller identity is taken from the context of the command (see WithCaller). Without a sink nothing is audited (default).
+func (sonoffBasicR2 *SonoffBasicR2) SetAuditSink(value AuditSink) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.auditSink = value
+	})
+}
+
+// audit sends a record of the command to the audit sink.
+func (sonoffBasicR2 SonoffBasicR2) audit(ctx context.Context, id string, command string, payload string, result string, latency time.Duration, err error) {
+	sonoffBasicR2.recordAudit(ctx, AuditRecord{
+		DeviceID: id,
+		Command:  command,
+		Payload:  payload,
+		Result:   result,
+		Latency:  latency,
+	}, err)
+}
+
+// recordAudit completes the record with the start time, the caller and the error and sends it to the audit sink.
+func (sonoffBasicR2 SonoffBasicR2) recordAudit(ctx context.Context, record AuditRecord, err error) {
+	auditSink := sonoffBasicR2.getSettings().auditSink
+
+	if auditSink == nil {
+		return
+	}
+
+	record.Time = time.Now().Add(-record.Latency)
+	record.Caller, _ = CallerFromContext(ctx)
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if errAudit := auditSink.Record(record); errAudit != nil {
+		sonoffBasicR2.logger().Error("audit failed", LogKeyDevice, record.DeviceID, LogKeyCommand, record.Command, LogKeyError, errAudit)
+	}
+}
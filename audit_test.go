@@ -0,0 +1,221 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"errors"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockAuditSink struct {
+	mutex   sync.Mutex
+	records []AuditRecord
+}
+
+func (m *MockAuditSink) Record(record AuditRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.records = append(m.records, record)
+
+	return nil
+}
+
+func TestWithCaller(t *testing.T) {
+	_, ok := CallerFromContext(context.Background())
+
+	assert.Equal(t, false, ok)
+
+	caller, ok := CallerFromContext(WithCaller(context.Background(), "scheduler"))
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "scheduler", caller)
+}
+
+func TestSonoffBasicR2_AuditSink(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Nil(t, sonoffServer.GetAuditSink())
+
+	sink := new(MockAuditSink)
+	sonoffServer.SetAuditSink(sink)
+
+	assert.Equal(t, sink, sonoffServer.GetAuditSink())
+
+	ctx := WithCaller(context.Background(), "scheduler")
+
+	err = sonoffServer.PowerOffContext(ctx, "1")
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusPhysicalButtonContext(ctx, "1")
+
+		responseChan <- err
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicResult), Payload: []byte(`{"SetOption73":"ON"}`)})
+
+	assert.NoError(t, <-responseChan)
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	assert.Equal(t, 2, len(sink.records))
+	assert.Equal(t, "scheduler", sink.records[0].Caller)
+	assert.Equal(t, "1", sink.records[0].DeviceID)
+	assert.Equal(t, TasmotaCmndTopicPower, sink.records[0].Command)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, sink.records[0].Payload)
+	assert.Equal(t, "", sink.records[0].Error)
+	assert.Equal(t, TasmotaCmndTopicPhysicalButton, sink.records[1].Command)
+	assert.Equal(t, `{"SetOption73":"ON"}`, sink.records[1].Result)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_AuditRejected(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	disconnectMockDevice(sonoffServer, mockServer, "1")
+
+	sink := new(MockAuditSink)
+	errUnreachable := errors.New("unreachable")
+
+	sonoffServer.SetAuditSink(sink)
+	sonoffServer.SetFlapProtection(FlapProtectionPolicy{MaxSwitches: 1, Window: time.Minute})
+	sonoffServer.SetCircuitBreaker(CircuitBreakerPolicy{
+		FailureThreshold: 1,
+		Cooldown:         time.Minute,
+		IsFailure:        func(err error) bool { return errors.Is(err, errUnreachable) },
+	})
+	sonoffServer.SetInterceptors(func(ctx context.Context, call CommandCall, invoker CommandInvoker) (string, error) {
+		if call.DeviceID == "3" {
+			return "", errUnreachable
+		}
+
+		return invoker(ctx, call)
+	})
+
+	ctx := WithCaller(context.Background(), "scheduler")
+
+	// The device is offline
+	assert.ErrorIs(t, sonoffServer.PowerOnContext(ctx, "1"), ErrDeviceOffline)
+
+	_, err = sonoffServer.StatusElevenContext(ctx, "1")
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+
+	// The second switch within the window is rate limited
+	assert.NoError(t, sonoffServer.PowerOnContext(ctx, "2"))
+	assert.ErrorIs(t, sonoffServer.PowerOffContext(ctx, "2"), ErrRateLimited)
+
+	// The failed command opens the circuit
+	_, err = sonoffServer.StatusElevenContext(ctx, "3")
+
+	assert.ErrorIs(t, err, errUnreachable)
+
+	_, err = sonoffServer.StatusElevenContext(ctx, "3")
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	// The command that opened the circuit failed in the interceptor, before anything was published
+	assert.Equal(t, 5, len(sink.records))
+
+	expected := []struct {
+		id      string
+		command string
+		payload string
+		err     error
+	}{
+		{"1", TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOn, ErrDeviceOffline},
+		{"1", "STATUS11", "11", ErrDeviceOffline},
+		{"2", TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOn, nil},
+		{"2", TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOff, ErrRateLimited},
+		{"3", "STATUS11", "11", ErrCircuitOpen},
+	}
+
+	for i, record := range sink.records {
+		assert.Equal(t, "scheduler", record.Caller)
+		assert.Equal(t, expected[i].id, record.DeviceID)
+		assert.Equal(t, expected[i].command, record.Command)
+		assert.Equal(t, expected[i].payload, record.Payload)
+
+		if expected[i].err == nil {
+			assert.Equal(t, "", record.Error)
+		} else {
+			assert.Contains(t, record.Error, expected[i].err.Error())
+		}
+	}
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewJSONLinesAuditSink(path)
+
+	assert.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	records := []AuditRecord{
+		{Time: now, Caller: "scheduler", DeviceID: "1", Command: "POWER", Payload: "ON", Latency: time.Millisecond},
+		{Time: now.Add(time.Minute), Caller: "dashboard", DeviceID: "1", Command: "POWER", Payload: "OFF", Error: "1 POWER: publish failed"},
+		{Time: now.Add(2 * time.Minute), Caller: "scheduler", DeviceID: "2", Command: "STATUS11", Result: "{}"},
+	}
+
+	for _, record := range records {
+		assert.NoError(t, sink.Record(record))
+	}
+
+	result, err := sink.Query(AuditQuery{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, records, result)
+
+	result, err = sink.Query(AuditQuery{Caller: "scheduler"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditRecord{records[0], records[2]}, result)
+
+	result, err = sink.Query(AuditQuery{DeviceID: "1", Since: now.Add(time.Second)})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditRecord{records[1]}, result)
+
+	result, err = sink.Query(AuditQuery{Limit: 1})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditRecord{records[2]}, result)
+
+	assert.NoError(t, sink.Close())
+
+	// Records are appended to an existing file
+	sink, err = NewJSONLinesAuditSink(path)
+
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Record(records[0]))
+
+	result, err = sink.Query(AuditQuery{Until: now.Add(time.Second)})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []AuditRecord{records[0], records[0]}, result)
+	assert.NoError(t, sink.Close())
+}
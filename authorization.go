@@ -0,0 +1,143 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Action is the kind of command checked by the authorization policy.
+type Action string
+
+// Actions checked by the authorization policy
+const (
+	// ActionReadStatus covers the Status methods.
+	ActionReadStatus Action = "read_status"
+
+	// ActionSwitch covers PowerOn, PowerOff and PowerToggle.
+	ActionSwitch Action = "switch"
+
+	// ActionConfigure covers PhysicalButtonOn and PhysicalButtonOff.
+	ActionConfigure Action = "configure"
+)
+
+// AuthorizationRequest describes a command that is about to be sent.
+// Caller is empty when the context has no caller identity (see WithCaller).
+type AuthorizationRequest struct {
+	Caller  string
+	Device  Device
+	Action  Action
+	Command string
+}
+
+// AuthorizationPolicy decides whether a caller may send a command to a device.
+type AuthorizationPolicy interface {
+	// Authorize returns nil when the command is allowed, or the reason of the denial.
+	Authorize(request AuthorizationRequest) error
+}
+
+// AuthorizationPolicyFunc adapts a function to the AuthorizationPolicy interface.
+type AuthorizationPolicyFunc func(request AuthorizationRequest) error
+
+// Authorize calls the function.
+func (policy AuthorizationPolicyFunc) Authorize(request AuthorizationRequest) error {
+	return policy(request)
+}
+
+// AuthorizationRule allows the callers to perform the actions on the devices. Empty fields match everything.
+type AuthorizationRule struct {
+	Callers []string
+	Devices []string
+
+	// Tags matches devices that have at least one of the tags (see SetDeviceTags).
+	Tags    []string
+	Actions []Action
+}
+
+// Match reports whether the rule allows the request.
+func (rule AuthorizationRule) Match(request AuthorizationRequest) bool {
+	if len(rule.Callers) > 0 && !slices.Contains(rule.Callers, request.Caller) {
+		return false
+	}
+
+	if len(rule.Devices) > 0 && !slices.Contains(rule.Devices, request.Device.ID) {
+		return false
+	}
+
+	if len(rule.Tags) > 0 && !slices.ContainsFunc(rule.Tags, func(tag string) bool { return slices.Contains(request.Device.Tags, tag) }) {
+		return false
+	}
+
+	return len(rule.Actions) == 0 || slices.Contains(rule.Actions, request.Action)
+}
+
+// RuleAuthorizationPolicy allows a command when at least one of the rules matches it and denies everything else.
+type RuleAuthorizationPolicy struct {
+	Rules []AuthorizationRule
+}
+
+// Authorize checks the request against the rules.
+func (policy RuleAuthorizationPolicy) Authorize(request AuthorizationRequest) error {
+	for _, rule := range policy.Rules {
+		if rule.Match(request) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no rule allows %q to %s", request.Caller, request.Action)
+}
+
+// GetAuthorizationPolicy returns the policy that decides which callers may control which devices.
+func (sonoffBasicR2 SonoffBasicR2) GetAuthorizationPolicy() AuthorizationPolicy {
+	return sonoffBasicR2.getSettings().authorizationPolicy
+}
+
+// SetAuthorizationPolicy sets the policy checked before a command is published.
+// Denied commands fail with ErrForbidden and are recorded by the audit sink. Without a policy everything is allowed (default).
+func (sonoffBasicR2 *SonoffBasicR2) SetAuthorizationPolicy(value AuthorizationPolicy) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.authorizationPolicy = value
+	})
+}
+
+// SetDeviceTags sets the tags of the device used by the authorization policy, e.g. "server-room".
+// The tags are kept in the registry, so they are lost when the device is deregistered.
+func (sonoffBasicR2 SonoffBasicR2) SetDeviceTags(id string, tags ...string) {
+	sonoffBasicR2.registry.update(id, 0, func(device *Device) {
+		device.Tags = slices.Clone(tags)
+	})
+}
+
+// authorize checks the command against the authorization policy and audits denials.
+func (sonoffBasicR2 SonoffBasicR2) authorize(ctx context.Context, id string, action Action, command string, payload string) error {
+	policy := sonoffBasicR2.getSettings().authorizationPolicy
+
+	if policy == nil {
+		return nil
+	}
+
+	caller, _ := CallerFromContext(ctx)
+	device, ok := sonoffBasicR2.registry.get(id)
+
+	if !ok {
+		device = Device{ID: id}
+	}
+
+	reason := policy.Authorize(AuthorizationRequest{
+		Caller:  caller,
+		Device:  device,
+		Action:  action,
+		Command: command,
+	})
+
+	if reason == nil {
+		return nil
+	}
+
+	err := newCommandError(id, command, fmt.Errorf("%w: %w", ErrForbidden, reason))
+
+	sonoffBasicR2.logger().Warn("command denied", LogKeyDevice, id, LogKeyCommand, command, LogKeyCaller, caller, LogKeyError, reason)
+	sonoffBasicR2.audit(ctx, id, command, payload, "", 0, err)
+
+	return err
+}
@@ -0,0 +1,98 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func TestRuleAuthorizationPolicy(t *testing.T) {
+	policy := RuleAuthorizationPolicy{
+		Rules: []AuthorizationRule{
+			{Actions: []Action{ActionReadStatus}},
+			{Callers: []string{"facilities"}, Tags: []string{"server-room"}},
+			{Callers: []string{"scheduler"}, Devices: []string{"pump"}, Actions: []Action{ActionSwitch}},
+		},
+	}
+
+	serverRoom := Device{ID: "rack", Tags: []string{"critical", "server-room"}}
+
+	assert.NoError(t, policy.Authorize(AuthorizationRequest{Caller: "anyone", Device: serverRoom, Action: ActionReadStatus}))
+	assert.NoError(t, policy.Authorize(AuthorizationRequest{Caller: "facilities", Device: serverRoom, Action: ActionConfigure}))
+	assert.Error(t, policy.Authorize(AuthorizationRequest{Caller: "scheduler", Device: serverRoom, Action: ActionSwitch}))
+	assert.NoError(t, policy.Authorize(AuthorizationRequest{Caller: "scheduler", Device: Device{ID: "pump"}, Action: ActionSwitch}))
+	assert.Error(t, policy.Authorize(AuthorizationRequest{Caller: "scheduler", Device: Device{ID: "pump"}, Action: ActionConfigure}))
+	assert.Error(t, policy.Authorize(AuthorizationRequest{Device: Device{ID: "pump"}, Action: ActionSwitch}))
+}
+
+func TestSonoffBasicR2_AuthorizationPolicy(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Nil(t, sonoffServer.GetAuthorizationPolicy())
+
+	sink := new(MockAuditSink)
+	policy := RuleAuthorizationPolicy{
+		Rules: []AuthorizationRule{
+			{Callers: []string{"facilities"}, Tags: []string{"server-room"}},
+		},
+	}
+
+	sonoffServer.SetAuditSink(sink)
+	sonoffServer.SetAuthorizationPolicy(policy)
+	sonoffServer.SetDeviceTags("1", "server-room")
+
+	assert.Equal(t, policy, sonoffServer.GetAuthorizationPolicy())
+
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, []string{"server-room"}, device.Tags)
+
+	err = sonoffServer.PowerOffContext(WithCaller(context.Background(), "scheduler"), "1")
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, TasmotaCmndTopicPower, commandError.Command)
+
+	_, err = sonoffServer.StatusEleven("1")
+
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	err = sonoffServer.PhysicalButtonOff("1")
+
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.PowerOffContext(WithCaller(context.Background(), "facilities"), "1")
+
+	assert.NoError(t, err)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 1)
+
+	// Denials are audited
+	sink.mutex.Lock()
+
+	assert.Equal(t, 4, len(sink.records))
+	assert.Equal(t, "scheduler", sink.records[0].Caller)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, sink.records[0].Payload)
+	assert.Contains(t, sink.records[0].Error, ErrForbidden.Error())
+	assert.Equal(t, "", sink.records[3].Error)
+
+	sink.mutex.Unlock()
+
+	sonoffServer.SetAuthorizationPolicy(AuthorizationPolicyFunc(func(request AuthorizationRequest) error {
+		return nil
+	}))
+
+	err = sonoffServer.PhysicalButtonOff("1")
+
+	assert.NoError(t, err)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
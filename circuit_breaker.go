@@ -0,0 +1,224 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of a device.
+type CircuitState int
+
+// Circuit breaker states
+const (
+	// CircuitClosed lets all commands through. It is the state of every device without failures.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen rejects all commands with ErrCircuitOpen until the cooldown has passed.
+	CircuitOpen
+
+	// CircuitHalfOpen lets a single probe command through, which closes the circuit on success or opens it again on failure.
+	CircuitHalfOpen
+)
+
+// String returns a human-readable name of the circuit state.
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerPolicy configures the per-device circuit breaker. The zero value disables it.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failed commands that opens the circuit. Zero disables the breaker.
+	FailureThreshold int
+
+	// Cooldown is how long the circuit stays open before a probe command is let through.
+	Cooldown time.Duration
+
+	// IsFailure decides whether a failed command counts towards the threshold.
+	// When nil, timeouts (ErrTimeout) and rejected publishes (ErrPublishFailed) are counted.
+	IsFailure func(err error) bool
+}
+
+// isFailure reports whether the error of a command counts towards the failure threshold.
+func (policy CircuitBreakerPolicy) isFailure(err error) bool {
+	if policy.IsFailure != nil {
+		return policy.IsFailure(err)
+	}
+
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrPublishFailed)
+}
+
+// circuit is the circuit breaker state of a single device.
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// circuitBreakers keeps the circuit breakers of all devices.
+type circuitBreakers struct {
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+}
+
+// newCircuitBreakers creates circuit breakers without any device.
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{
+		circuits: make(map[string]*circuit),
+	}
+}
+
+// allow reports whether a command to the device may be sent and the state the circuit changed to (if it changed).
+func (breakers *circuitBreakers) allow(policy CircuitBreakerPolicy, id string) (bool, CircuitState, bool) {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+
+	entry, ok := breakers.circuits[id]
+
+	if !ok {
+		return true, CircuitClosed, false
+	}
+
+	switch entry.state {
+	case CircuitOpen:
+		if time.Since(entry.openedAt) < policy.Cooldown {
+			return false, CircuitOpen, false
+		}
+
+		entry.state = CircuitHalfOpen
+		entry.probing = true
+
+		return true, CircuitHalfOpen, true
+	case CircuitHalfOpen:
+		if entry.probing {
+			return false, CircuitHalfOpen, false
+		}
+
+		entry.probing = true
+
+		return true, CircuitHalfOpen, false
+	default:
+		return true, CircuitClosed, false
+	}
+}
+
+// record counts the outcome of a command and returns the state the circuit changed to (if it changed).
+// Errors that are not failures according to the policy (e.g. a canceled context) leave the circuit as it is.
+func (breakers *circuitBreakers) record(policy CircuitBreakerPolicy, id string, err error) (CircuitState, bool) {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+
+	entry, ok := breakers.circuits[id]
+
+	if !ok {
+		entry = &circuit{}
+		breakers.circuits[id] = entry
+	}
+
+	probing := entry.probing
+	entry.probing = false
+
+	switch {
+	case err == nil:
+		entry.failures = 0
+
+		if entry.state != CircuitClosed {
+			entry.state = CircuitClosed
+
+			return CircuitClosed, true
+		}
+	case policy.isFailure(err):
+		entry.failures++
+
+		// A failed probe opens the circuit again right away
+		if (entry.state == CircuitHalfOpen && probing) || (entry.state == CircuitClosed && entry.failures >= policy.FailureThreshold) {
+			entry.state = CircuitOpen
+			entry.openedAt = time.Now()
+
+			return CircuitOpen, true
+		}
+	}
+
+	return entry.state, false
+}
+
+// GetCircuitBreaker returns the policy of the per-device circuit breaker.
+func (sonoffBasicR2 SonoffBasicR2) GetCircuitBreaker() CircuitBreakerPolicy {
+	return sonoffBasicR2.getSettings().circuitBreakerPolicy
+}
+
+// SetCircuitBreaker sets the policy of the per-device circuit breaker.
+// After FailureThreshold consecutive failures, commands to the device fail with ErrCircuitOpen until the cooldown has passed.
+// State changes are stored in Device.Circuit and reported with DeviceEventCircuitOpened, DeviceEventCircuitHalfOpened and DeviceEventCircuitClosed.
+func (sonoffBasicR2 *SonoffBasicR2) SetCircuitBreaker(value CircuitBreakerPolicy) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.circuitBreakerPolicy = value
+	})
+}
+
+// allowCircuit checks the circuit breaker of the device before a command is sent.
+func (sonoffBasicR2 SonoffBasicR2) allowCircuit(id string, command string) error {
+	policy := sonoffBasicR2.getSettings().circuitBreakerPolicy
+
+	if policy.FailureThreshold <= 0 {
+		return nil
+	}
+
+	allowed, state, changed := sonoffBasicR2.circuitBreakers.allow(policy, id)
+
+	if changed {
+		sonoffBasicR2.circuitChanged(id, state)
+	}
+
+	if !allowed {
+		return newCommandError(id, command, ErrCircuitOpen)
+	}
+
+	return nil
+}
+
+// recordCircuit counts the outcome of a command in the circuit breaker of the device.
+func (sonoffBasicR2 SonoffBasicR2) recordCircuit(id string, err error) {
+	policy := sonoffBasicR2.getSettings().circuitBreakerPolicy
+
+	if policy.FailureThreshold <= 0 {
+		return
+	}
+
+	if state, changed := sonoffBasicR2.circuitBreakers.record(policy, id, err); changed {
+		sonoffBasicR2.circuitChanged(id, state)
+	}
+}
+
+// circuitChanged stores the new circuit state in the registry and reports it with a device event.
+func (sonoffBasicR2 SonoffBasicR2) circuitChanged(id string, state CircuitState) {
+	eventType := map[CircuitState]DeviceEventType{
+		CircuitClosed:   DeviceEventCircuitClosed,
+		CircuitOpen:     DeviceEventCircuitOpened,
+		CircuitHalfOpen: DeviceEventCircuitHalfOpened,
+	}[state]
+
+	sonoffBasicR2.registry.update(id, eventType, func(device *Device) {
+		device.Circuit = state
+	})
+
+	level := slog.LevelInfo
+
+	if state == CircuitOpen {
+		level = slog.LevelWarn
+	}
+
+	sonoffBasicR2.logger().Log(context.Background(), level, "circuit breaker state changed", LogKeyDevice, id, LogKeyCircuit, state.String())
+}
@@ -0,0 +1,141 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitState_String(t *testing.T) {
+	assert.Equal(t, "closed", CircuitClosed.String())
+	assert.Equal(t, "open", CircuitOpen.String())
+	assert.Equal(t, "half_open", CircuitHalfOpen.String())
+	assert.Equal(t, "unknown", CircuitState(42).String())
+}
+
+func TestCircuitBreakers(t *testing.T) {
+	breakers := newCircuitBreakers()
+	policy := CircuitBreakerPolicy{FailureThreshold: 2, Cooldown: 10 * time.Millisecond}
+
+	allowed, _, _ := breakers.allow(policy, "1")
+
+	assert.Equal(t, true, allowed)
+
+	_, changed := breakers.record(policy, "1", newCommandError("1", "POWER", ErrTimeout))
+
+	assert.Equal(t, false, changed)
+
+	_, changed = breakers.record(policy, "1", newCommandError("1", "POWER", context.Canceled))
+
+	assert.Equal(t, false, changed)
+
+	state, changed := breakers.record(policy, "1", newCommandError("1", "POWER", ErrTimeout))
+
+	assert.Equal(t, CircuitOpen, state)
+	assert.Equal(t, true, changed)
+
+	allowed, state, _ = breakers.allow(policy, "1")
+
+	assert.Equal(t, false, allowed)
+	assert.Equal(t, CircuitOpen, state)
+
+	allowed, _, _ = breakers.allow(policy, "2")
+
+	assert.Equal(t, true, allowed)
+
+	time.Sleep(20 * time.Millisecond)
+
+	allowed, state, changed = breakers.allow(policy, "1")
+
+	assert.Equal(t, true, allowed)
+	assert.Equal(t, CircuitHalfOpen, state)
+	assert.Equal(t, true, changed)
+
+	allowed, _, _ = breakers.allow(policy, "1")
+
+	assert.Equal(t, false, allowed)
+
+	state, changed = breakers.record(policy, "1", nil)
+
+	assert.Equal(t, CircuitClosed, state)
+	assert.Equal(t, true, changed)
+}
+
+func TestSonoffBasicR2_CircuitBreaker(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockPublishError())
+
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitBreakerPolicy{}, sonoffServer.GetCircuitBreaker())
+
+	sonoffServer.SetCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+
+	var mutex sync.Mutex
+	var events []DeviceEventType
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		events = append(events, event.Type)
+	})
+
+	assert.ErrorIs(t, sonoffServer.PowerOn("1"), ErrPublishFailed)
+	assert.ErrorIs(t, sonoffServer.PowerOn("1"), ErrPublishFailed)
+
+	err = sonoffServer.PowerOn("1")
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, "POWER", commandError.Command)
+	mockServer.AssertNumberOfCalls(t, "Publish", 2)
+
+	device, ok := sonoffServer.Device("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, CircuitOpen, device.Circuit)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.ErrorIs(t, sonoffServer.PowerOn("1"), ErrPublishFailed)
+	assert.ErrorIs(t, sonoffServer.PowerOn("1"), ErrCircuitOpen)
+	mockServer.AssertNumberOfCalls(t, "Publish", 3)
+
+	mutex.Lock()
+	assert.Equal(t, []DeviceEventType{DeviceEventCircuitOpened, DeviceEventCircuitHalfOpened, DeviceEventCircuitOpened}, events)
+	mutex.Unlock()
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_CircuitBreakerClosed(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 2, Cooldown: 10 * time.Millisecond})
+
+	sonoffServer.recordCircuit("1", newCommandError("1", "POWER", ErrTimeout))
+	sonoffServer.recordCircuit("1", newCommandError("1", "POWER", ErrTimeout))
+
+	assert.ErrorIs(t, sonoffServer.PowerOn("1"), ErrCircuitOpen)
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, sonoffServer.PowerOn("1"))
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), mock.Anything, mock.Anything, mock.Anything)
+
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, CircuitClosed, device.Circuit)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
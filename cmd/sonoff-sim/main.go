@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fromsi/mqtt_sonoff_basic_r2/sonoffsim"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reboot patterns of the fleet.
+const (
+	// RebootModeRandom reboots every device on its own after an exponentially distributed interval.
+	RebootModeRandom = "random"
+
+	// RebootModePeriodic reboots every device on its own at a fixed interval, starting at a random offset.
+	RebootModePeriodic = "periodic"
+
+	// RebootModeOutage power cycles all devices at once, like a power outage.
+	RebootModeOutage = "outage"
+)
+
+// options are the command-line options of the simulator.
+type options struct {
+	broker         string
+	count          int
+	prefix         string
+	ids            string
+	versions       string
+	rssi           string
+	telePeriod     time.Duration
+	latency        time.Duration
+	failureRate    float64
+	rebootMode     string
+	rebootInterval time.Duration
+	rebootDowntime time.Duration
+	buttonInterval time.Duration
+	startInterval  time.Duration
+	seed           int64
+	verbose        bool
+}
+
+// distribution draws random values, like the RSSI of the devices.
+type distribution func(random *rand.Rand) int
+
+func main() {
+	var opts options
+
+	flag.StringVar(&opts.broker, "broker", "127.0.0.1:1883", "address (host:port) of the MQTT broker")
+	flag.IntVar(&opts.count, "count", 10, "number of simulated devices")
+	flag.StringVar(&opts.prefix, "prefix", "sonoff-sim", "prefix of the generated device IDs (<prefix>-001, <prefix>-002, ...)")
+	flag.StringVar(&opts.ids, "ids", "", "comma-separated device IDs, instead of -count and -prefix")
+	flag.StringVar(&opts.versions, "versions", sonoffsim.DefaultVersion, "comma-separated firmware versions, assigned to the devices in turn")
+	flag.StringVar(&opts.rssi, "rssi", "uniform:40:100", "distribution of the RSSI in percent: fixed:<value>, uniform:<min>:<max> or normal:<mean>:<stddev>, drawn again every tele period")
+	flag.DurationVar(&opts.telePeriod, "tele-period", 10*time.Second, "interval of the tele/<id>/STATE messages (0 disables them)")
+	flag.DurationVar(&opts.latency, "latency", 0, "delay before a device answers a command")
+	flag.Float64Var(&opts.failureRate, "failure-rate", 0, "probability (0 to 1) that a device ignores a command")
+	flag.StringVar(&opts.rebootMode, "reboot-mode", RebootModeRandom, "reboot pattern: random, periodic or outage")
+	flag.DurationVar(&opts.rebootInterval, "reboot-interval", 0, "mean interval between reboots (0 disables them)")
+	flag.DurationVar(&opts.rebootDowntime, "reboot-downtime", 5*time.Second, "time a rebooting device stays offline")
+	flag.DurationVar(&opts.buttonInterval, "button-interval", 0, "mean interval between presses of the physical button of each device (0 disables them)")
+	flag.DurationVar(&opts.startInterval, "start-interval", 10*time.Millisecond, "delay between the connections of two devices")
+	flag.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "seed of the random values")
+	flag.BoolVar(&opts.verbose, "verbose", false, "log the commands received by the devices")
+	flag.Parse()
+
+	level := slog.LevelInfo
+
+	if opts.verbose {
+		level = slog.LevelDebug
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if err := run(opts, logger); err != nil {
+		logger.Error("simulation failed", "error", err)
+
+		os.Exit(1)
+	}
+}
+
+// run starts the fleet, runs the reboot and button patterns until SIGINT or SIGTERM and stops the fleet.
+func run(opts options, logger *slog.Logger) error {
+	rssi, err := parseDistribution(opts.rssi)
+
+	if err != nil {
+		return err
+	}
+
+	switch opts.rebootMode {
+	case RebootModeRandom, RebootModePeriodic, RebootModeOutage:
+	default:
+		return fmt.Errorf("unknown reboot mode %q", opts.rebootMode)
+	}
+
+	ids := getIDs(opts)
+	versions := strings.Split(opts.versions, ",")
+	devices := make([]*sonoffsim.Device, 0, len(ids))
+
+	for i, id := range ids {
+		random := rand.New(rand.NewSource(opts.seed + int64(i)))
+		device := sonoffsim.NewDevice(id, opts.broker)
+
+		device.SetVersion(strings.TrimSpace(versions[i%len(versions)]))
+		device.SetTelePeriod(opts.telePeriod)
+		device.SetLatency(opts.latency)
+		device.SetFailureRate(opts.failureRate)
+		device.SetRSSI(rssi(random))
+		device.SetBootCount(1 + random.Intn(20))
+		device.SetLogger(logger)
+
+		if err := device.Start(); err != nil {
+			stopAll(devices)
+
+			return fmt.Errorf("start %s: %w", id, err)
+		}
+
+		devices = append(devices, device)
+
+		time.Sleep(opts.startInterval)
+	}
+
+	logger.Info("fleet started", "devices", len(devices), "broker", opts.broker)
+
+	done := make(chan struct{})
+
+	var wait sync.WaitGroup
+
+	for i, device := range devices {
+		random := rand.New(rand.NewSource(opts.seed + int64(len(devices)+i)))
+
+		wait.Add(1)
+
+		go func(device *sonoffsim.Device) {
+			defer wait.Done()
+
+			simulate(opts, device, random, rssi, done, logger)
+		}(device)
+	}
+
+	if opts.rebootMode == RebootModeOutage && opts.rebootInterval > 0 {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			outages(opts, devices, rand.New(rand.NewSource(opts.seed-1)), done, logger)
+		}()
+	}
+
+	sigSystem := make(chan os.Signal, 1)
+
+	signal.Notify(sigSystem, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigSystem
+
+	close(done)
+	wait.Wait()
+
+	return stopAll(devices)
+}
+
+// simulate changes the RSSI every tele period, presses the button and reboots the device according to the options.
+func simulate(opts options, device *sonoffsim.Device, random *rand.Rand, rssi distribution, done <-chan struct{}, logger *slog.Logger) {
+	var rssiTicker <-chan time.Time
+
+	if opts.telePeriod > 0 {
+		ticker := time.NewTicker(opts.telePeriod)
+		defer ticker.Stop()
+
+		rssiTicker = ticker.C
+	}
+
+	button := newTimer(opts.buttonInterval, exponential(random, opts.buttonInterval))
+	defer button.Stop()
+
+	var reboot *time.Timer
+
+	switch opts.rebootMode {
+	case RebootModeRandom:
+		reboot = newTimer(opts.rebootInterval, exponential(random, opts.rebootInterval))
+	case RebootModePeriodic:
+		reboot = newTimer(opts.rebootInterval, time.Duration(random.Int63n(int64(max(opts.rebootInterval, 1)))))
+	default:
+		reboot = newTimer(0, 0)
+	}
+
+	defer reboot.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-rssiTicker:
+			device.SetRSSI(rssi(random))
+		case <-button.C:
+			if err := device.PressButton(); err != nil && !errors.Is(err, sonoffsim.ErrNotConnected) {
+				logger.Warn("button press failed", "device", device.GetID(), "error", err)
+			}
+
+			button.Reset(exponential(random, opts.buttonInterval))
+		case <-reboot.C:
+			if err := device.Reboot(opts.rebootDowntime); err != nil && !errors.Is(err, sonoffsim.ErrNotConnected) {
+				logger.Warn("reboot failed", "device", device.GetID(), "error", err)
+			}
+
+			if opts.rebootMode == RebootModePeriodic {
+				reboot.Reset(opts.rebootInterval)
+			} else {
+				reboot.Reset(exponential(random, opts.rebootInterval))
+			}
+		}
+	}
+}
+
+// outages power cycles all devices at once after exponentially distributed intervals.
+func outages(opts options, devices []*sonoffsim.Device, random *rand.Rand, done <-chan struct{}, logger *slog.Logger) {
+	timer := time.NewTimer(exponential(random, opts.rebootInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			logger.Info("power outage", "devices", len(devices), "downtime", opts.rebootDowntime)
+
+			var wait sync.WaitGroup
+
+			for _, device := range devices {
+				wait.Add(1)
+
+				go func(device *sonoffsim.Device) {
+					defer wait.Done()
+
+					if err := device.PowerCycle(opts.rebootDowntime); err != nil && !errors.Is(err, sonoffsim.ErrNotConnected) {
+						logger.Warn("reboot failed", "device", device.GetID(), "error", err)
+					}
+				}(device)
+			}
+
+			wait.Wait()
+
+			timer.Reset(exponential(random, opts.rebootInterval))
+		}
+	}
+}
+
+// stopAll stops the started devices.
+func stopAll(devices []*sonoffsim.Device) error {
+	var err error
+
+	for _, device := range devices {
+		if errStop := device.Stop(); errStop != nil && !errors.Is(errStop, sonoffsim.ErrNotStarted) {
+			err = errors.Join(err, fmt.Errorf("stop %s: %w", device.GetID(), errStop))
+		}
+	}
+
+	return err
+}
+
+// getIDs returns the IDs given with -ids or generates -count IDs with -prefix.
+func getIDs(opts options) []string {
+	if opts.ids != "" {
+		ids := make([]string, 0)
+
+		for _, id := range strings.Split(opts.ids, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+
+		return ids
+	}
+
+	ids := make([]string, 0, opts.count)
+
+	for i := 1; i <= opts.count; i++ {
+		ids = append(ids, fmt.Sprintf("%s-%03d", opts.prefix, i))
+	}
+
+	return ids
+}
+
+// parseDistribution parses fixed:<value>, uniform:<min>:<max> or normal:<mean>:<stddev>. The values are clamped to 0..100.
+func parseDistribution(value string) (distribution, error) {
+	parts := strings.Split(value, ":")
+	numbers := make([]float64, 0, len(parts)-1)
+
+	for _, part := range parts[1:] {
+		number, err := strconv.ParseFloat(part, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid distribution %q: %w", value, err)
+		}
+
+		numbers = append(numbers, number)
+	}
+
+	switch {
+	case parts[0] == "fixed" && len(numbers) == 1:
+		return func(random *rand.Rand) int {
+			return clamp(numbers[0])
+		}, nil
+	case parts[0] == "uniform" && len(numbers) == 2 && numbers[0] <= numbers[1]:
+		return func(random *rand.Rand) int {
+			return clamp(numbers[0] + random.Float64()*(numbers[1]-numbers[0]))
+		}, nil
+	case parts[0] == "normal" && len(numbers) == 2:
+		return func(random *rand.Rand) int {
+			return clamp(numbers[0] + random.NormFloat64()*numbers[1])
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid distribution %q", value)
+	}
+}
+
+// clamp rounds the value and limits it to 0..100.
+func clamp(value float64) int {
+	return int(math.Round(math.Max(0, math.Min(100, value))))
+}
+
+// exponential draws an exponentially distributed interval with the given mean.
+func exponential(random *rand.Rand, mean time.Duration) time.Duration {
+	return time.Duration(random.ExpFloat64() * float64(mean))
+}
+
+// newTimer returns a timer firing after the delay, or a stopped timer when the interval is 0.
+func newTimer(interval time.Duration, delay time.Duration) *time.Timer {
+	timer := time.NewTimer(delay)
+
+	if interval <= 0 {
+		timer.Stop()
+	}
+
+	return timer
+}
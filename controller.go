@@ -0,0 +1,54 @@
+package mqtt_sonoff_basic_r2
+
+import "context"
+
+// Controller is the public API of SonoffBasicR2 for controlling and querying devices.
+// Depend on it instead of *SonoffBasicR2 to replace the devices with the fake of the sonofftest package in tests.
+type Controller interface {
+	Serve() error
+	Close() error
+
+	TeleConnected() <-chan string
+	TeleDisconnected() <-chan string
+
+	Device(id string) (Device, bool)
+	Devices() []Device
+	OnDeviceEvent(handler DeviceEventFn) func()
+	Discover() ([]string, error)
+
+	Status(id string) (*Status, error)
+	StatusContext(ctx context.Context, id string) (*Status, error)
+	StatusOne(id string) (*StatusOne, error)
+	StatusOneContext(ctx context.Context, id string) (*StatusOne, error)
+	StatusTwo(id string) (*StatusTwo, error)
+	StatusTwoContext(ctx context.Context, id string) (*StatusTwo, error)
+	StatusThree(id string) (*StatusThree, error)
+	StatusThreeContext(ctx context.Context, id string) (*StatusThree, error)
+	StatusFour(id string) (*StatusFour, error)
+	StatusFourContext(ctx context.Context, id string) (*StatusFour, error)
+	StatusFive(id string) (*StatusFive, error)
+	StatusFiveContext(ctx context.Context, id string) (*StatusFive, error)
+	StatusSix(id string) (*StatusSix, error)
+	StatusSixContext(ctx context.Context, id string) (*StatusSix, error)
+	StatusSeven(id string) (*StatusSeven, error)
+	StatusSevenContext(ctx context.Context, id string) (*StatusSeven, error)
+	StatusEight(id string) (*StatusEight, error)
+	StatusEightContext(ctx context.Context, id string) (*StatusEight, error)
+	StatusEleven(id string) (*StatusEleven, error)
+	StatusElevenContext(ctx context.Context, id string) (*StatusEleven, error)
+	StatusPhysicalButton(id string) (bool, error)
+	StatusPhysicalButtonContext(ctx context.Context, id string) (bool, error)
+
+	PowerOn(id string) error
+	PowerOnContext(ctx context.Context, id string) error
+	PowerOff(id string) error
+	PowerOffContext(ctx context.Context, id string) error
+	PowerToggle(id string) error
+	PowerToggleContext(ctx context.Context, id string) error
+	PhysicalButtonOn(id string) error
+	PhysicalButtonOnContext(ctx context.Context, id string) error
+	PhysicalButtonOff(id string) error
+	PhysicalButtonOffContext(ctx context.Context, id string) error
+}
+
+var _ Controller = (*SonoffBasicR2)(nil)
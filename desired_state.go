@@ -0,0 +1,196 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"sync"
+)
+
+// CallerReconciliation is the caller identity (see WithCaller) of the commands sent by desired-state reconciliation.
+const CallerReconciliation = "reconciliation"
+
+// DesiredStateStore keeps the power state the application last commanded for each device.
+// Implementations must be safe for concurrent use; a persistent store keeps the desired state across restarts.
+type DesiredStateStore interface {
+	// GetDesiredPower returns the desired power state (ON or OFF) of the device and whether one is stored.
+	GetDesiredPower(id string) (power string, ok bool, err error)
+
+	// SetDesiredPower stores the desired power state (ON or OFF) of the device.
+	SetDesiredPower(id string, power string) error
+}
+
+// MemoryDesiredStateStore is a DesiredStateStore that keeps the desired state in memory.
+type MemoryDesiredStateStore struct {
+	mutex  sync.RWMutex
+	powers map[string]string
+}
+
+// NewMemoryDesiredStateStore creates an empty in-memory desired state store.
+func NewMemoryDesiredStateStore() *MemoryDesiredStateStore {
+	return &MemoryDesiredStateStore{
+		powers: make(map[string]string),
+	}
+}
+
+// GetDesiredPower returns the desired power state of the device.
+func (store *MemoryDesiredStateStore) GetDesiredPower(id string) (string, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	power, ok := store.powers[id]
+
+	return power, ok, nil
+}
+
+// SetDesiredPower stores the desired power state of the device.
+func (store *MemoryDesiredStateStore) SetDesiredPower(id string, power string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.powers[id] = power
+
+	return nil
+}
+
+// GetDesiredStateStore returns the store of the desired power states.
+func (sonoffBasicR2 SonoffBasicR2) GetDesiredStateStore() DesiredStateStore {
+	return sonoffBasicR2.getSettings().desiredStateStore
+}
+
+// SetDesiredStateStore enables desired-state reconciliation: PowerOn and PowerOff store the commanded state, PowerToggle
+// inverts it (with power confirmation the confirmed result is stored), and when a device reports "Online"
+// its actual state (STATUS 11) is compared with the desired one.
+// On a mismatch DeviceEventPowerDrift is emitted and the desired state is applied again with PowerOn or PowerOff.
+// Reconciliation sends its commands as CallerReconciliation, so the authorization policy, flap protection and audit sink apply to them. Without a store nothing is reconciled (default).
+func (sonoffBasicR2 *SonoffBasicR2) SetDesiredStateStore(value DesiredStateStore) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.desiredStateStore = value
+	})
+}
+
+// desiredStateStore returns the store of the desired power states, or nil when reconciliation is disabled.
+// In dry-run mode changes are kept in memory on top of the configured store, since the commands were not published.
+func (sonoffBasicR2 SonoffBasicR2) desiredStateStore() DesiredStateStore {
+	settings := sonoffBasicR2.getSettings()
+
+	if settings.desiredStateStore == nil || !settings.dryRun {
+		return settings.desiredStateStore
+	}
+
+	return dryRunDesiredStateStore{
+		store:   settings.desiredStateStore,
+		changes: sonoffBasicR2.dryRun.desiredPowers,
+	}
+}
+
+// setDesiredPower stores the commanded power state (ON or OFF) in the store and in the registry.
+func (sonoffBasicR2 SonoffBasicR2) setDesiredPower(id string, power string) {
+	store := sonoffBasicR2.desiredStateStore()
+
+	if store == nil {
+		return
+	}
+
+	if err := store.SetDesiredPower(id, power); err != nil {
+		sonoffBasicR2.logger().Error("storing desired power failed", LogKeyDevice, id, LogKeyError, err)
+
+		return
+	}
+
+	sonoffBasicR2.registry.update(id, 0, func(device *Device) {
+		device.DesiredPower = power
+	})
+}
+
+// toggleDesiredPower inverts the stored desired power state, so reconciliation does not undo a toggle.
+// Without a stored state nothing changes, since the result of the toggle depends on the unknown actual state.
+func (sonoffBasicR2 SonoffBasicR2) toggleDesiredPower(id string) {
+	store := sonoffBasicR2.desiredStateStore()
+
+	if store == nil {
+		return
+	}
+
+	desired, ok, err := store.GetDesiredPower(id)
+
+	if err != nil {
+		sonoffBasicR2.logger().Error("loading desired power failed", LogKeyDevice, id, LogKeyError, err)
+
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	if desired == TasmotaCmndTopicPowerValueOn {
+		sonoffBasicR2.setDesiredPower(id, TasmotaCmndTopicPowerValueOff)
+	} else {
+		sonoffBasicR2.setDesiredPower(id, TasmotaCmndTopicPowerValueOn)
+	}
+}
+
+// reconcileDesiredState compares the actual power state of the device with the desired one and applies the desired one on a mismatch.
+func (sonoffBasicR2 SonoffBasicR2) reconcileDesiredState(id string) {
+	store := sonoffBasicR2.desiredStateStore()
+
+	if store == nil {
+		return
+	}
+
+	desired, ok, err := store.GetDesiredPower(id)
+
+	if err != nil {
+		sonoffBasicR2.logger().Error("loading desired power failed", LogKeyDevice, id, LogKeyError, err)
+
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	ctx := WithCaller(context.Background(), CallerReconciliation)
+
+	status, err := sonoffBasicR2.StatusElevenContext(ctx, id)
+
+	if err != nil {
+		sonoffBasicR2.logger().Warn("reconciliation failed", LogKeyDevice, id, LogKeyError, err)
+
+		return
+	}
+
+	actual := status.POWER
+	device, _ := sonoffBasicR2.registry.get(id)
+
+	// Devices announced via native discovery report their own state texts
+	if device.isPowerOnText(actual) == (desired == TasmotaCmndTopicPowerValueOn) {
+		return
+	}
+
+	sonoffBasicR2.registry.update(id, DeviceEventPowerDrift, func(device *Device) {
+		device.DesiredPower = desired
+	})
+
+	sonoffBasicR2.logger().Warn("power state drift", LogKeyDevice, id, LogKeyPower, actual, LogKeyDesired, desired)
+
+	if desired == TasmotaCmndTopicPowerValueOn {
+		err = sonoffBasicR2.PowerOnContext(ctx, id)
+	} else {
+		err = sonoffBasicR2.PowerOffContext(ctx, id)
+	}
+
+	if err != nil {
+		sonoffBasicR2.logger().Warn("reconciliation failed", LogKeyDevice, id, LogKeyError, err)
+	}
+}
+
+// getPowerValue converts the power state reported by the device, which may be one of its own state texts, into ON or OFF.
+func (sonoffBasicR2 SonoffBasicR2) getPowerValue(id string, power string) string {
+	device, _ := sonoffBasicR2.registry.get(id)
+
+	if device.isPowerOnText(power) {
+		return TasmotaCmndTopicPowerValueOn
+	}
+
+	return TasmotaCmndTopicPowerValueOff
+}
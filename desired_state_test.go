@@ -0,0 +1,308 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func WithMockDesiredState(store DesiredStateStore, observer Observer) MockOption {
+	return func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetDesiredStateStore(store)
+		sonoffServer.SetObserver(observer)
+	}
+}
+
+func TestMemoryDesiredStateStore(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+
+	_, ok, err := store.GetDesiredPower("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, ok)
+
+	err = store.SetDesiredPower("1", TasmotaCmndTopicPowerValueOn)
+
+	assert.NoError(t, err)
+
+	power, ok, err := store.GetDesiredPower("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, power)
+}
+
+func TestSonoffBasicR2_DesiredState(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+	observer := new(MockObserver)
+
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockDesiredState(store, observer))
+
+	assert.NoError(t, err)
+	assert.Equal(t, store, sonoffServer.GetDesiredStateStore())
+
+	powerCommands := func() int {
+		observer.mutex.Lock()
+		defer observer.mutex.Unlock()
+
+		count := 0
+
+		for _, command := range observer.completed {
+			if command == "1/"+TasmotaCmndTopicPower {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	drifts := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventPowerDrift {
+			drifts <- event
+		}
+	})
+
+	err = sonoffServer.PowerOff("1")
+
+	assert.NoError(t, err)
+
+	power, _, _ := store.GetDesiredPower("1")
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, power)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, device.DesiredPower)
+
+	fullStatTopic := sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusEleven)
+	handlerConnected := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+
+	// The device comes back with the relay turned on by PowerOnState
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullStatTopic, Payload: []byte(`{"StatusSTS":{"POWER":"ON"}}`)})
+
+	event := <-drifts
+
+	assert.Equal(t, "1", event.Device.ID)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, event.Device.DesiredPower)
+	assert.Equal(t, "power_drift", event.Type.String())
+
+	assert.Eventually(t, func() bool {
+		return powerCommands() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// No drift, nothing is sent
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	handler = <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullStatTopic, Payload: []byte(`{"StatusSTS":{"POWER":"OFF"}}`)})
+
+	assert.Never(t, func() bool {
+		return len(drifts) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	assert.Equal(t, 2, powerCommands())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DesiredStateToggle(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+	observer := new(MockObserver)
+
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockDesiredState(store, observer))
+
+	assert.NoError(t, err)
+
+	drifts := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventPowerDrift {
+			drifts <- event
+		}
+	})
+
+	// Without power confirmation the toggle inverts the desired state
+	assert.NoError(t, sonoffServer.PowerToggle("1"))
+
+	_, ok, _ := store.GetDesiredPower("1")
+
+	assert.Equal(t, false, ok)
+	assert.NoError(t, sonoffServer.PowerOn("1"))
+	assert.NoError(t, sonoffServer.PowerToggle("1"))
+
+	power, _, _ := store.GetDesiredPower("1")
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, power)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, device.DesiredPower)
+
+	// The device goes offline and comes back with the toggled state, nothing is sent
+	handlerConnected := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handlerDisconnected := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+
+	handlerDisconnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleDisconnected())
+
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusEleven), Payload: []byte(`{"StatusSTS":{"POWER":"OFF"}}`)})
+
+	assert.Never(t, func() bool {
+		return len(drifts) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 4)
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicStatus), []byte(TasmotaStatTopicStatusElevenValue), false, byte(1))
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DesiredStateStateTexts(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+	observer := new(MockObserver)
+
+	requests := make(chan AuthorizationRequest, 2)
+
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockDesiredState(store, observer), func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetAuthorizationPolicy(AuthorizationPolicyFunc(func(request AuthorizationRequest) error {
+			requests <- request
+
+			return nil
+		}))
+	})
+
+	assert.NoError(t, err)
+
+	// The device was announced via native discovery with its own state texts
+	sonoffServer.registry.update("1", 0, func(device *Device) {
+		device.Discovery = &DiscoveryConfig{Topic: "1", StateTexts: []string{"AUS", "AN", "UMSCHALTEN", "HALTEN"}}
+	})
+
+	drifts := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventPowerDrift {
+			drifts <- event
+		}
+	})
+
+	assert.NoError(t, sonoffServer.PowerOn("1"))
+	assert.Equal(t, "", (<-requests).Caller)
+
+	fullStatTopic := sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusEleven)
+	handlerConnected := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+
+	// The device reports its ON text, nothing is sent
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullStatTopic, Payload: []byte(`{"StatusSTS":{"POWER":"AN"}}`)})
+
+	assert.Never(t, func() bool {
+		return len(drifts) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 2)
+
+	request := <-requests
+
+	assert.Equal(t, CallerReconciliation, request.Caller)
+	assert.Equal(t, ActionReadStatus, request.Action)
+
+	// The device reports its OFF text, the desired state is applied by the reconciliation caller
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	handler = <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullStatTopic, Payload: []byte(`{"StatusSTS":{"POWER":"AUS"}}`)})
+
+	event := <-drifts
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, event.Device.DesiredPower)
+
+	assert.Equal(t, ActionReadStatus, (<-requests).Action)
+
+	request = <-requests
+
+	assert.Equal(t, CallerReconciliation, request.Caller)
+	assert.Equal(t, ActionSwitch, request.Action)
+
+	assert.Eventually(t, func() bool {
+		observer.mutex.Lock()
+		defer observer.mutex.Unlock()
+
+		return len(observer.completed) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), []byte(TasmotaCmndTopicPowerValueOn), false, byte(1))
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DesiredStateConfirmedToggle(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockDesiredState(store, new(MockObserver)), func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetPowerConfirmation(true)
+	})
+
+	assert.NoError(t, err)
+
+	sonoffServer.registry.update("1", 0, func(device *Device) {
+		device.Discovery = &DiscoveryConfig{Topic: "1", StateTexts: []string{"AUS", "AN", "UMSCHALTEN", "HALTEN"}}
+	})
+
+	fullStatTopic := sonoffServer.getFullStatTopic("1", TasmotaStatTopicResult)
+
+	toggle := func(power string) {
+		responseChan := make(chan error, 1)
+
+		go func() {
+			responseChan <- sonoffServer.PowerToggle("1")
+		}()
+
+		handler := <-mockServer.subscribeChan
+		handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullStatTopic, Payload: []byte(`{"POWER":"` + power + `"}`)})
+
+		assert.NoError(t, <-responseChan)
+	}
+
+	// The confirmed state text is stored as ON or OFF
+	toggle("AN")
+
+	power, _, _ := store.GetDesiredPower("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, power)
+
+	toggle("AUS")
+
+	power, _, _ = store.GetDesiredPower("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, power)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,126 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discover enumerates online devices by broadcasting the STATUS command to the default group topic (cmnd/tasmotas/STATUS).
+// Every device that answers within the command response timeout is returned.
+// Devices that were not known to be online are added to the registry and reported on TeleConnected.
+// The reports wait for a reader of TeleConnected until the discovery ends; reports that are not read by then are dropped,
+// while the devices are still part of the result and of the registry.
+// In dry-run mode the broadcast is only recorded and the devices known to be online are returned.
+func (sonoffBasicR2 SonoffBasicR2) Discover() ([]string, error) {
+	fullTopicStat := sonoffBasicR2.getFullStatTopic(TasmotaStatTopicValueAll, TasmotaStatTopicStatusShort)
+	fullTopicCmnd := sonoffBasicR2.getFullCmndTopic(TasmotaGroupTopicAll, TasmotaCmndTopicStatus)
+
+	if sonoffBasicR2.mainContext.Err() != nil {
+		return nil, newCommandError(TasmotaGroupTopicAll, TasmotaCmndTopicStatus, ErrClosed)
+	}
+
+	if sonoffBasicR2.getSettings().dryRun {
+		return sonoffBasicR2.discoverDryRun()
+	}
+
+	// Collect answers for the whole timeout, since the number of devices is unknown
+	ctx, cancel := context.WithTimeout(
+		sonoffBasicR2.mainContext,
+		time.Duration(sonoffBasicR2.getSettings().ctxCmndResponseTimeoutInSeconds)*time.Second,
+	)
+
+	defer cancel()
+
+	// The reports on TeleConnected are sent until the discovery ends
+	var reports sync.WaitGroup
+
+	defer reports.Wait()
+
+	// Channel to capture the IDs of answering devices
+	found := make(chan string, 1)
+
+	// Generate a unique subscription ID
+	subscriptionId := sonoffBasicR2.generateSubscriptionId()
+
+	// Function to handle incoming status messages
+	subscribeResponse := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		parts := strings.Split(pk.TopicName, "/")
+
+		if len(parts) < 3 {
+			return
+		}
+
+		select {
+		case found <- parts[1]:
+		case <-ctx.Done():
+		}
+	}
+
+	// Subscribe to the status topic of all devices to receive the answers
+	err := sonoffBasicR2.server.Subscribe(fullTopicStat, subscriptionId, subscribeResponse)
+
+	defer sonoffBasicR2.logUnsubscribe(fullTopicStat, subscriptionId)
+
+	if err != nil {
+		return nil, newCommandError(TasmotaGroupTopicAll, TasmotaCmndTopicStatus, err)
+	}
+
+	// Publish the command to all devices
+	start := time.Now()
+
+	err = sonoffBasicR2.server.Publish(fullTopicCmnd, []byte{}, false, sonoffBasicR2.qos)
+
+	sonoffBasicR2.audit(ctx, TasmotaGroupTopicAll, TasmotaCmndTopicStatus, "", "", time.Since(start), err)
+
+	if err != nil {
+		return nil, newPublishError(TasmotaGroupTopicAll, TasmotaCmndTopicStatus, err)
+	}
+
+	sonoffBasicR2.logger().Debug("discovery request published", LogKeyTopic, fullTopicCmnd)
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return result, nil
+		case id := <-found:
+			if seen[id] {
+				continue
+			}
+
+			seen[id] = true
+			result = append(result, id)
+
+			sonoffBasicR2.logger().Debug("device discovered", LogKeyDevice, id)
+
+			sonoffBasicR2.discovered(ctx, &reports, id)
+		}
+	}
+}
+
+// discovered feeds a device found by Discover into the registry and the connected channel,
+// unless the device is already known to be online.
+func (sonoffBasicR2 SonoffBasicR2) discovered(ctx context.Context, reports *sync.WaitGroup, id string) {
+	if device, ok := sonoffBasicR2.registry.get(id); ok && device.Online {
+		return
+	}
+
+	sonoffBasicR2.markConnected(id, "")
+
+	// The report must not hold up the answers of the other devices, so it waits for the reader in the background
+	reports.Add(1)
+
+	go func() {
+		defer reports.Done()
+
+		if !sonoffBasicR2.notifyContext(ctx, sonoffBasicR2.connected, id) {
+			sonoffBasicR2.logger().Debug("connected notification dropped", LogKeyDevice, id)
+		}
+	}()
+}
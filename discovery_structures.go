@@ -0,0 +1,119 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// FullTopic placeholders used by Tasmota (see SetOption and FullTopic command).
+const (
+	TasmotaFullTopicPrefix   = "%prefix%"
+	TasmotaFullTopicTopic    = "%topic%"
+	TasmotaFullTopicHostname = "%hostname%"
+	TasmotaFullTopicID       = "%id%"
+)
+
+// DiscoveryConfig represents the retained native discovery message Tasmota publishes on tasmota/discovery/<mac>/config.
+// It describes the topic layout, the relays and the firmware of the device.
+// See: https://tasmota.github.io/docs/Home-Assistant/
+type DiscoveryConfig struct {
+	IP               string         `json:"ip"`
+	DeviceName       string         `json:"dn"`
+	FriendlyName     []string       `json:"fn"`
+	Hostname         string         `json:"hn"`
+	MAC              string         `json:"mac"`
+	Module           string         `json:"md"`
+	TuyaMCU          int            `json:"ty"`
+	IFan             int            `json:"if"`
+	OfflinePayload   string         `json:"ofln"`
+	OnlinePayload    string         `json:"onln"`
+	StateTexts       []string       `json:"state"`
+	SoftwareVersion  string         `json:"sw"`
+	Topic            string         `json:"t"`
+	FullTopic        string         `json:"ft"`
+	Prefixes         []string       `json:"tp"`
+	Relays           []int          `json:"rl"`
+	SwitchConfig     []int          `json:"swc"`
+	SwitchNames      []string       `json:"swn"`
+	Buttons          []int          `json:"btn"`
+	SetOptions       map[string]int `json:"so"`
+	LightLinked      int            `json:"lk"`
+	LightSubtype     int            `json:"lt_st"`
+	ShutterOptions   []int          `json:"sho"`
+	ShutterTilt      [][]int        `json:"sht"`
+	DiscoveryVersion int            `json:"ver"`
+}
+
+// UnmarshalDiscoveryConfig unmarshals the native discovery config message from JSON data.
+func UnmarshalDiscoveryConfig(data []byte) (*DiscoveryConfig, error) {
+	var result DiscoveryConfig
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// RelayCount returns the number of relays the device reports (Sonoff Basic R2 has one).
+func (discoveryConfig DiscoveryConfig) RelayCount() int {
+	count := 0
+
+	for _, relay := range discoveryConfig.Relays {
+		if relay != 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// GetPrefix maps one of the default prefixes (cmnd, stat, tele) to the prefix configured on the device.
+func (discoveryConfig DiscoveryConfig) GetPrefix(prefix string) string {
+	index := map[string]int{TasmotaPrefixCmnd: 0, TasmotaPrefixStat: 1, TasmotaPrefixTele: 2}
+
+	if i, ok := index[prefix]; ok && i < len(discoveryConfig.Prefixes) && discoveryConfig.Prefixes[i] != "" {
+		return discoveryConfig.Prefixes[i]
+	}
+
+	return prefix
+}
+
+// GetFullTopic builds the full topic of a command, status or telemetry message using the FullTopic of the device.
+func (discoveryConfig DiscoveryConfig) GetFullTopic(prefix string, topic string) string {
+	fullTopic := discoveryConfig.FullTopic
+
+	if fullTopic == "" {
+		fullTopic = TasmotaFullTopicPrefix + "/" + TasmotaFullTopicTopic + "/"
+	}
+
+	mac := strings.ReplaceAll(discoveryConfig.MAC, ":", "")
+
+	if len(mac) > 6 {
+		mac = mac[len(mac)-6:]
+	}
+
+	fullTopic = strings.NewReplacer(
+		TasmotaFullTopicPrefix, discoveryConfig.GetPrefix(prefix),
+		TasmotaFullTopicTopic, discoveryConfig.Topic,
+		TasmotaFullTopicHostname, discoveryConfig.Hostname,
+		TasmotaFullTopicID, mac,
+	).Replace(fullTopic)
+
+	if !strings.HasSuffix(fullTopic, "/") {
+		fullTopic += "/"
+	}
+
+	return fullTopic + topic
+}
+
+// IsDefaultLayout reports whether the device uses the %prefix%/%topic%/ layout with the default prefixes.
+func (discoveryConfig DiscoveryConfig) IsDefaultLayout() bool {
+	for _, prefix := range []string{TasmotaPrefixCmnd, TasmotaPrefixStat, TasmotaPrefixTele} {
+		if discoveryConfig.GetFullTopic(prefix, "") != prefix+"/"+discoveryConfig.Topic+"/" {
+			return false
+		}
+	}
+
+	return true
+}
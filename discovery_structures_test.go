@@ -0,0 +1,95 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const JsonDiscoveryConfigData = `{
+	"ip": "192.168.1.50",
+	"dn": "Tasmota",
+	"fn": ["Tasmota", null, null, null, null, null, null, null],
+	"hn": "tasmota-ABCDEF-1234",
+	"mac": "A4CF12ABCDEF",
+	"md": "Sonoff Basic",
+	"ty": 0,
+	"if": 0,
+	"ofln": "Offline",
+	"onln": "Online",
+	"state": ["OFF", "ON", "TOGGLE", "HOLD"],
+	"sw": "12.5.0",
+	"t": "tasmota_ABCDEF",
+	"ft": "%prefix%/%topic%/",
+	"tp": ["cmnd", "stat", "tele"],
+	"rl": [1, 0, 0, 0, 0, 0, 0, 0],
+	"swc": [-1, -1, -1, -1, -1, -1, -1, -1],
+	"swn": [null, null, null, null, null, null, null, null],
+	"btn": [0, 0, 0, 0, 0, 0, 0, 0],
+	"so": {"4": 0, "11": 0, "13": 0, "17": 0, "20": 0, "30": 0, "68": 0, "73": 0, "82": 0, "114": 0, "117": 0},
+	"lk": 0,
+	"lt_st": 0,
+	"sho": [0, 0, 0, 0],
+	"sht": [[0, 0, 0], [0, 0, 0], [0, 0, 0], [0, 0, 0]],
+	"ver": 1
+}`
+
+func TestUnmarshalDiscoveryConfig(t *testing.T) {
+	config, err := UnmarshalDiscoveryConfig([]byte(JsonDiscoveryConfigData))
+
+	assert.NoError(t, err)
+
+	assert.Equal(t, "192.168.1.50", config.IP)
+	assert.Equal(t, "Tasmota", config.DeviceName)
+	assert.Equal(t, []string{"Tasmota", "", "", "", "", "", "", ""}, config.FriendlyName)
+	assert.Equal(t, "tasmota-ABCDEF-1234", config.Hostname)
+	assert.Equal(t, "A4CF12ABCDEF", config.MAC)
+	assert.Equal(t, "Sonoff Basic", config.Module)
+	assert.Equal(t, "Offline", config.OfflinePayload)
+	assert.Equal(t, "Online", config.OnlinePayload)
+	assert.Equal(t, []string{"OFF", "ON", "TOGGLE", "HOLD"}, config.StateTexts)
+	assert.Equal(t, "12.5.0", config.SoftwareVersion)
+	assert.Equal(t, "tasmota_ABCDEF", config.Topic)
+	assert.Equal(t, "%prefix%/%topic%/", config.FullTopic)
+	assert.Equal(t, []string{"cmnd", "stat", "tele"}, config.Prefixes)
+	assert.Equal(t, 0, config.SetOptions["73"])
+	assert.Len(t, config.ShutterTilt, 4)
+	assert.Equal(t, 1, config.DiscoveryVersion)
+
+	_, err = UnmarshalDiscoveryConfig([]byte("test"))
+
+	assert.Error(t, err)
+}
+
+func TestDiscoveryConfig_RelayCount(t *testing.T) {
+	assert.Equal(t, 1, DiscoveryConfig{Relays: []int{1, 0, 0, 0}}.RelayCount())
+	assert.Equal(t, 2, DiscoveryConfig{Relays: []int{1, 1, 0, 0}}.RelayCount())
+	assert.Equal(t, 0, DiscoveryConfig{}.RelayCount())
+}
+
+func TestDiscoveryConfig_GetFullTopic(t *testing.T) {
+	config := DiscoveryConfig{
+		Topic:     "sonoff",
+		Hostname:  "tasmota-ABCDEF-1234",
+		MAC:       "A4CF12ABCDEF",
+		FullTopic: "%prefix%/%topic%/",
+		Prefixes:  []string{"cmnd", "stat", "tele"},
+	}
+
+	assert.Equal(t, "cmnd/sonoff/POWER", config.GetFullTopic(TasmotaPrefixCmnd, TasmotaCmndTopicPower))
+	assert.Equal(t, "stat/sonoff/RESULT", config.GetFullTopic(TasmotaPrefixStat, TasmotaStatTopicResult))
+	assert.Equal(t, "tele/sonoff/LWT", config.GetFullTopic(TasmotaPrefixTele, TasmotaTeleTopicLWT))
+	assert.Equal(t, true, config.IsDefaultLayout())
+
+	config.FullTopic = "home/%hostname%/%prefix%"
+	config.Prefixes = []string{"command", "status", "telemetry"}
+
+	assert.Equal(t, "home/tasmota-ABCDEF-1234/command/POWER", config.GetFullTopic(TasmotaPrefixCmnd, TasmotaCmndTopicPower))
+	assert.Equal(t, "home/tasmota-ABCDEF-1234/status/RESULT", config.GetFullTopic(TasmotaPrefixStat, TasmotaStatTopicResult))
+	assert.Equal(t, "home/tasmota-ABCDEF-1234/telemetry/LWT", config.GetFullTopic(TasmotaPrefixTele, TasmotaTeleTopicLWT))
+	assert.Equal(t, false, config.IsDefaultLayout())
+
+	config.FullTopic = "%id%/%prefix%/"
+	config.Prefixes = nil
+
+	assert.Equal(t, "ABCDEF/cmnd/POWER", config.GetFullTopic(TasmotaPrefixCmnd, TasmotaCmndTopicPower))
+}
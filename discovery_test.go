@@ -0,0 +1,131 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestSonoffBasicR2_Discover(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.registry.markOnline("1", "DVES_1")
+
+	responseChan := make(chan []string, 1)
+
+	go func() {
+		ids, err := sonoffServer.Discover()
+
+		assert.NoError(t, err)
+
+		responseChan <- ids
+	}()
+
+	fullStatTopicAll := sonoffServer.getFullStatTopic(TasmotaStatTopicValueAll, TasmotaStatTopicStatusShort)
+	fullCmndTopic := sonoffServer.getFullCmndTopic(TasmotaGroupTopicAll, TasmotaCmndTopicStatus)
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusShort), Payload: []byte("{}")})
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("2", TasmotaStatTopicStatusShort), Payload: []byte("{}")})
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("2", TasmotaStatTopicStatusShort), Payload: []byte("{}")})
+
+	assert.Equal(t, "2", <-sonoffServer.TeleConnected())
+	assert.Equal(t, []string{"1", "2"}, <-responseChan)
+
+	assert.Equal(t, fullStatTopicAll, mockServer.Calls[2].Arguments.Get(0).(string))
+	assert.Equal(t, fullCmndTopic, mockServer.Calls[3].Arguments.Get(0).(string))
+	assert.Equal(t, fullStatTopicAll, mockServer.Calls[4].Arguments.Get(0).(string))
+
+	device, ok := sonoffServer.Device("2")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, device.Online)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DiscoverWithoutReader(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan []string, 1)
+
+	go func() {
+		ids, err := sonoffServer.Discover()
+
+		assert.NoError(t, err)
+
+		responseChan <- ids
+	}()
+
+	// Nobody reads TeleConnected while the devices answer
+	handler := <-mockServer.subscribeChan
+
+	for _, id := range []string{"1", "2", "3"} {
+		handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic(id, TasmotaStatTopicStatusShort), Payload: []byte("{}")})
+	}
+
+	// The notifications wait for the reader while the discovery is running
+	connected := make([]string, 0)
+
+	for i := 0; i < 3; i++ {
+		connected = append(connected, <-sonoffServer.TeleConnected())
+	}
+
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, connected)
+
+	select {
+	case ids := <-responseChan:
+		assert.Equal(t, []string{"1", "2", "3"}, ids)
+	case <-time.After(2 * MockCtxCmndResponseTimeoutInSeconds * time.Second):
+		t.Fatal("Discover did not return after its timeout")
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		device, _ := sonoffServer.Device(id)
+
+		assert.Equal(t, true, device.Online)
+	}
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DiscoveryOnServe(t *testing.T) {
+	mockServer := new(MockMQTTServer)
+	mockServer.subscribeChan = make(chan mqtt.InlineSubFn, 1)
+
+	sonoffServer, err := NewSonoffBasicR2WithServer(mockServer, 1)
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, sonoffServer.GetDiscoveryOnServe())
+
+	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(MockCtxCmndResponseTimeoutInSeconds)
+	sonoffServer.SetDiscoveryOnServe(true)
+
+	assert.Equal(t, true, sonoffServer.GetDiscoveryOnServe())
+
+	mockServer.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockServer.On("Unsubscribe", mock.Anything, mock.Anything).Return(nil)
+	mockServer.On("Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	assert.NoError(t, sonoffServer.Serve())
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusShort), Payload: []byte("{}")})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,254 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DryRunCommand is a command recorded in dry-run mode instead of being published.
+type DryRunCommand struct {
+	CommandCall
+
+	Time   time.Time
+	Caller string
+}
+
+// dryRun keeps the commands recorded in dry-run mode and the state that the registry does not track.
+type dryRun struct {
+	mutex           sync.Mutex
+	commands        []DryRunCommand
+	physicalButtons map[string]string
+	desiredPowers   *MemoryDesiredStateStore
+}
+
+// newDryRun creates an empty dry-run recorder.
+func newDryRun() *dryRun {
+	return &dryRun{
+		physicalButtons: make(map[string]string),
+		desiredPowers:   NewMemoryDesiredStateStore(),
+	}
+}
+
+// dryRunDesiredStateStore reads the desired power states recorded in dry-run mode before the ones of the configured store,
+// and never writes to the configured store.
+type dryRunDesiredStateStore struct {
+	store   DesiredStateStore
+	changes *MemoryDesiredStateStore
+}
+
+// GetDesiredPower returns the desired power state recorded in dry-run mode or the one of the configured store.
+func (store dryRunDesiredStateStore) GetDesiredPower(id string) (string, bool, error) {
+	if power, ok, _ := store.changes.GetDesiredPower(id); ok {
+		return power, true, nil
+	}
+
+	return store.store.GetDesiredPower(id)
+}
+
+// SetDesiredPower records the desired power state in memory.
+func (store dryRunDesiredStateStore) SetDesiredPower(id string, power string) error {
+	return store.changes.SetDesiredPower(id, power)
+}
+
+// GetDryRun returns whether commands are recorded instead of published.
+func (sonoffBasicR2 SonoffBasicR2) GetDryRun() bool {
+	return sonoffBasicR2.getSettings().dryRun
+}
+
+// SetDryRun sets whether commands are recorded instead of published (default false).
+// In dry-run mode nothing is published to the devices: the commands are logged and kept for DryRunCommands,
+// and the responses are synthesized from the last known state in the registry. POWER commands update that state.
+// The desired power states they set (see SetDesiredStateStore) are kept in memory, the configured store is not changed.
+// Interceptors, the observer and the audit sink still see every command, audit records are marked with DryRun.
+// Commands to offline devices are not queued (see SetOfflineQueueTTL), so nothing is published when dry-run mode ends.
+func (sonoffBasicR2 *SonoffBasicR2) SetDryRun(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.dryRun = value
+	})
+}
+
+// DryRunCommands returns the commands recorded in dry-run mode in the order they were sent.
+func (sonoffBasicR2 SonoffBasicR2) DryRunCommands() []DryRunCommand {
+	sonoffBasicR2.dryRun.mutex.Lock()
+	defer sonoffBasicR2.dryRun.mutex.Unlock()
+
+	return slices.Clone(sonoffBasicR2.dryRun.commands)
+}
+
+// ClearDryRunCommands forgets the commands recorded in dry-run mode.
+func (sonoffBasicR2 SonoffBasicR2) ClearDryRunCommands() {
+	sonoffBasicR2.dryRun.mutex.Lock()
+	defer sonoffBasicR2.dryRun.mutex.Unlock()
+
+	sonoffBasicR2.dryRun.commands = nil
+}
+
+// invokeDryRun records the command and returns the response the device would send.
+// Like a published command it is reported to the observer and the audit sink.
+func (sonoffBasicR2 SonoffBasicR2) invokeDryRun(ctx context.Context, call CommandCall) (response string, err error) {
+	start := time.Now()
+	caller, _ := CallerFromContext(ctx)
+
+	defer func() {
+		duration := time.Since(start)
+
+		sonoffBasicR2.observeCommandCompleted(call.DeviceID, call.Command, duration, err)
+		sonoffBasicR2.recordAudit(ctx, AuditRecord{
+			DeviceID: call.DeviceID,
+			Command:  call.Command,
+			Payload:  call.Payload,
+			Result:   response,
+			Latency:  duration,
+			DryRun:   true,
+		}, err)
+	}()
+
+	sonoffBasicR2.dryRun.mutex.Lock()
+
+	sonoffBasicR2.dryRun.commands = append(sonoffBasicR2.dryRun.commands, DryRunCommand{
+		CommandCall: call,
+		Time:        time.Now(),
+		Caller:      caller,
+	})
+
+	sonoffBasicR2.dryRun.mutex.Unlock()
+
+	sonoffBasicR2.logger().Info("dry run, command not published", LogKeyDevice, call.DeviceID, LogKeyCommand, call.Command, LogKeyCaller, caller)
+
+	var result any
+
+	switch call.Topic {
+	case TasmotaCmndTopicPower:
+		result = map[string]string{"POWER": sonoffBasicR2.dryRunPower(call.DeviceID, call.Payload)}
+	case TasmotaCmndTopicPhysicalButton:
+		result = map[string]string{"SetOption73": sonoffBasicR2.dryRunPhysicalButton(call.DeviceID, call.Payload)}
+	default:
+		if call.ResponseTopic == "" {
+			return "", nil
+		}
+
+		result = dryRunStatusPart(sonoffBasicR2.dryRunStatus(call.DeviceID), call.ResponseTopic)
+	}
+
+	data, err := json.Marshal(result)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// discoverDryRun records the discovery broadcast and returns the devices known to be online.
+func (sonoffBasicR2 SonoffBasicR2) discoverDryRun() ([]string, error) {
+	call := CommandCall{DeviceID: TasmotaGroupTopicAll, Command: TasmotaCmndTopicStatus, Topic: TasmotaCmndTopicStatus}
+
+	if _, err := sonoffBasicR2.invokeDryRun(context.Background(), call); err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0)
+
+	for _, device := range sonoffBasicR2.registry.all() {
+		if device.Online {
+			result = append(result, device.ID)
+		}
+	}
+
+	return result, nil
+}
+
+// dryRunPower applies the POWER command to the state in the registry and returns the new power state.
+func (sonoffBasicR2 SonoffBasicR2) dryRunPower(id string, value string) string {
+	device, _ := sonoffBasicR2.registry.get(id)
+	power := device.State.Power
+
+	switch value {
+	case "":
+		return power
+	case TasmotaCmndTopicPowerValueToggle:
+		if power == TasmotaCmndTopicPowerValueOn {
+			power = TasmotaCmndTopicPowerValueOff
+		} else {
+			power = TasmotaCmndTopicPowerValueOn
+		}
+	default:
+		power = value
+	}
+
+	sonoffBasicR2.updateStatePower(id, power)
+
+	return power
+}
+
+// dryRunPhysicalButton applies the SetOption73 command and returns its state (OFF when the physical button is enabled).
+func (sonoffBasicR2 SonoffBasicR2) dryRunPhysicalButton(id string, value string) string {
+	sonoffBasicR2.dryRun.mutex.Lock()
+	defer sonoffBasicR2.dryRun.mutex.Unlock()
+
+	switch value {
+	case TasmotaCmndTopicPhysicalButtonValueOn:
+		sonoffBasicR2.dryRun.physicalButtons[id] = "OFF"
+	case TasmotaCmndTopicPhysicalButtonValueOff:
+		sonoffBasicR2.dryRun.physicalButtons[id] = "ON"
+	}
+
+	if state, ok := sonoffBasicR2.dryRun.physicalButtons[id]; ok {
+		return state
+	}
+
+	return "OFF"
+}
+
+// dryRunStatus builds the STATUS 0 response from the last known state of the device.
+func (sonoffBasicR2 SonoffBasicR2) dryRunStatus(id string) Status {
+	device, _ := sonoffBasicR2.registry.get(id)
+
+	var status Status
+
+	status.Status.Topic = id
+	status.Status.Power = "0"
+
+	if device.State.Power == TasmotaCmndTopicPowerValueOn {
+		status.Status.Power = "1"
+	}
+
+	status.StatusPRM.BootCount = device.State.BootCount
+	status.StatusSTS.Time = TasmotaTime(time.Now())
+	status.StatusSTS.POWER = device.State.Power
+	status.StatusSTS.UptimeSec = device.State.UptimeSec
+	status.StatusSTS.Heap = device.State.Heap
+	status.StatusSTS.Wifi.RSSI = device.State.RSSI
+	status.StatusSTS.Wifi.Signal = device.State.Signal
+
+	return status
+}
+
+// dryRunStatusPart returns the part of STATUS 0 that is sent on the given status topic.
+func dryRunStatusPart(status Status, topic string) any {
+	switch topic {
+	case TasmotaStatTopicStatusOne:
+		return map[string]any{"StatusPRM": status.StatusPRM}
+	case TasmotaStatTopicStatusTwo:
+		return map[string]any{"StatusFWR": status.StatusFWR}
+	case TasmotaStatTopicStatusThree:
+		return map[string]any{"StatusLOG": status.StatusLOG}
+	case TasmotaStatTopicStatusFour:
+		return map[string]any{"StatusMEM": status.StatusMEM}
+	case TasmotaStatTopicStatusFive:
+		return map[string]any{"StatusNET": status.StatusNET}
+	case TasmotaStatTopicStatusSix:
+		return map[string]any{"StatusMQT": status.StatusMQT}
+	case TasmotaStatTopicStatusSeven:
+		return map[string]any{"StatusTIM": status.StatusTIM}
+	case TasmotaStatTopicStatusEight:
+		return map[string]any{"StatusSNS": status.StatusSNS}
+	case TasmotaStatTopicStatusEleven:
+		return map[string]any{"StatusSTS": status.StatusSTS}
+	default:
+		return status
+	}
+}
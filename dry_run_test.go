@@ -0,0 +1,222 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestSonoffBasicR2_DryRun(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, sonoffServer.GetDryRun())
+
+	sonoffServer.SetDryRun(true)
+	sonoffServer.SetPowerConfirmation(true)
+
+	assert.Equal(t, true, sonoffServer.GetDryRun())
+
+	err = sonoffServer.PowerOnContext(WithCaller(context.Background(), "automation"), "1")
+
+	assert.NoError(t, err)
+
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, device.State.Power)
+
+	err = sonoffServer.PowerToggle("1")
+
+	assert.NoError(t, err)
+
+	status, err := sonoffServer.StatusEleven("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, status.POWER)
+
+	statusAll, err := sonoffServer.Status("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "1", statusAll.Status.Topic)
+	assert.Equal(t, "0", statusAll.Status.Power)
+
+	enabled, err := sonoffServer.StatusPhysicalButton("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, enabled)
+
+	err = sonoffServer.PhysicalButtonOff("1")
+
+	assert.NoError(t, err)
+
+	enabled, err = sonoffServer.StatusPhysicalButton("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, enabled)
+
+	_, err = sonoffServer.StatusTwo("1")
+
+	assert.NoError(t, err)
+
+	// Nothing reaches the broker
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockServer.AssertNumberOfCalls(t, "Subscribe", 2)
+
+	commands := sonoffServer.DryRunCommands()
+
+	assert.Equal(t, 8, len(commands))
+	assert.Equal(t, "1", commands[0].DeviceID)
+	assert.Equal(t, TasmotaCmndTopicPower, commands[0].Command)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, commands[0].Payload)
+	assert.Equal(t, "automation", commands[0].Caller)
+	assert.Equal(t, TasmotaCmndTopicPowerValueToggle, commands[1].Payload)
+	assert.Equal(t, "STATUS11", commands[2].Command)
+
+	sonoffServer.ClearDryRunCommands()
+
+	assert.Empty(t, sonoffServer.DryRunCommands())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DiscoverDryRun(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetDryRun(true)
+
+	handler := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	<-sonoffServer.TeleConnected()
+
+	ids, err := sonoffServer.Discover()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, ids)
+	assert.Equal(t, TasmotaGroupTopicAll, sonoffServer.DryRunCommands()[0].DeviceID)
+
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DryRunAuditAndOfflineQueue(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockOfflineQueue(time.Minute))
+
+	assert.NoError(t, err)
+
+	disconnectMockDevice(sonoffServer, mockServer, "1")
+
+	sink := new(MockAuditSink)
+	observer := new(MockObserver)
+
+	sonoffServer.SetAuditSink(sink)
+	sonoffServer.SetObserver(observer)
+	sonoffServer.SetDryRun(true)
+
+	// The device is offline, but the command is recorded instead of queued
+	err = sonoffServer.PowerOnContext(WithCaller(context.Background(), "automation"), "1")
+
+	assert.NoError(t, err)
+
+	sink.mutex.Lock()
+
+	assert.Equal(t, 1, len(sink.records))
+	assert.Equal(t, "automation", sink.records[0].Caller)
+	assert.Equal(t, "1", sink.records[0].DeviceID)
+	assert.Equal(t, TasmotaCmndTopicPower, sink.records[0].Command)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, sink.records[0].Payload)
+	assert.Equal(t, `{"POWER":"ON"}`, sink.records[0].Result)
+	assert.Equal(t, true, sink.records[0].DryRun)
+
+	sink.mutex.Unlock()
+
+	observer.mutex.Lock()
+
+	assert.Equal(t, []string{"1/POWER"}, observer.completed)
+
+	observer.mutex.Unlock()
+
+	// Nothing is sent when the device comes back after dry-run mode ended
+	sonoffServer.SetDryRun(false)
+
+	handler := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	<-sonoffServer.TeleConnected()
+
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_DryRunDesiredState(t *testing.T) {
+	store := NewMemoryDesiredStateStore()
+
+	assert.NoError(t, store.SetDesiredPower("1", TasmotaCmndTopicPowerValueOff))
+
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetDesiredStateStore(store)
+	sonoffServer.SetDryRun(true)
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	// The desired state of the simulation changes, the stored one does not
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, device.DesiredPower)
+
+	power, ok, err := store.GetDesiredPower("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, power)
+
+	err = sonoffServer.PowerToggle("1")
+
+	assert.NoError(t, err)
+
+	device, _ = sonoffServer.Device("1")
+
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, device.DesiredPower)
+
+	power, _, err = store.GetDesiredPower("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, power)
+
+	// Commands after dry-run mode ended are stored again
+	sonoffServer.SetDryRun(false)
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	power, _, err = store.GetDesiredPower("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOn, power)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 1)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
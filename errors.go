@@ -0,0 +1,93 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the commands, always wrapped in a *CommandError.
+// Use errors.Is to check for them and errors.As to get the device ID and the command.
+var (
+	// ErrTimeout is returned when the device does not answer within the command response timeout.
+	ErrTimeout = errors.New("operation not completed")
+
+	// ErrDeviceOffline is returned when the device is known to be offline according to its LWT.
+	ErrDeviceOffline = errors.New("device is offline")
+
+	// ErrUnexpectedPayload is returned when the response of the device cannot be decoded or lacks the expected value.
+	ErrUnexpectedPayload = errors.New("unexpected payload")
+
+	// ErrClosed is returned when SonoffBasicR2 is closed before or while the command is sent.
+	ErrClosed = errors.New("sonoff basic r2 is closed")
+
+	// ErrPublishFailed is returned when the broker rejects the command.
+	ErrPublishFailed = errors.New("publish failed")
+
+	// ErrCircuitOpen is returned when the circuit breaker of the device is open after repeated failures.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	// ErrQueued is returned when the command is queued until the offline device reports "Online" (see SetOfflineQueueTTL).
+	ErrQueued = errors.New("command queued until the device is online")
+
+	// ErrQueueExpired is the result of a queued command that was not delivered within the TTL of the offline queue.
+	ErrQueueExpired = errors.New("queued command expired")
+
+	// ErrSuperseded is the result of a queued command that was replaced by a newer command of the same kind.
+	ErrSuperseded = errors.New("queued command superseded")
+
+	// ErrRateLimited is returned when a power command comes too fast according to the flap protection policy.
+	ErrRateLimited = errors.New("power command rate limited")
+
+	// ErrForbidden is returned when the authorization policy does not allow the caller to send the command to the device.
+	ErrForbidden = errors.New("command not allowed")
+)
+
+// CommandError describes a failed command together with the device and the command it was sent to.
+// Attempts is the number of times the command was sent according to the retry policy.
+type CommandError struct {
+	DeviceID string
+	Command  string
+	Attempts int
+	Err      error
+}
+
+// Error returns the error message prefixed with the device ID and the command.
+func (commandError *CommandError) Error() string {
+	if commandError.Attempts > 1 {
+		return fmt.Sprintf("%s %s (%d attempts): %v", commandError.DeviceID, commandError.Command, commandError.Attempts, commandError.Err)
+	}
+
+	return fmt.Sprintf("%s %s: %v", commandError.DeviceID, commandError.Command, commandError.Err)
+}
+
+// Unwrap returns the underlying error, so errors.Is and errors.As see the sentinel errors and the cause.
+func (commandError *CommandError) Unwrap() error {
+	return commandError.Err
+}
+
+// newCommandError wraps the error of a command sent to the device.
+func newCommandError(id string, command string, err error) *CommandError {
+	return &CommandError{DeviceID: id, Command: command, Err: err}
+}
+
+// newTimeoutError creates the error returned when the device does not answer in time.
+// The error also matches ErrDeviceOffline when the device is known to be offline.
+func (sonoffBasicR2 SonoffBasicR2) newTimeoutError(id string, command string) *CommandError {
+	err := fmt.Errorf("%w in %d seconds", ErrTimeout, sonoffBasicR2.getSettings().ctxCmndResponseTimeoutInSeconds)
+
+	if sonoffBasicR2.registry.offline(id) {
+		err = fmt.Errorf("%w: %w", err, ErrDeviceOffline)
+	}
+
+	return newCommandError(id, command, err)
+}
+
+// newPayloadError creates the error returned when the response of the device cannot be decoded.
+func newPayloadError(id string, command string, err error) *CommandError {
+	return newCommandError(id, command, fmt.Errorf("%w: %w", ErrUnexpectedPayload, err))
+}
+
+// newPublishError creates the error returned when the broker rejects the command.
+func newPublishError(id string, command string, err error) *CommandError {
+	return newCommandError(id, command, fmt.Errorf("%w: %w", ErrPublishFailed, err))
+}
@@ -0,0 +1,184 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"encoding/json"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func WithMockPublishError() MockOption {
+	return func(_ *SonoffBasicR2, mockServer *MockMQTTServer) {
+		mockServer.On("Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(assert.AnError)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	err := newCommandError("1", "STATUS11", ErrTimeout)
+
+	assert.Equal(t, "1 STATUS11: operation not completed", err.Error())
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Equal(t, ErrTimeout, err.Unwrap())
+}
+
+func TestSonoffBasicR2_ErrTimeout(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusTwo("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	err = <-responseChan
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.NotErrorIs(t, err, ErrDeviceOffline)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, "1", commandError.DeviceID)
+	assert.Equal(t, "STATUS2", commandError.Command)
+	assert.Equal(t, "1 STATUS2: operation not completed in 1 seconds", err.Error())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_ErrDeviceOffline(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handler := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleDisconnected())
+
+	sonoffServer.SetFailFastOffline(false)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusTwo("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	err = <-responseChan
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_ErrUnexpectedPayload(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte("test")})
+
+	err = <-responseChan
+
+	var syntaxError *json.SyntaxError
+
+	assert.ErrorIs(t, err, ErrUnexpectedPayload)
+	assert.ErrorAs(t, err, &syntaxError)
+
+	go func() {
+		_, err := sonoffServer.StatusPhysicalButton("1")
+
+		responseChan <- err
+	}()
+
+	handler = <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"POWER":"ON"}`)})
+
+	err = <-responseChan
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrUnexpectedPayload)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, TasmotaCmndTopicPhysicalButton, commandError.Command)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_ErrClosed(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+
+	_, err = sonoffServer.StatusTwo("1")
+
+	assert.ErrorIs(t, err, ErrClosed)
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.ErrorIs(t, err, ErrClosed)
+
+	_, err = sonoffServer.Discover()
+
+	assert.ErrorIs(t, err, ErrClosed)
+
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSonoffBasicR2_ErrPublishFailed(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockPublishError())
+
+	assert.NoError(t, err)
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.ErrorIs(t, err, ErrPublishFailed)
+	assert.ErrorIs(t, err, assert.AnError)
+
+	_, err = sonoffServer.StatusTwo("1")
+
+	<-mockServer.subscribeChan
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrPublishFailed)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, "STATUS2", commandError.Command)
+	assert.NotErrorIs(t, err, ErrTimeout)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
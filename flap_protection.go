@@ -0,0 +1,180 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FlapProtectionPolicy limits how often the relay of a device may be switched. The zero value disables it.
+type FlapProtectionPolicy struct {
+	// MinInterval is the minimum time between two power commands to the same device.
+	MinInterval time.Duration
+
+	// MaxSwitches is the maximum number of power commands to the same device within Window. Zero disables the limit.
+	// Reaching it marks the device as flapping and emits DeviceEventFlapping once, until a whole Window passed without a limited command.
+	MaxSwitches int
+
+	// Window is the time span MaxSwitches applies to.
+	Window time.Duration
+
+	// Delay makes limited commands wait until they are allowed instead of failing with ErrRateLimited.
+	Delay bool
+}
+
+// enabled reports whether the policy limits anything.
+func (policy FlapProtectionPolicy) enabled() bool {
+	return policy.MinInterval > 0 || (policy.MaxSwitches > 0 && policy.Window > 0)
+}
+
+// switchHistory is the list of recent power commands of a single device.
+type switchHistory struct {
+	times    []time.Time
+	flapping bool
+	heldAt   time.Time
+}
+
+// switchLimiter keeps the switch history of all devices.
+type switchLimiter struct {
+	mutex   sync.Mutex
+	devices map[string]*switchHistory
+}
+
+// newSwitchLimiter creates a switch limiter without any device.
+func newSwitchLimiter() *switchLimiter {
+	return &switchLimiter{
+		devices: make(map[string]*switchHistory),
+	}
+}
+
+// reserve records a power command to the device when it is allowed, or returns how long it has to wait.
+// It also reports whether the device just started flapping. The device stays flapping until a whole window passed
+// without a command held back by MaxSwitches, so a burst of delayed commands is reported once.
+func (limiter *switchLimiter) reserve(policy FlapProtectionPolicy, id string, now time.Time, delayed bool) (wait time.Duration, flapping bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	history, ok := limiter.devices[id]
+
+	if !ok {
+		history = &switchHistory{}
+		limiter.devices[id] = history
+	}
+
+	// Forget the commands that are out of the window
+	keep := policy.MinInterval
+
+	if policy.Window > keep {
+		keep = policy.Window
+	}
+
+	for len(history.times) > 0 && now.Sub(history.times[0]) >= keep {
+		history.times = history.times[1:]
+	}
+
+	// A delayed command of a flapping device still belongs to the burst that started the flapping
+	if history.flapping {
+		if delayed {
+			history.heldAt = now
+		} else if now.Sub(history.heldAt) >= policy.Window {
+			history.flapping = false
+		}
+	}
+
+	if count := len(history.times); count > 0 && policy.MinInterval > 0 {
+		if since := now.Sub(history.times[count-1]); since < policy.MinInterval {
+			wait = policy.MinInterval - since
+		}
+	}
+
+	if policy.MaxSwitches > 0 && policy.Window > 0 {
+		inWindow := 0
+
+		for _, at := range history.times {
+			if now.Sub(at) < policy.Window {
+				inWindow++
+			}
+		}
+
+		if inWindow >= policy.MaxSwitches {
+			if until := history.times[len(history.times)-inWindow].Add(policy.Window).Sub(now); until > wait {
+				wait = until
+			}
+
+			flapping = !history.flapping
+			history.flapping = true
+			history.heldAt = now
+		}
+	}
+
+	if wait > 0 {
+		return wait, flapping
+	}
+
+	history.times = append(history.times, now)
+
+	return 0, false
+}
+
+// GetFlapProtection returns the flap protection policy of the power commands.
+func (sonoffBasicR2 SonoffBasicR2) GetFlapProtection() FlapProtectionPolicy {
+	return sonoffBasicR2.getSettings().flapProtection
+}
+
+// SetFlapProtection sets the flap protection policy of PowerOn, PowerOff and PowerToggle.
+// Commands that come too fast fail with ErrRateLimited, or wait when Delay is set.
+func (sonoffBasicR2 *SonoffBasicR2) SetFlapProtection(value FlapProtectionPolicy) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.flapProtection = value
+	})
+}
+
+// limitPower applies the flap protection policy before a power command is sent to the device.
+// Rejected commands are recorded by the audit sink.
+func (sonoffBasicR2 SonoffBasicR2) limitPower(ctx context.Context, id string, value string) (err error) {
+	policy := sonoffBasicR2.getSettings().flapProtection
+
+	if !policy.enabled() {
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			sonoffBasicR2.audit(ctx, id, TasmotaCmndTopicPower, value, "", 0, err)
+		}
+	}()
+
+	for delayed := false; ; delayed = true {
+		wait, flapping := sonoffBasicR2.switchLimiter.reserve(policy, id, time.Now(), delayed)
+
+		if flapping {
+			sonoffBasicR2.registry.update(id, DeviceEventFlapping, func(device *Device) {})
+
+			sonoffBasicR2.logger().Warn("device is flapping", LogKeyDevice, id, LogKeyDuration, policy.Window)
+		}
+
+		if wait == 0 {
+			return nil
+		}
+
+		if !policy.Delay {
+			return newCommandError(id, TasmotaCmndTopicPower, ErrRateLimited)
+		}
+
+		sonoffBasicR2.logger().Debug("power command delayed", LogKeyDevice, id, LogKeyDuration, wait)
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+
+			return newCommandError(id, TasmotaCmndTopicPower, ctx.Err())
+		case <-sonoffBasicR2.mainContext.Done():
+			timer.Stop()
+
+			return newCommandError(id, TasmotaCmndTopicPower, ErrClosed)
+		}
+	}
+}
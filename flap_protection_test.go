@@ -0,0 +1,149 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSwitchLimiter(t *testing.T) {
+	limiter := newSwitchLimiter()
+	policy := FlapProtectionPolicy{MinInterval: time.Second, MaxSwitches: 3, Window: time.Minute}
+	now := time.Now()
+
+	wait, flapping := limiter.reserve(policy, "1", now, false)
+
+	assert.Equal(t, time.Duration(0), wait)
+	assert.Equal(t, false, flapping)
+
+	wait, _ = limiter.reserve(policy, "1", now.Add(400*time.Millisecond), false)
+
+	assert.Equal(t, 600*time.Millisecond, wait)
+
+	wait, _ = limiter.reserve(policy, "2", now.Add(400*time.Millisecond), false)
+
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, _ = limiter.reserve(policy, "1", now.Add(time.Second), false)
+
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, _ = limiter.reserve(policy, "1", now.Add(2*time.Second), false)
+
+	assert.Equal(t, time.Duration(0), wait)
+
+	// The fourth switch within a minute marks the device as flapping once
+	wait, flapping = limiter.reserve(policy, "1", now.Add(3*time.Second), false)
+
+	assert.Equal(t, 57*time.Second, wait)
+	assert.Equal(t, true, flapping)
+
+	_, flapping = limiter.reserve(policy, "1", now.Add(4*time.Second), false)
+
+	assert.Equal(t, false, flapping)
+
+	// The delayed command keeps the device flapping, although the window drained below MaxSwitches
+	wait, _ = limiter.reserve(policy, "1", now.Add(time.Minute), true)
+
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, flapping = limiter.reserve(policy, "1", now.Add(time.Minute+500*time.Millisecond), false)
+
+	assert.Equal(t, 500*time.Millisecond, wait)
+	assert.Equal(t, false, flapping)
+
+	// A whole window without a held back command ends the flapping
+	for i := 0; i < 3; i++ {
+		wait, _ = limiter.reserve(policy, "1", now.Add(2*time.Minute+time.Duration(i)*time.Second), false)
+
+		assert.Equal(t, time.Duration(0), wait)
+	}
+
+	_, flapping = limiter.reserve(policy, "1", now.Add(2*time.Minute+3*time.Second), false)
+
+	assert.Equal(t, true, flapping)
+}
+
+func TestSonoffBasicR2_FlapProtection(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Equal(t, FlapProtectionPolicy{}, sonoffServer.GetFlapProtection())
+
+	sonoffServer.SetFlapProtection(FlapProtectionPolicy{MaxSwitches: 2, Window: time.Minute})
+
+	events := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventFlapping {
+			events <- event
+		}
+	})
+
+	assert.NoError(t, sonoffServer.PowerToggle("1"))
+	assert.NoError(t, sonoffServer.PowerToggle("1"))
+
+	err = sonoffServer.PowerToggle("1")
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, TasmotaCmndTopicPower, commandError.Command)
+	assert.Equal(t, "1", (<-events).Device.ID)
+	assert.Equal(t, "flapping", DeviceEventFlapping.String())
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 2)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_FlapProtectionDelay(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetFlapProtection(FlapProtectionPolicy{MinInterval: 50 * time.Millisecond, Delay: true})
+
+	start := time.Now()
+
+	assert.NoError(t, sonoffServer.PowerOn("1"))
+	assert.NoError(t, sonoffServer.PowerOff("1"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 2)
+
+	// Commands delayed by MaxSwitches report the flapping device once
+	var flapping atomic.Int32
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventFlapping {
+			flapping.Add(1)
+		}
+	})
+
+	sonoffServer.SetFlapProtection(FlapProtectionPolicy{MaxSwitches: 2, Window: 50 * time.Millisecond, Delay: true})
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, sonoffServer.PowerToggle("1"))
+	}
+
+	assert.Equal(t, int32(1), flapping.Load())
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = sonoffServer.PowerOnContext(ctx, "1")
+
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
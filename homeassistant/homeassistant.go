@@ -0,0 +1,327 @@
+// Package homeassistant publishes Home Assistant MQTT discovery messages for the relays managed by SonoffBasicR2.
+// Every device becomes a switch entity together with diagnostic sensors (RSSI, uptime and heap, as reported in StatusEleven).
+// See: https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"sync"
+)
+
+// DefaultDiscoveryPrefix is the default discovery prefix of Home Assistant.
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// Home Assistant components and Tasmota topics used in the discovery messages
+const (
+	// ComponentSwitch is the Home Assistant component of the relay.
+	ComponentSwitch = "switch"
+
+	// ComponentSensor is the Home Assistant component of the diagnostic sensors.
+	ComponentSensor = "sensor"
+
+	// TasmotaTeleTopicState is the telemetry topic with the same content as StatusEleven.
+	TasmotaTeleTopicState = "STATE"
+
+	// EntityCategoryDiagnostic marks entities that are not meant to control the device.
+	EntityCategoryDiagnostic = "diagnostic"
+)
+
+// Device describes the physical device an entity belongs to.
+type Device struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections,omitempty"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model"`
+	SwVersion    string     `json:"sw_version,omitempty"`
+}
+
+// SwitchConfig is the discovery payload of the relay.
+type SwitchConfig struct {
+	Name                string `json:"name"`
+	UniqueID            string `json:"unique_id"`
+	ObjectID            string `json:"object_id"`
+	CommandTopic        string `json:"command_topic"`
+	StateTopic          string `json:"state_topic"`
+	PayloadOn           string `json:"payload_on"`
+	PayloadOff          string `json:"payload_off"`
+	StateOn             string `json:"state_on"`
+	StateOff            string `json:"state_off"`
+	AvailabilityTopic   string `json:"availability_topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+	Device              Device `json:"device"`
+}
+
+// SensorConfig is the discovery payload of a diagnostic sensor.
+type SensorConfig struct {
+	Name                string `json:"name"`
+	UniqueID            string `json:"unique_id"`
+	ObjectID            string `json:"object_id"`
+	StateTopic          string `json:"state_topic"`
+	ValueTemplate       string `json:"value_template"`
+	UnitOfMeasurement   string `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string `json:"device_class,omitempty"`
+	StateClass          string `json:"state_class,omitempty"`
+	EntityCategory      string `json:"entity_category"`
+	AvailabilityTopic   string `json:"availability_topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+	Device              Device `json:"device"`
+}
+
+// sensor describes a diagnostic sensor read from the tele STATE message.
+type sensor struct {
+	key               string
+	name              string
+	valueTemplate     string
+	unitOfMeasurement string
+	deviceClass       string
+}
+
+// sensors are the diagnostic sensors published for every device.
+var sensors = []sensor{
+	{key: "rssi", name: "RSSI", valueTemplate: "{{ value_json.Wifi.RSSI }}", unitOfMeasurement: "%"},
+	{key: "uptime", name: "Uptime", valueTemplate: "{{ value_json.UptimeSec }}", unitOfMeasurement: "s", deviceClass: "duration"},
+	{key: "heap", name: "Heap", valueTemplate: "{{ value_json.Heap }}", unitOfMeasurement: "kB", deviceClass: "data_size"},
+}
+
+// Publisher publishes retained Home Assistant discovery messages for the devices of a SonoffBasicR2
+// and removes them when the devices are deregistered.
+type Publisher struct {
+	sonoffBasicR2   *sonoff.SonoffBasicR2
+	discoveryPrefix string
+	mutex           sync.Mutex
+	published       map[string]bool
+	stopEvents      func()
+}
+
+// NewPublisher creates a Home Assistant discovery publisher for the devices of the given SonoffBasicR2.
+func NewPublisher(sonoffBasicR2 *sonoff.SonoffBasicR2) *Publisher {
+	return &Publisher{
+		sonoffBasicR2:   sonoffBasicR2,
+		discoveryPrefix: DefaultDiscoveryPrefix,
+		published:       make(map[string]bool),
+	}
+}
+
+// GetDiscoveryPrefix returns the discovery prefix of Home Assistant.
+func (publisher *Publisher) GetDiscoveryPrefix() string {
+	return publisher.discoveryPrefix
+}
+
+// SetDiscoveryPrefix sets the discovery prefix of Home Assistant.
+func (publisher *Publisher) SetDiscoveryPrefix(value string) {
+	publisher.discoveryPrefix = value
+}
+
+// Start publishes the discovery messages of all known devices and keeps them in sync with the device registry.
+// Devices are published when they connect or are discovered and removed when they are deregistered.
+// Failed publishes are logged with the logger of the SonoffBasicR2. Calling Start again restarts the publisher.
+func (publisher *Publisher) Start() error {
+	publisher.Stop()
+
+	publisher.stopEvents = publisher.sonoffBasicR2.OnDeviceEvent(publisher.handleDeviceEvent)
+
+	for _, device := range publisher.sonoffBasicR2.Devices() {
+		if err := publisher.PublishDevice(device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop stops following the device registry. The published discovery messages are kept, so the entities stay in Home Assistant.
+func (publisher *Publisher) Stop() {
+	if publisher.stopEvents != nil {
+		publisher.stopEvents()
+		publisher.stopEvents = nil
+	}
+}
+
+// handleDeviceEvent publishes or removes the discovery messages of the device of the registry event.
+func (publisher *Publisher) handleDeviceEvent(event sonoff.DeviceEvent) {
+	var err error
+
+	switch event.Type {
+	case sonoff.DeviceEventConnected:
+		if !publisher.isPublished(event.Device.ID) {
+			err = publisher.PublishDevice(event.Device)
+		}
+	case sonoff.DeviceEventDiscovered:
+		err = publisher.PublishDevice(event.Device)
+	case sonoff.DeviceEventDeregistered:
+		err = publisher.RemoveDevice(event.Device)
+	}
+
+	if err != nil {
+		publisher.sonoffBasicR2.GetLogger().Error("home assistant discovery failed", sonoff.LogKeyDevice, event.Device.ID, sonoff.LogKeyError, err)
+	}
+}
+
+// PublishDevice publishes the retained discovery messages of the relay and the diagnostic sensors of the device.
+func (publisher *Publisher) PublishDevice(device sonoff.Device) error {
+	if err := publisher.publish(publisher.getSwitchTopic(device.ID), NewSwitchConfig(device)); err != nil {
+		return err
+	}
+
+	for _, sensorConfig := range sensors {
+		if err := publisher.publish(publisher.getSensorTopic(device.ID, sensorConfig.key), newSensorConfig(device, sensorConfig)); err != nil {
+			return err
+		}
+	}
+
+	publisher.mutex.Lock()
+	publisher.published[device.ID] = true
+	publisher.mutex.Unlock()
+
+	return nil
+}
+
+// RemoveDevice clears the retained discovery messages of the device, which removes its entities from Home Assistant.
+func (publisher *Publisher) RemoveDevice(device sonoff.Device) error {
+	if err := publisher.clear(publisher.getSwitchTopic(device.ID)); err != nil {
+		return err
+	}
+
+	for _, sensorConfig := range sensors {
+		if err := publisher.clear(publisher.getSensorTopic(device.ID, sensorConfig.key)); err != nil {
+			return err
+		}
+	}
+
+	publisher.mutex.Lock()
+	delete(publisher.published, device.ID)
+	publisher.mutex.Unlock()
+
+	return nil
+}
+
+// NewSwitchConfig builds the discovery payload of the relay of the device.
+// The availability is bound to the LWT topic of the device.
+func NewSwitchConfig(device sonoff.Device) SwitchConfig {
+	stateTexts := getStateTexts(device)
+
+	return SwitchConfig{
+		Name:                "Relay",
+		UniqueID:            device.ID + "_relay",
+		ObjectID:            device.ID + "_relay",
+		CommandTopic:        device.GetFullTopic(sonoff.TasmotaPrefixCmnd, sonoff.TasmotaCmndTopicPower),
+		StateTopic:          device.GetFullTopic(sonoff.TasmotaPrefixStat, sonoff.TasmotaCmndTopicPower),
+		PayloadOn:           sonoff.TasmotaCmndTopicPowerValueOn,
+		PayloadOff:          sonoff.TasmotaCmndTopicPowerValueOff,
+		StateOn:             stateTexts[1],
+		StateOff:            stateTexts[0],
+		AvailabilityTopic:   device.GetFullTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT),
+		PayloadAvailable:    getOnlinePayload(device),
+		PayloadNotAvailable: getOfflinePayload(device),
+		Device:              newDevice(device),
+	}
+}
+
+// newSensorConfig builds the discovery payload of a diagnostic sensor of the device.
+func newSensorConfig(device sonoff.Device, sensorConfig sensor) SensorConfig {
+	return SensorConfig{
+		Name:                sensorConfig.name,
+		UniqueID:            device.ID + "_" + sensorConfig.key,
+		ObjectID:            device.ID + "_" + sensorConfig.key,
+		StateTopic:          device.GetFullTopic(sonoff.TasmotaPrefixTele, TasmotaTeleTopicState),
+		ValueTemplate:       sensorConfig.valueTemplate,
+		UnitOfMeasurement:   sensorConfig.unitOfMeasurement,
+		DeviceClass:         sensorConfig.deviceClass,
+		StateClass:          "measurement",
+		EntityCategory:      EntityCategoryDiagnostic,
+		AvailabilityTopic:   device.GetFullTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT),
+		PayloadAvailable:    getOnlinePayload(device),
+		PayloadNotAvailable: getOfflinePayload(device),
+		Device:              newDevice(device),
+	}
+}
+
+// newDevice builds the device description shared by all entities of the device.
+func newDevice(device sonoff.Device) Device {
+	result := Device{
+		Identifiers:  []string{device.ID},
+		Name:         device.ID,
+		Manufacturer: "Sonoff",
+		Model:        "Basic R2",
+	}
+
+	if device.Discovery != nil {
+		result.SwVersion = device.Discovery.SoftwareVersion
+
+		if device.Discovery.DeviceName != "" {
+			result.Name = device.Discovery.DeviceName
+		}
+
+		if device.Discovery.MAC != "" {
+			result.Connections = [][]string{{"mac", device.Discovery.MAC}}
+		}
+	}
+
+	return result
+}
+
+// getStateTexts returns the OFF and ON state texts of the device.
+func getStateTexts(device sonoff.Device) []string {
+	if device.Discovery != nil && len(device.Discovery.StateTexts) >= 2 {
+		return device.Discovery.StateTexts
+	}
+
+	return []string{sonoff.TasmotaCmndTopicPowerValueOff, sonoff.TasmotaCmndTopicPowerValueOn}
+}
+
+// getOnlinePayload returns the LWT payload of the device when it is online.
+func getOnlinePayload(device sonoff.Device) string {
+	if device.Discovery != nil && device.Discovery.OnlinePayload != "" {
+		return device.Discovery.OnlinePayload
+	}
+
+	return sonoff.TasmotaTeleTopicLWTResponseOnline
+}
+
+// getOfflinePayload returns the LWT payload of the device when it is offline.
+func getOfflinePayload(device sonoff.Device) string {
+	if device.Discovery != nil && device.Discovery.OfflinePayload != "" {
+		return device.Discovery.OfflinePayload
+	}
+
+	return sonoff.TasmotaTeleTopicLWTResponseOffline
+}
+
+// isPublished reports whether the discovery messages of the device were already published.
+func (publisher *Publisher) isPublished(id string) bool {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	return publisher.published[id]
+}
+
+// publish publishes the retained discovery message.
+func (publisher *Publisher) publish(topic string, config any) error {
+	payload, err := json.Marshal(config)
+
+	if err != nil {
+		return err
+	}
+
+	return publisher.sonoffBasicR2.Server().Publish(topic, payload, true, publisher.sonoffBasicR2.GetQos())
+}
+
+// clear removes the retained discovery message.
+func (publisher *Publisher) clear(topic string) error {
+	return publisher.sonoffBasicR2.Server().Publish(topic, []byte{}, true, publisher.sonoffBasicR2.GetQos())
+}
+
+// getSwitchTopic constructs the discovery topic of the relay: homeassistant/switch/<id>/config.
+func (publisher *Publisher) getSwitchTopic(id string) string {
+	return fmt.Sprintf("%s/%s/%s/config", publisher.discoveryPrefix, ComponentSwitch, id)
+}
+
+// getSensorTopic constructs the discovery topic of a diagnostic sensor: homeassistant/sensor/<id>/<key>/config.
+func (publisher *Publisher) getSensorTopic(id string, key string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", publisher.discoveryPrefix, ComponentSensor, id, key)
+}
@@ -0,0 +1,186 @@
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func newServer(t *testing.T) (*sonoff.SonoffBasicR2, *mqtt.Server, func() []message) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2WithServer(server, 0)
+
+	assert.NoError(t, err)
+	assert.NoError(t, sonoffServer.Serve())
+
+	go func() {
+		for range sonoffServer.TeleConnected() {
+		}
+	}()
+
+	var mutex sync.Mutex
+	messages := make([]message, 0)
+
+	err = server.Subscribe(DefaultDiscoveryPrefix+"/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		messages = append(messages, message{topic: pk.TopicName, payload: pk.Payload, retain: pk.FixedHeader.Retain})
+	})
+
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = sonoffServer.Close()
+		_ = server.Close()
+	})
+
+	return sonoffServer, server, func() []message {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return append([]message{}, messages...)
+	}
+}
+
+func TestPublisher_Start(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	publisher := NewPublisher(sonoffServer)
+
+	assert.Equal(t, DefaultDiscoveryPrefix, publisher.GetDiscoveryPrefix())
+	assert.NoError(t, publisher.Start())
+	assert.Len(t, messages(), 0)
+
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	published := messages()
+
+	assert.Len(t, published, 4)
+	assert.Equal(t, "homeassistant/switch/sonoff/config", published[0].topic)
+	assert.Equal(t, "homeassistant/sensor/sonoff/rssi/config", published[1].topic)
+	assert.Equal(t, "homeassistant/sensor/sonoff/uptime/config", published[2].topic)
+	assert.Equal(t, "homeassistant/sensor/sonoff/heap/config", published[3].topic)
+	assert.Equal(t, true, published[0].retain)
+
+	var switchConfig SwitchConfig
+
+	assert.NoError(t, json.Unmarshal(published[0].payload, &switchConfig))
+	assert.Equal(t, "cmnd/sonoff/POWER", switchConfig.CommandTopic)
+	assert.Equal(t, "tele/sonoff/LWT", switchConfig.AvailabilityTopic)
+
+	var sensorConfig SensorConfig
+
+	assert.NoError(t, json.Unmarshal(published[1].payload, &sensorConfig))
+	assert.Equal(t, "tele/sonoff/STATE", sensorConfig.StateTopic)
+	assert.Equal(t, EntityCategoryDiagnostic, sensorConfig.EntityCategory)
+
+	// A reconnect of an already published device publishes nothing
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.Len(t, messages(), 4)
+
+	assert.Equal(t, true, sonoffServer.Deregister("sonoff"))
+
+	published = messages()
+
+	assert.Len(t, published, 8)
+
+	for _, removed := range published[4:] {
+		assert.Len(t, removed.payload, 0)
+		assert.Equal(t, true, removed.retain)
+	}
+}
+
+func TestPublisher_StartWithKnownDevices(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	publisher := NewPublisher(sonoffServer)
+	publisher.SetDiscoveryPrefix("ha")
+
+	assert.Equal(t, "ha", publisher.GetDiscoveryPrefix())
+	assert.NoError(t, publisher.Start())
+
+	// Messages are published under the custom prefix, which the test does not subscribe to
+	assert.Len(t, messages(), 0)
+}
+
+func TestPublisher_Stop(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	publisher := NewPublisher(sonoffServer)
+
+	// A second Start replaces the registration of the first one
+	assert.NoError(t, publisher.Start())
+	assert.NoError(t, publisher.Start())
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.Len(t, messages(), 4)
+	assert.Equal(t, true, sonoffServer.Deregister("sonoff"))
+	assert.Len(t, messages(), 8)
+
+	publisher.Stop()
+	publisher.Stop()
+
+	assert.NoError(t, server.Publish("tele/kitchen/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.Len(t, messages(), 8)
+}
+
+func TestPublisher_LogsFailedPublish(t *testing.T) {
+	sonoffServer, server, _ := newServer(t)
+
+	var output bytes.Buffer
+
+	sonoffServer.SetLogger(slog.New(slog.NewTextHandler(&output, nil)))
+
+	// A wildcard in the discovery prefix makes every publish fail
+	publisher := NewPublisher(sonoffServer)
+	publisher.SetDiscoveryPrefix("ha/#")
+
+	assert.NoError(t, publisher.Start())
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.Contains(t, output.String(), `msg="home assistant discovery failed" device=sonoff`)
+}
+
+func TestNewSwitchConfig(t *testing.T) {
+	device := sonoff.Device{
+		ID: "sonoff",
+		Discovery: &sonoff.DiscoveryConfig{
+			Topic:           "sonoff",
+			DeviceName:      "Pump",
+			MAC:             "A4CF12ABCDEF",
+			SoftwareVersion: "12.5.0",
+			FullTopic:       "home/%topic%/%prefix%/",
+			StateTexts:      []string{"AUS", "AN", "UMSCHALTEN", "HALTEN"},
+			OnlinePayload:   "Up",
+			OfflinePayload:  "Down",
+		},
+	}
+
+	config := NewSwitchConfig(device)
+
+	assert.Equal(t, "sonoff_relay", config.UniqueID)
+	assert.Equal(t, "home/sonoff/cmnd/POWER", config.CommandTopic)
+	assert.Equal(t, "home/sonoff/stat/POWER", config.StateTopic)
+	assert.Equal(t, "home/sonoff/tele/LWT", config.AvailabilityTopic)
+	assert.Equal(t, "AN", config.StateOn)
+	assert.Equal(t, "AUS", config.StateOff)
+	assert.Equal(t, "Up", config.PayloadAvailable)
+	assert.Equal(t, "Down", config.PayloadNotAvailable)
+	assert.Equal(t, "Pump", config.Device.Name)
+	assert.Equal(t, "12.5.0", config.Device.SwVersion)
+	assert.Equal(t, [][]string{{"mac", "A4CF12ABCDEF"}}, config.Device.Connections)
+}
@@ -0,0 +1,403 @@
+// Package homie bridges the relays managed by SonoffBasicR2 to the Homie MQTT convention.
+// Every device is exposed as a Homie device with a "relay" node (settable boolean "power")
+// and a "status" node (read-only "rssi" and "uptime").
+// See: https://homieiot.github.io/specification/
+package homie
+
+import (
+	"context"
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBaseTopic is the default base topic of the Homie convention.
+const DefaultBaseTopic = "homie"
+
+// Version is the version of the Homie convention implemented by the bridge.
+const Version = "4.0.0"
+
+// DefaultSetQueueSize is the number of set commands buffered while the bridge waits for the devices.
+const DefaultSetQueueSize = 64
+
+// Homie device states
+const (
+	StateInit         = "init"
+	StateReady        = "ready"
+	StateDisconnected = "disconnected"
+	StateLost         = "lost"
+)
+
+// Homie nodes and properties of a Sonoff Basic R2
+const (
+	NodeRelay         = "relay"
+	NodeStatus        = "status"
+	PropertyPower     = "power"
+	PropertyRSSI      = "rssi"
+	PropertyUptime    = "uptime"
+	PropertySetSuffix = "set"
+)
+
+// Homie payloads and data types
+const (
+	PayloadTrue     = "true"
+	PayloadFalse    = "false"
+	DataTypeBoolean = "boolean"
+	DataTypeInteger = "integer"
+)
+
+// Homie attributes of devices, nodes and properties
+const (
+	AttributeHomie      = "$homie"
+	AttributeName       = "$name"
+	AttributeState      = "$state"
+	AttributeNodes      = "$nodes"
+	AttributeType       = "$type"
+	AttributeProperties = "$properties"
+	AttributeDataType   = "$datatype"
+	AttributeSettable   = "$settable"
+	AttributeUnit       = "$unit"
+)
+
+// invalidID matches the characters that are not allowed in Homie IDs.
+var invalidID = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// ToHomieID converts a Tasmota topic into a valid Homie ID (lowercase letters, digits and hyphens).
+func ToHomieID(id string) string {
+	return strings.Trim(invalidID.ReplaceAllString(strings.ToLower(id), "-"), "-")
+}
+
+// Bridge exposes the devices of a SonoffBasicR2 as Homie devices.
+// It translates homie/<id>/relay/power/set into PowerOn/PowerOff and mirrors the device state back.
+// The state is mirrored from the device registry, so telemetry tracking should be enabled (see SetTelemetryTracking).
+type Bridge struct {
+	sonoffBasicR2  *sonoff.SonoffBasicR2
+	baseTopic      string
+	subscriptionId int
+	mutex          sync.Mutex
+	devices        map[string]string
+	queue          chan setCommand
+	cancel         context.CancelFunc
+	done           chan struct{}
+	stopEvents     func()
+}
+
+// setCommand is a power state requested on a set topic.
+type setCommand struct {
+	id    string
+	power bool
+}
+
+// NewBridge creates a Homie bridge for the devices of the given SonoffBasicR2.
+func NewBridge(sonoffBasicR2 *sonoff.SonoffBasicR2) *Bridge {
+	return &Bridge{
+		sonoffBasicR2:  sonoffBasicR2,
+		baseTopic:      DefaultBaseTopic,
+		subscriptionId: rand.New(rand.NewSource(time.Now().UnixNano())).Intn(math.MaxInt32),
+		devices:        make(map[string]string),
+	}
+}
+
+// GetBaseTopic returns the base topic of the Homie devices.
+func (bridge *Bridge) GetBaseTopic() string {
+	return bridge.baseTopic
+}
+
+// SetBaseTopic sets the base topic of the Homie devices.
+func (bridge *Bridge) SetBaseTopic(value string) {
+	bridge.baseTopic = value
+}
+
+// Start subscribes to the set topics, publishes all known devices and keeps them in sync with the device registry.
+// The set commands are sent one after another by a worker, so a slow device never blocks the broker.
+func (bridge *Bridge) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	bridge.queue = make(chan setCommand, DefaultSetQueueSize)
+	bridge.cancel = cancel
+	bridge.done = make(chan struct{})
+
+	go bridge.run(ctx, bridge.queue, bridge.done)
+
+	topicSet := bridge.getTopic("+", NodeRelay, PropertyPower, PropertySetSuffix)
+
+	err := bridge.sonoffBasicR2.Server().Subscribe(topicSet, bridge.subscriptionId, bridge.handleSet)
+
+	if err != nil {
+		bridge.stopWorker()
+
+		return err
+	}
+
+	bridge.stopEvents = bridge.sonoffBasicR2.OnDeviceEvent(bridge.handleDeviceEvent)
+
+	for _, device := range bridge.sonoffBasicR2.Devices() {
+		if err := bridge.PublishDevice(device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop unsubscribes from the set topics and the device registry, cancels the pending set commands and marks all devices as disconnected.
+func (bridge *Bridge) Stop() error {
+	topicSet := bridge.getTopic("+", NodeRelay, PropertyPower, PropertySetSuffix)
+
+	err := bridge.sonoffBasicR2.Server().Unsubscribe(topicSet, bridge.subscriptionId)
+
+	if err != nil {
+		return err
+	}
+
+	if bridge.stopEvents != nil {
+		bridge.stopEvents()
+		bridge.stopEvents = nil
+	}
+
+	bridge.stopWorker()
+
+	bridge.mutex.Lock()
+	homieIDs := make([]string, 0, len(bridge.devices))
+
+	for homieID := range bridge.devices {
+		homieIDs = append(homieIDs, homieID)
+	}
+
+	bridge.mutex.Unlock()
+
+	for _, homieID := range homieIDs {
+		if err := bridge.publish(bridge.getTopic(homieID, AttributeState), StateDisconnected); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PublishDevice publishes the description of the device together with its current state and values.
+func (bridge *Bridge) PublishDevice(device sonoff.Device) error {
+	homieID := ToHomieID(device.ID)
+
+	bridge.mutex.Lock()
+	bridge.devices[homieID] = device.ID
+	bridge.mutex.Unlock()
+
+	for _, attribute := range bridge.getAttributes(homieID, device) {
+		if err := bridge.publish(attribute[0], attribute[1]); err != nil {
+			return err
+		}
+	}
+
+	if err := bridge.publishValues(device); err != nil {
+		return err
+	}
+
+	return bridge.publishState(device)
+}
+
+// RemoveDevice clears the retained topics of the device, which removes it from Homie controllers.
+func (bridge *Bridge) RemoveDevice(device sonoff.Device) error {
+	homieID := ToHomieID(device.ID)
+
+	bridge.mutex.Lock()
+	delete(bridge.devices, homieID)
+	bridge.mutex.Unlock()
+
+	topics := []string{
+		bridge.getTopic(homieID, NodeRelay, PropertyPower),
+		bridge.getTopic(homieID, NodeStatus, PropertyRSSI),
+		bridge.getTopic(homieID, NodeStatus, PropertyUptime),
+	}
+
+	for _, attribute := range bridge.getAttributes(homieID, device) {
+		topics = append(topics, attribute[0])
+	}
+
+	for _, topic := range topics {
+		if err := bridge.publish(topic, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getAttributes returns the topics and payloads describing the device, its nodes and properties.
+// The $state attribute comes first, so controllers see the device in the init state while it is described.
+func (bridge *Bridge) getAttributes(homieID string, device sonoff.Device) [][2]string {
+	return [][2]string{
+		{bridge.getTopic(homieID, AttributeState), StateInit},
+		{bridge.getTopic(homieID, AttributeHomie), Version},
+		{bridge.getTopic(homieID, AttributeName), device.ID},
+		{bridge.getTopic(homieID, AttributeNodes), NodeRelay + "," + NodeStatus},
+		{bridge.getTopic(homieID, NodeRelay, AttributeName), "Relay"},
+		{bridge.getTopic(homieID, NodeRelay, AttributeType), "Sonoff Basic R2"},
+		{bridge.getTopic(homieID, NodeRelay, AttributeProperties), PropertyPower},
+		{bridge.getTopic(homieID, NodeRelay, PropertyPower, AttributeName), "Power"},
+		{bridge.getTopic(homieID, NodeRelay, PropertyPower, AttributeDataType), DataTypeBoolean},
+		{bridge.getTopic(homieID, NodeRelay, PropertyPower, AttributeSettable), PayloadTrue},
+		{bridge.getTopic(homieID, NodeStatus, AttributeName), "Status"},
+		{bridge.getTopic(homieID, NodeStatus, AttributeType), "Tasmota"},
+		{bridge.getTopic(homieID, NodeStatus, AttributeProperties), PropertyRSSI + "," + PropertyUptime},
+		{bridge.getTopic(homieID, NodeStatus, PropertyRSSI, AttributeName), "RSSI"},
+		{bridge.getTopic(homieID, NodeStatus, PropertyRSSI, AttributeDataType), DataTypeInteger},
+		{bridge.getTopic(homieID, NodeStatus, PropertyRSSI, AttributeUnit), "%"},
+		{bridge.getTopic(homieID, NodeStatus, PropertyUptime, AttributeName), "Uptime"},
+		{bridge.getTopic(homieID, NodeStatus, PropertyUptime, AttributeDataType), DataTypeInteger},
+		{bridge.getTopic(homieID, NodeStatus, PropertyUptime, AttributeUnit), "s"},
+	}
+}
+
+// handleDeviceEvent mirrors changes in the device registry to the Homie topics.
+func (bridge *Bridge) handleDeviceEvent(event sonoff.DeviceEvent) {
+	switch event.Type {
+	case sonoff.DeviceEventConnected, sonoff.DeviceEventDiscovered:
+		if !bridge.isPublished(event.Device.ID) {
+			_ = bridge.PublishDevice(event.Device)
+
+			return
+		}
+
+		_ = bridge.publishState(event.Device)
+	case sonoff.DeviceEventDisconnected:
+		_ = bridge.publishState(event.Device)
+	case sonoff.DeviceEventStateUpdated:
+		if bridge.isPublished(event.Device.ID) {
+			_ = bridge.publishValues(event.Device)
+		}
+	case sonoff.DeviceEventDeregistered:
+		_ = bridge.RemoveDevice(event.Device)
+	}
+}
+
+// handleSet translates homie/<id>/relay/power/set into PowerOn/PowerOff.
+func (bridge *Bridge) handleSet(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	parts := strings.Split(strings.TrimPrefix(pk.TopicName, bridge.baseTopic+"/"), "/")
+
+	if len(parts) != 4 {
+		return
+	}
+
+	bridge.mutex.Lock()
+	id, ok := bridge.devices[parts[0]]
+	bridge.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var command setCommand
+
+	switch string(pk.Payload) {
+	case PayloadTrue:
+		command = setCommand{id: id, power: true}
+	case PayloadFalse:
+		command = setCommand{id: id, power: false}
+	default:
+		return
+	}
+
+	// The handler runs in the goroutine of the publishing client, so it must not wait for the device
+	select {
+	case bridge.queue <- command:
+	default:
+		bridge.sonoffBasicR2.GetLogger().Warn("homie set dropped, queue is full", sonoff.LogKeyDevice, id)
+	}
+}
+
+// run sends the queued set commands until the context is canceled.
+func (bridge *Bridge) run(ctx context.Context, queue <-chan setCommand, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case command := <-queue:
+			// Failed commands are logged by SonoffBasicR2, the state is mirrored back once the device reports it
+			if command.power {
+				_ = bridge.sonoffBasicR2.PowerOnContext(ctx, command.id)
+			} else {
+				_ = bridge.sonoffBasicR2.PowerOffContext(ctx, command.id)
+			}
+		}
+	}
+}
+
+// stopWorker cancels the command in progress and waits for the worker to return.
+func (bridge *Bridge) stopWorker() {
+	if bridge.cancel == nil {
+		return
+	}
+
+	bridge.cancel()
+
+	<-bridge.done
+}
+
+// publishState publishes the Homie state of the device: ready when online, lost otherwise.
+func (bridge *Bridge) publishState(device sonoff.Device) error {
+	state := StateLost
+
+	if device.Online {
+		state = StateReady
+	}
+
+	return bridge.publish(bridge.getTopic(ToHomieID(device.ID), AttributeState), state)
+}
+
+// publishValues publishes the property values of the device that are known.
+func (bridge *Bridge) publishValues(device sonoff.Device) error {
+	homieID := ToHomieID(device.ID)
+
+	if device.State.Power != "" {
+		power := PayloadFalse
+
+		if device.IsPowerOn() {
+			power = PayloadTrue
+		}
+
+		if err := bridge.publish(bridge.getTopic(homieID, NodeRelay, PropertyPower), power); err != nil {
+			return err
+		}
+	}
+
+	if device.State.UpdatedAt.IsZero() {
+		return nil
+	}
+
+	if err := bridge.publish(bridge.getTopic(homieID, NodeStatus, PropertyRSSI), strconv.Itoa(device.State.RSSI)); err != nil {
+		return err
+	}
+
+	return bridge.publish(bridge.getTopic(homieID, NodeStatus, PropertyUptime), strconv.Itoa(device.State.UptimeSec))
+}
+
+// isPublished reports whether the description of the device was already published.
+func (bridge *Bridge) isPublished(id string) bool {
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+
+	_, ok := bridge.devices[ToHomieID(id)]
+
+	return ok
+}
+
+// publish publishes a retained Homie message.
+func (bridge *Bridge) publish(topic string, payload string) error {
+	return bridge.sonoffBasicR2.Server().Publish(topic, []byte(payload), true, bridge.sonoffBasicR2.GetQos())
+}
+
+// getTopic constructs a Homie topic from the base topic and the given parts.
+func (bridge *Bridge) getTopic(parts ...string) string {
+	return fmt.Sprintf("%s/%s", bridge.baseTopic, strings.Join(parts, "/"))
+}
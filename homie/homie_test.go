@@ -0,0 +1,244 @@
+package homie
+
+import (
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mutex    sync.Mutex
+	messages map[string]string
+}
+
+func (r *recorder) handler(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.messages[pk.TopicName] = string(pk.Payload)
+}
+
+func (r *recorder) get(topic string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	payload, ok := r.messages[topic]
+
+	return payload, ok
+}
+
+func newServer(t *testing.T) (*sonoff.SonoffBasicR2, *mqtt.Server, *recorder) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2WithServer(server, 0)
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetTelemetryTracking(true)
+
+	assert.NoError(t, sonoffServer.Serve())
+
+	connected := sonoffServer.TeleConnected()
+	disconnected := sonoffServer.TeleDisconnected()
+
+	go func() {
+		for range connected {
+		}
+	}()
+
+	go func() {
+		for range disconnected {
+		}
+	}()
+
+	messages := &recorder{messages: make(map[string]string)}
+
+	assert.NoError(t, server.Subscribe(DefaultBaseTopic+"/#", 1, messages.handler))
+	assert.NoError(t, server.Subscribe(sonoff.TasmotaPrefixCmnd+"/#", 2, messages.handler))
+
+	t.Cleanup(func() {
+		_ = sonoffServer.Close()
+		_ = server.Close()
+	})
+
+	return sonoffServer, server, messages
+}
+
+func TestBridge_PublishDevice(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	bridge := NewBridge(sonoffServer)
+
+	assert.Equal(t, DefaultBaseTopic, bridge.GetBaseTopic())
+	assert.NoError(t, bridge.Start())
+
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	homie, _ := messages.get("homie/sonoff-pump/$homie")
+	state, _ := messages.get("homie/sonoff-pump/$state")
+	nodes, _ := messages.get("homie/sonoff-pump/$nodes")
+	settable, _ := messages.get("homie/sonoff-pump/relay/power/$settable")
+	datatype, _ := messages.get("homie/sonoff-pump/relay/power/$datatype")
+
+	assert.Equal(t, Version, homie)
+	assert.Equal(t, StateReady, state)
+	assert.Equal(t, "relay,status", nodes)
+	assert.Equal(t, PayloadTrue, settable)
+	assert.Equal(t, DataTypeBoolean, datatype)
+
+	_, ok := messages.get("homie/sonoff-pump/relay/power")
+
+	assert.Equal(t, false, ok)
+
+	// An empty retained payload would delete the attribute, so no extensions are announced
+	_, ok = messages.get("homie/sonoff-pump/$extensions")
+
+	assert.Equal(t, false, ok)
+
+	// State changes are mirrored back
+	assert.NoError(t, server.Publish("stat/Sonoff_Pump/POWER", []byte("ON"), false, 0))
+
+	power, _ := messages.get("homie/sonoff-pump/relay/power")
+
+	assert.Equal(t, PayloadTrue, power)
+
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/STATE", []byte(`{"UptimeSec":1623,"POWER":"OFF","Wifi":{"RSSI":68}}`), false, 0))
+
+	power, _ = messages.get("homie/sonoff-pump/relay/power")
+	rssi, _ := messages.get("homie/sonoff-pump/status/rssi")
+	uptime, _ := messages.get("homie/sonoff-pump/status/uptime")
+
+	assert.Equal(t, PayloadFalse, power)
+	assert.Equal(t, "68", rssi)
+	assert.Equal(t, "1623", uptime)
+
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOffline), true, 0))
+
+	state, _ = messages.get("homie/sonoff-pump/$state")
+
+	assert.Equal(t, StateLost, state)
+
+	assert.Equal(t, true, sonoffServer.Deregister("Sonoff_Pump"))
+
+	homie, _ = messages.get("homie/sonoff-pump/$homie")
+	power, _ = messages.get("homie/sonoff-pump/relay/power")
+
+	assert.Equal(t, "", homie)
+	assert.Equal(t, "", power)
+}
+
+func TestBridge_Set(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	bridge := NewBridge(sonoffServer)
+
+	assert.NoError(t, bridge.Start())
+
+	isCommand := func(value string) func() bool {
+		return func() bool {
+			command, _ := messages.get("cmnd/Sonoff_Pump/POWER")
+
+			return command == value
+		}
+	}
+
+	assert.NoError(t, server.Publish("homie/sonoff-pump/relay/power/set", []byte(PayloadTrue), false, 0))
+	assert.Eventually(t, isCommand(sonoff.TasmotaCmndTopicPowerValueOn), time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, server.Publish("homie/sonoff-pump/relay/power/set", []byte(PayloadFalse), false, 0))
+	assert.Eventually(t, isCommand(sonoff.TasmotaCmndTopicPowerValueOff), time.Second, 10*time.Millisecond)
+
+	// Unknown devices and payloads are ignored
+	assert.NoError(t, server.Publish("homie/unknown/relay/power/set", []byte(PayloadTrue), false, 0))
+	assert.NoError(t, server.Publish("homie/sonoff-pump/relay/power/set", []byte("on"), false, 0))
+
+	assert.Never(t, func() bool {
+		_, ok := messages.get("cmnd/unknown/POWER")
+
+		return ok || !isCommand(sonoff.TasmotaCmndTopicPowerValueOff)()
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	assert.NoError(t, bridge.Stop())
+
+	state, _ := messages.get("homie/sonoff-pump/$state")
+
+	assert.Equal(t, StateDisconnected, state)
+}
+
+func TestBridge_Stop(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	bridge := NewBridge(sonoffServer)
+
+	assert.NoError(t, bridge.Start())
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.NoError(t, bridge.Stop())
+
+	state, _ := messages.get("homie/sonoff-pump/$state")
+
+	assert.Equal(t, StateDisconnected, state)
+
+	// Device events after Stop are not mirrored anymore
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.NoError(t, server.Publish("tele/Sonoff_Valve/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	state, _ = messages.get("homie/sonoff-pump/$state")
+
+	assert.Equal(t, StateDisconnected, state)
+
+	_, ok := messages.get("homie/sonoff-valve/$homie")
+
+	assert.Equal(t, false, ok)
+
+	// A second Start mirrors the events again
+	assert.NoError(t, bridge.Start())
+
+	state, _ = messages.get("homie/sonoff-valve/$state")
+
+	assert.Equal(t, StateReady, state)
+
+	assert.NoError(t, bridge.Stop())
+}
+
+func TestBridge_SetDoesNotBlock(t *testing.T) {
+	sonoffServer, server, messages := newServer(t)
+
+	// The device never confirms, so every command waits for the response timeout
+	sonoffServer.SetPowerConfirmation(true)
+
+	assert.NoError(t, server.Publish("tele/Sonoff_Pump/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+
+	bridge := NewBridge(sonoffServer)
+
+	assert.NoError(t, bridge.Start())
+
+	start := time.Now()
+
+	assert.NoError(t, server.Publish("homie/sonoff-pump/relay/power/set", []byte(PayloadTrue), false, 0))
+	assert.NoError(t, server.Publish("homie/sonoff-pump/relay/power/set", []byte(PayloadFalse), false, 0))
+	assert.Less(t, time.Since(start), time.Second)
+
+	assert.Eventually(t, func() bool {
+		command, _ := messages.get("cmnd/Sonoff_Pump/POWER")
+
+		return command == sonoff.TasmotaCmndTopicPowerValueOn
+	}, time.Second, 10*time.Millisecond)
+
+	// Stop cancels the command waiting for the confirmation
+	start = time.Now()
+
+	assert.NoError(t, bridge.Stop())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestToHomieID(t *testing.T) {
+	assert.Equal(t, "sonoff-pump", ToHomieID("Sonoff_Pump"))
+	assert.Equal(t, "tasmota-abcdef", ToHomieID("tasmota_ABCDEF"))
+	assert.Equal(t, "kitchen", ToHomieID("_kitchen_"))
+}
@@ -0,0 +1,511 @@
+package mqtt_sonoff_basic_r2_test
+
+import (
+	"context"
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"github.com/fromsi/mqtt_sonoff_basic_r2/sonoffsim"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	mqttauth "github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The integration tests run SonoffBasicR2 with its embedded broker on a loopback port and simulated Tasmota devices,
+// so topic matching, QoS and LWT handling go through a real broker. They are skipped with -short.
+
+func skipShort(t *testing.T) {
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+}
+
+func getFreeAddress(t *testing.T) (string, uint16) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	require.NoError(t, err)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	require.NoError(t, listener.Close())
+
+	return fmt.Sprintf("127.0.0.1:%d", port), uint16(port)
+}
+
+func newIntegrationServer(t *testing.T, qos byte) (*sonoff.SonoffBasicR2, string) {
+	address, port := getFreeAddress(t)
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2("127.0.0.1", port, qos)
+
+	require.NoError(t, err)
+
+	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(1)
+
+	return sonoffServer, address
+}
+
+func serveIntegration(sonoffServer *sonoff.SonoffBasicR2) {
+	go func() {
+		_ = sonoffServer.Serve()
+	}()
+}
+
+func startDevice(t *testing.T, id string, address string) *sonoffsim.Device {
+	device := sonoffsim.NewDevice(id, address)
+
+	device.SetReconnectDelay(50 * time.Millisecond)
+
+	// The listener of the broker starts in the background
+	require.Eventually(t, func() bool {
+		return device.Start() == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	return device
+}
+
+func receiveID(t *testing.T, channel <-chan string) string {
+	select {
+	case id := <-channel:
+		return id
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no device reported")
+
+		return ""
+	}
+}
+
+func TestIntegration_ConnectDisconnect(t *testing.T) {
+	skipShort(t)
+
+	sonoffServer, address := newIntegrationServer(t, 0)
+
+	serveIntegration(sonoffServer)
+
+	device := startDevice(t, "kitchen", address)
+
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleConnected()))
+
+	registered, ok := sonoffServer.Device("kitchen")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, registered.Online)
+	assert.Equal(t, device.GetClientID(), registered.Session.ClientID)
+
+	// A graceful stop publishes "Offline" itself
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleDisconnected()))
+
+	registered, _ = sonoffServer.Device("kitchen")
+
+	assert.Equal(t, false, registered.Online)
+
+	// A reboot drops the connection, so the broker publishes the will
+	device = startDevice(t, "kitchen", address)
+
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleConnected()))
+	assert.NoError(t, device.Reboot(10*time.Millisecond))
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleConnected()))
+
+	statusOne, err := sonoffServer.StatusOne("kitchen")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, statusOne.BootCount)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "kitchen", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestIntegration_RetainedLWT(t *testing.T) {
+	skipShort(t)
+
+	address, port := getFreeAddress(t)
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "integration", Address: fmt.Sprintf("127.0.0.1:%d", port)})))
+	require.NoError(t, server.AddHook(new(mqttauth.AllowHook), nil))
+	require.NoError(t, server.Serve())
+
+	// The device is online before SonoffBasicR2 subscribes to the LWT topics
+	device := startDevice(t, "hall", address)
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2WithServer(server, 0)
+
+	require.NoError(t, err)
+
+	serveIntegration(sonoffServer)
+
+	assert.Equal(t, "hall", receiveID(t, sonoffServer.TeleConnected()))
+
+	status, err := sonoffServer.StatusEleven("hall")
+
+	assert.NoError(t, err)
+	assert.Equal(t, sonoffsim.DefaultRSSI, status.Wifi.RSSI)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "hall", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+	assert.NoError(t, server.Close())
+}
+
+func TestIntegration_Status(t *testing.T) {
+	skipShort(t)
+
+	for _, qos := range []byte{0, 1, 2} {
+		t.Run(fmt.Sprintf("qos %d", qos), func(t *testing.T) {
+			sonoffServer, address := newIntegrationServer(t, qos)
+
+			serveIntegration(sonoffServer)
+
+			device := startDevice(t, "office", address)
+
+			device.SetVersion("12.5.0(tasmota)")
+			device.SetHeap(21)
+
+			assert.Equal(t, "office", receiveID(t, sonoffServer.TeleConnected()))
+
+			status, err := sonoffServer.Status("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, "office", status.Status.Topic)
+			assert.Equal(t, "12.5.0(tasmota)", status.StatusFWR.Version)
+
+			statusOne, err := sonoffServer.StatusOne("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, sonoffsim.RestartReasonPowerOn, statusOne.RestartReason)
+
+			statusTwo, err := sonoffServer.StatusTwo("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, "12.5.0(tasmota)", statusTwo.Version)
+
+			statusThree, err := sonoffServer.StatusThree("office")
+
+			assert.NoError(t, err)
+			assert.NotEmpty(t, statusThree.SetOption)
+
+			statusFour, err := sonoffServer.StatusFour("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, 21, statusFour.Heap)
+
+			statusFive, err := sonoffServer.StatusFive("office")
+
+			assert.NoError(t, err)
+			assert.NotEmpty(t, statusFive.Mac)
+
+			statusSix, err := sonoffServer.StatusSix("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, device.GetClientID(), statusSix.MqttClient)
+
+			statusSeven, err := sonoffServer.StatusSeven("office")
+
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now(), statusSeven.UTC, time.Minute)
+
+			statusEight, err := sonoffServer.StatusEight("office")
+
+			assert.NoError(t, err)
+			assert.False(t, statusEight.Time.ToTime().IsZero())
+
+			statusEleven, err := sonoffServer.StatusEleven("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOff, statusEleven.POWER)
+
+			enabled, err := sonoffServer.StatusPhysicalButton("office")
+
+			assert.NoError(t, err)
+			assert.Equal(t, true, enabled)
+
+			ids, err := sonoffServer.Discover()
+
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"office"}, ids)
+
+			assert.NoError(t, device.Stop())
+			assert.Equal(t, "office", receiveID(t, sonoffServer.TeleDisconnected()))
+			assert.NoError(t, sonoffServer.Close())
+		})
+	}
+}
+
+func TestIntegration_Power(t *testing.T) {
+	skipShort(t)
+
+	sonoffServer, address := newIntegrationServer(t, 1)
+
+	sonoffServer.SetTelemetryTracking(true)
+
+	serveIntegration(sonoffServer)
+
+	device := startDevice(t, "porch", address)
+
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleConnected()))
+
+	// Without confirmation the command is only published
+	assert.NoError(t, sonoffServer.PowerOn("porch"))
+	assert.Eventually(t, func() bool {
+		registered, _ := sonoffServer.Device("porch")
+
+		return registered.State.Power == sonoff.TasmotaCmndTopicPowerValueOn
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOn, device.GetPower())
+
+	sonoffServer.SetPowerConfirmation(true)
+
+	assert.NoError(t, sonoffServer.PowerOff("porch"))
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOff, device.GetPower())
+
+	// The stat/porch/POWER of the command must arrive before the next RESULT is awaited
+	assert.Eventually(t, func() bool {
+		registered, _ := sonoffServer.Device("porch")
+
+		return registered.State.Power == sonoff.TasmotaCmndTopicPowerValueOff
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sonoffServer.PowerToggle("porch"))
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOn, device.GetPower())
+
+	// SetOption73 is only published
+	assert.NoError(t, sonoffServer.PhysicalButtonOff("porch"))
+	assert.Eventually(t, func() bool {
+		return !device.GetPhysicalButton()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sonoffServer.PhysicalButtonOn("porch"))
+	assert.Eventually(t, device.GetPhysicalButton, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestIntegration_DryRunAfterServe(t *testing.T) {
+	skipShort(t)
+
+	sonoffServer, address := newIntegrationServer(t, 0)
+	store := sonoff.NewMemoryDesiredStateStore()
+
+	assert.NoError(t, store.SetDesiredPower("attic", sonoff.TasmotaCmndTopicPowerValueOff))
+
+	sonoffServer.SetDesiredStateStore(store)
+
+	serveIntegration(sonoffServer)
+
+	device := startDevice(t, "attic", address)
+
+	assert.Equal(t, "attic", receiveID(t, sonoffServer.TeleConnected()))
+
+	// The broker handlers are already running, they must still see the change,
+	// so the reconciliation after the reboot is only recorded
+	sonoffServer.SetDryRun(true)
+
+	assert.NoError(t, store.SetDesiredPower("attic", sonoff.TasmotaCmndTopicPowerValueOn))
+	assert.NoError(t, device.Reboot(10*time.Millisecond))
+	assert.Equal(t, "attic", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.Equal(t, "attic", receiveID(t, sonoffServer.TeleConnected()))
+	assert.Eventually(t, func() bool {
+		for _, command := range sonoffServer.DryRunCommands() {
+			if command.Topic == sonoff.TasmotaCmndTopicPower && command.Caller == sonoff.CallerReconciliation {
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOff, device.GetPower())
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "attic", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestIntegration_Timeout(t *testing.T) {
+	skipShort(t)
+
+	sonoffServer, address := newIntegrationServer(t, 0)
+
+	serveIntegration(sonoffServer)
+
+	device := startDevice(t, "garage", address)
+
+	assert.Equal(t, "garage", receiveID(t, sonoffServer.TeleConnected()))
+
+	// The device ignores the command
+	device.SetFailureRate(1)
+
+	_, err := sonoffServer.StatusTwo("garage")
+
+	assert.ErrorIs(t, err, sonoff.ErrTimeout)
+
+	// The device answers too late for the context
+	device.SetFailureRate(0)
+	device.SetLatency(500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = sonoffServer.StatusTwoContext(ctx, "garage")
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The device goes offline while the command is waiting
+	device.SetLatency(time.Hour)
+
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("garage")
+
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "garage", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.ErrorIs(t, <-result, sonoff.ErrDeviceOffline)
+
+	// Known offline devices fail fast
+	_, err = sonoffServer.StatusEleven("garage")
+
+	assert.ErrorIs(t, err, sonoff.ErrDeviceOffline)
+
+	// Unknown devices never answer
+	_, err = sonoffServer.StatusEleven("unknown")
+
+	assert.ErrorIs(t, err, sonoff.ErrTimeout)
+
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestIntegration_Shutdown(t *testing.T) {
+	skipShort(t)
+
+	sonoffServer, address := newIntegrationServer(t, 0)
+
+	serveIntegration(sonoffServer)
+
+	devices := make([]*sonoffsim.Device, 0)
+
+	for _, id := range []string{"attic", "cellar", "shed"} {
+		devices = append(devices, startDevice(t, id, address))
+
+		assert.Equal(t, id, receiveID(t, sonoffServer.TeleConnected()))
+	}
+
+	devices[0].SetLatency(time.Hour)
+
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("attic")
+
+		result <- err
+	}()
+
+	// Nobody reads TeleDisconnected, so the LWT handler of the second device is still sending during Close
+	assert.NoError(t, devices[1].Stop())
+	assert.NoError(t, devices[2].Stop())
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, sonoffServer.Close())
+	assert.ErrorIs(t, <-result, sonoff.ErrClosed)
+
+	_, ok := <-sonoffServer.TeleConnected()
+
+	assert.Equal(t, false, ok)
+
+	_, err := sonoffServer.Status("attic")
+
+	assert.ErrorIs(t, err, sonoff.ErrClosed)
+
+	// The broker is gone, so only the connection of the device is closed
+	_ = devices[0].Stop()
+}
+
+func TestIntegration_RecordReplay(t *testing.T) {
+	skipShort(t)
+
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recorder, err := sonoff.NewTrafficRecorder(path)
+
+	require.NoError(t, err)
+
+	// Record a session with a simulated device
+	sonoffServer, address := newIntegrationServer(t, 0)
+
+	require.NoError(t, sonoffServer.AddHook(recorder))
+
+	serveIntegration(sonoffServer)
+
+	device := startDevice(t, "porch", address)
+
+	device.SetRSSI(58)
+
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleConnected()))
+
+	recorded, err := sonoffServer.StatusEleven("porch")
+
+	require.NoError(t, err)
+	assert.NoError(t, sonoffServer.PowerOn("porch"))
+	assert.Eventually(t, func() bool {
+		return device.GetPower() == sonoff.TasmotaCmndTopicPowerValueOn
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+	assert.NoError(t, recorder.Close())
+	assert.NoError(t, recorder.Err())
+
+	records, err := sonoff.ReadTrafficRecording(path)
+
+	require.NoError(t, err)
+
+	// Replay the session without a device or a network listener
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+
+	sonoffServer, err = sonoff.NewSonoffBasicR2WithServer(server, 0)
+
+	require.NoError(t, err)
+	require.NoError(t, sonoffServer.Serve())
+
+	replayer, err := sonoff.NewTrafficReplayer(server, records)
+
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- replayer.Replay(ctx)
+	}()
+
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleConnected()))
+
+	replayed, err := sonoffServer.StatusEleven("porch")
+
+	assert.NoError(t, err)
+	assert.Equal(t, recorded, replayed)
+	assert.Equal(t, 58, replayed.Wifi.RSSI)
+
+	assert.NoError(t, sonoffServer.PowerOn("porch"))
+	assert.Equal(t, "porch", receiveID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, <-result)
+	assert.NoError(t, replayer.Close())
+	assert.NoError(t, sonoffServer.Close())
+}
@@ -0,0 +1,57 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"slices"
+)
+
+// CommandCall describes a single attempt of a command sent to a device.
+// ResponseTopic is empty for commands that do not wait for a response (POWER without confirmation, SetOption73).
+type CommandCall struct {
+	DeviceID      string
+	Command       string
+	Topic         string
+	Payload       string
+	ResponseTopic string
+}
+
+// CommandInvoker sends the command and returns the response of the device (empty when no response is expected).
+type CommandInvoker func(ctx context.Context, call CommandCall) (response string, err error)
+
+// CommandInterceptor wraps the invocation of a command, like gRPC client interceptors.
+// It may inspect or change the call, decide not to call the invoker, and inspect or change the response and the error.
+type CommandInterceptor func(ctx context.Context, call CommandCall, invoker CommandInvoker) (response string, err error)
+
+// GetInterceptors returns the interceptors around the commands.
+func (sonoffBasicR2 SonoffBasicR2) GetInterceptors() []CommandInterceptor {
+	return slices.Clone(sonoffBasicR2.getSettings().interceptors)
+}
+
+// SetInterceptors sets the interceptors called around every attempt of a command, after authorization and before the publish.
+// The first interceptor is the outermost one.
+func (sonoffBasicR2 *SonoffBasicR2) SetInterceptors(value ...CommandInterceptor) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.interceptors = slices.Clone(value)
+	})
+}
+
+// intercept calls the invoker through the chain of interceptors.
+// In dry-run mode the invoker is replaced, so the command is recorded instead of published.
+func (sonoffBasicR2 SonoffBasicR2) intercept(ctx context.Context, call CommandCall, invoker CommandInvoker) (string, error) {
+	settings := sonoffBasicR2.getSettings()
+
+	if settings.dryRun {
+		invoker = sonoffBasicR2.invokeDryRun
+	}
+
+	for i := len(settings.interceptors) - 1; i >= 0; i-- {
+		interceptor := settings.interceptors[i]
+		next := invoker
+
+		invoker = func(ctx context.Context, call CommandCall) (string, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+
+	return invoker(ctx, call)
+}
@@ -0,0 +1,97 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+)
+
+func TestSonoffBasicR2_Interceptors(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Empty(t, sonoffServer.GetInterceptors())
+
+	var calls []string
+
+	outer := func(ctx context.Context, call CommandCall, invoker CommandInvoker) (string, error) {
+		calls = append(calls, "outer "+call.Command)
+
+		response, err := invoker(ctx, call)
+
+		calls = append(calls, "outer done")
+
+		return response, err
+	}
+
+	inner := func(ctx context.Context, call CommandCall, invoker CommandInvoker) (string, error) {
+		calls = append(calls, "inner "+call.Payload)
+
+		// Rewrite the command on the way out and the response on the way back
+		if call.Command == TasmotaCmndTopicPower {
+			call.Payload = TasmotaCmndTopicPowerValueOff
+		}
+
+		response, err := invoker(ctx, call)
+
+		if response != "" {
+			response = `{"SetOption73":"OFF"}`
+		}
+
+		return response, err
+	}
+
+	sonoffServer.SetInterceptors(outer, inner)
+
+	assert.Equal(t, 2, len(sonoffServer.GetInterceptors()))
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"outer POWER", "inner ON", "outer done"}, calls)
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), []byte(TasmotaCmndTopicPowerValueOff), false, byte(1))
+
+	responseChan := make(chan bool, 1)
+
+	go func() {
+		enabled, err := sonoffServer.StatusPhysicalButton("1")
+
+		assert.NoError(t, err)
+
+		responseChan <- enabled
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicResult), Payload: []byte(`{"SetOption73":"ON"}`)})
+
+	// SetOption73 OFF means that the physical button is enabled
+	assert.Equal(t, true, <-responseChan)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_InterceptorShortCircuit(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetInterceptors(func(ctx context.Context, call CommandCall, invoker CommandInvoker) (string, error) {
+		return `{"StatusSTS":{"POWER":"ON"}}`, nil
+	})
+
+	status, err := sonoffServer.StatusEleven("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ON", status.POWER)
+
+	mockServer.AssertNotCalled(t, "Subscribe", sonoffServer.getFullStatTopic("1", TasmotaStatTopicStatusEleven), mock.Anything, mock.Anything)
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,61 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"io"
+	"log/slog"
+)
+
+// Keys of the attributes added to log records
+const (
+	LogKeyDevice   = "device"
+	LogKeyClientID = "client_id"
+	LogKeyCaller   = "caller"
+	LogKeyTopic    = "topic"
+	LogKeyCommand  = "command"
+	LogKeyDuration = "duration"
+	LogKeyAttempt  = "attempt"
+	LogKeyCircuit  = "circuit"
+	LogKeyPower    = "power"
+	LogKeyDesired  = "desired_power"
+	LogKeyPending  = "pending_commands"
+	LogKeyQueued   = "queued_commands"
+	LogKeyError    = "error"
+)
+
+// discardLogger is used until a logger is set with SetLogger.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// GetLogger returns the logger used by the library.
+func (sonoffBasicR2 SonoffBasicR2) GetLogger() *slog.Logger {
+	return sonoffBasicR2.logger()
+}
+
+// SetLogger sets the logger used by the library.
+// Device availability is logged at Info, commands and responses at Debug,
+// timeouts and malformed payloads at Warn and failed publishes at Error. Without a logger nothing is logged.
+func (sonoffBasicR2 *SonoffBasicR2) SetLogger(value *slog.Logger) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.log = value
+	})
+}
+
+// logger returns the configured logger or a logger that discards every record.
+func (sonoffBasicR2 SonoffBasicR2) logger() *slog.Logger {
+	if log := sonoffBasicR2.getSettings().log; log != nil {
+		return log
+	}
+
+	return discardLogger
+}
+
+// logUnsubscribe unsubscribes the filter and logs the error, for deferred calls that cannot return it.
+func (sonoffBasicR2 SonoffBasicR2) logUnsubscribe(filter string, subscriptionId int) {
+	if err := sonoffBasicR2.server.Unsubscribe(filter, subscriptionId); err != nil {
+		sonoffBasicR2.logger().Warn("unsubscribe failed", LogKeyTopic, filter, LogKeyError, err)
+	}
+}
+
+// logDecodeFailed logs a payload of the device that cannot be decoded.
+func (sonoffBasicR2 SonoffBasicR2) logDecodeFailed(id string, topic string, err error) {
+	sonoffBasicR2.logger().Warn("malformed payload", LogKeyDevice, id, LogKeyTopic, topic, LogKeyError, err)
+}
@@ -0,0 +1,162 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"bytes"
+	"encoding/json"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+type MockLogWriter struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (m *MockLogWriter) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.buffer.Write(p)
+}
+
+func (m *MockLogWriter) Records() []map[string]any {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]map[string]any, 0)
+
+	for _, line := range bytes.Split(bytes.TrimSpace(m.buffer.Bytes()), []byte("\n")) {
+		var record map[string]any
+
+		if err := json.Unmarshal(line, &record); err == nil {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
+func (m *MockLogWriter) Find(message string) map[string]any {
+	for _, record := range m.Records() {
+		if record[slog.MessageKey] == message {
+			return record
+		}
+	}
+
+	return nil
+}
+
+func WithMockLogger(logger *slog.Logger) MockOption {
+	return func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetLogger(logger)
+	}
+}
+
+func TestSonoffBasicR2_GetLogger(t *testing.T) {
+	sonoffServer, _, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.NotNil(t, sonoffServer.GetLogger())
+
+	logger := slog.Default()
+
+	sonoffServer.SetLogger(logger)
+
+	assert.Equal(t, logger, sonoffServer.GetLogger())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_Logger(t *testing.T) {
+	writer := new(MockLogWriter)
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockLogger(slog.New(slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+
+	assert.NoError(t, err)
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handler := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Origin: "DVES_1", Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	record := writer.Find("device connected")
+
+	assert.Equal(t, "INFO", record[slog.LevelKey])
+	assert.Equal(t, "1", record[LogKeyDevice])
+	assert.Equal(t, "DVES_1", record[LogKeyClientID])
+
+	sonoffServer.PowerOn("1")
+
+	record = writer.Find("command published")
+
+	assert.Equal(t, "1", record[LogKeyDevice])
+	assert.Equal(t, "cmnd/1/POWER", record[LogKeyTopic])
+	assert.Equal(t, TasmotaCmndTopicPower, record[LogKeyCommand])
+	assert.Contains(t, record, LogKeyDuration)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	handler = <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte("test")})
+
+	assert.Error(t, <-responseChan)
+
+	record = writer.Find("malformed payload")
+
+	assert.Equal(t, "WARN", record[slog.LevelKey])
+	assert.Equal(t, "stat/1/STATUS11", record[LogKeyTopic])
+	assert.Contains(t, record, LogKeyError)
+
+	go func() {
+		_, err := sonoffServer.StatusTwo("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	assert.Error(t, <-responseChan)
+
+	record = writer.Find("command timed out")
+
+	assert.Equal(t, "WARN", record[slog.LevelKey])
+	assert.Equal(t, "STATUS2", record[LogKeyCommand])
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_LoggerPublishFailed(t *testing.T) {
+	mockServer := new(MockMQTTServer)
+	mockServer.subscribeChan = make(chan mqtt.InlineSubFn, 1)
+	mockServer.On("Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(assert.AnError)
+
+	sonoffServer, err := NewSonoffBasicR2WithServer(mockServer, 0)
+
+	assert.NoError(t, err)
+
+	writer := new(MockLogWriter)
+
+	sonoffServer.SetLogger(slog.New(slog.NewJSONHandler(writer, nil)))
+	sonoffServer.PowerOff("1")
+
+	record := writer.Find("command publish failed")
+
+	assert.Equal(t, "ERROR", record[slog.LevelKey])
+	assert.Equal(t, assert.AnError.Error(), record[LogKeyError])
+}
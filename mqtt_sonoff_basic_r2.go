@@ -10,9 +10,11 @@ import (
 	mqttauth "github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/listeners"
 	"github.com/mochi-mqtt/server/v2/packets"
+	"go.opentelemetry.io/otel/trace"
 	"math"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,6 +33,12 @@ const (
 	TasmotaPrefixCmnd = "cmnd"
 )
 
+// MQTT group topics
+const (
+	// TasmotaGroupTopicAll is the default group topic every Tasmota device subscribes to.
+	TasmotaGroupTopicAll = "tasmotas"
+)
+
 // MQTT telemetry (tele) topics
 const (
 	// TasmotaTeleTopicLWT is the Last Will and Testament topic used by Tasmota devices to report their availability.
@@ -84,6 +92,12 @@ const (
 	// TasmotaStatTopicStatus is the general status response topic.
 	TasmotaStatTopicStatus = "STATUS0"
 
+	// TasmotaStatTopicStatusShort is the response topic of the STATUS command sent without a value.
+	TasmotaStatTopicStatusShort = "STATUS"
+
+	// TasmotaStatTopicValueAll subscribes to the stat topics of all devices.
+	TasmotaStatTopicValueAll = "+"
+
 	// TasmotaStatTopicStatusOne to TasmotaStatTopicStatusEleven represent different status responses of the device.
 	TasmotaStatTopicStatusOne         = "STATUS1"
 	TasmotaStatTopicStatusOneValue    = "1"
@@ -105,6 +119,11 @@ const (
 	TasmotaStatTopicStatusElevenValue = "11"
 )
 
+// mochiMQTTV2HookAdder is implemented by servers that accept hooks, such as *mqtt.Server.
+type mochiMQTTV2HookAdder interface {
+	AddHook(hook mqtt.Hook, config any) error
+}
+
 // MochiMQTTV2 is interface to support dependency inversion
 type MochiMQTTV2 interface {
 	Serve() error
@@ -117,14 +136,23 @@ type MochiMQTTV2 interface {
 // SonoffBasicR2 is a struct that manages MQTT connections to a Sonoff Basic R2 device using the Tasmota firmware.
 // It handles device commands, status checks, and power control over MQTT.
 type SonoffBasicR2 struct {
-	server                          MochiMQTTV2
-	qos                             byte
-	isOwnServer                     bool
-	connected                       chan string
-	disconnected                    chan string
-	ctxCmndResponseTimeoutInSeconds uint
-	mainContext                     context.Context
-	mainContextCancel               context.CancelFunc
+	server                    MochiMQTTV2
+	qos                       byte
+	isOwnServer               bool
+	connected                 chan string
+	disconnected              chan string
+	channelsMutex             *sync.RWMutex
+	settings                  *sharedSettings
+	mainContext               context.Context
+	mainContextCancel         context.CancelFunc
+	registry                  *deviceRegistry
+	sessionHook               *SessionHook
+	pending                   *pendingCommands
+	circuitBreakers           *circuitBreakers
+	offlineQueue              *offlineQueue
+	switchLimiter             *switchLimiter
+	dryRun                    *dryRun
+	discoveryLWTSubscriptions *discoveryLWTSubscriptions
 }
 
 // NewSonoffBasicR2 initializes a new instance of SonoffBasicR2 and sets up an internal MQTT server.
@@ -153,70 +181,215 @@ func NewSonoffBasicR2(ip string, port uint16, qos byte) (*SonoffBasicR2, error)
 		return nil, err
 	}
 
+	registry := newDeviceRegistry()
+	sessionHook := newSessionHook(registry)
+
+	// Track TCP sessions of the devices
+	err = server.AddHook(sessionHook, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
 	mainContext, mainContextCancel := context.WithCancel(context.Background())
 
 	return &SonoffBasicR2{
-		server:                          server,
-		qos:                             qos,
-		isOwnServer:                     true,
-		connected:                       make(chan string, 1),
-		disconnected:                    make(chan string, 1),
-		ctxCmndResponseTimeoutInSeconds: DefaultCtxCmndResponseTimeoutInSeconds,
-		mainContext:                     mainContext,
-		mainContextCancel:               mainContextCancel,
+		server:                    server,
+		qos:                       qos,
+		isOwnServer:               true,
+		connected:                 make(chan string, 1),
+		disconnected:              make(chan string, 1),
+		channelsMutex:             new(sync.RWMutex),
+		settings:                  newSharedSettings(),
+		mainContext:               mainContext,
+		mainContextCancel:         mainContextCancel,
+		registry:                  registry,
+		sessionHook:               sessionHook,
+		discoveryLWTSubscriptions: newDiscoveryLWTSubscriptions(),
+		pending:                   newPendingCommands(),
+		circuitBreakers:           newCircuitBreakers(),
+		offlineQueue:              newOfflineQueue(),
+		switchLimiter:             newSwitchLimiter(),
+		dryRun:                    newDryRun(),
 	}, nil
 }
 
 // NewSonoffBasicR2WithServer initializes a SonoffBasicR2 instance with an external MQTT server.
 // The server must have the InlineClient option enabled.
+// If the server accepts hooks (like *mqtt.Server), the SessionHook is registered on it automatically.
 // Warning: inline_client must be true.
 func NewSonoffBasicR2WithServer(server MochiMQTTV2, qos byte) (*SonoffBasicR2, error) {
+	registry := newDeviceRegistry()
+	sessionHook := newSessionHook(registry)
+
+	// Track TCP sessions of the devices when the server supports hooks
+	if hookAdder, ok := server.(mochiMQTTV2HookAdder); ok {
+		if err := hookAdder.AddHook(sessionHook, nil); err != nil {
+			return nil, err
+		}
+	}
+
 	mainContext, mainContextCancel := context.WithCancel(context.Background())
 
 	return &SonoffBasicR2{
-		server:                          server,
-		qos:                             qos,
-		isOwnServer:                     false,
-		connected:                       make(chan string, 1),
-		disconnected:                    make(chan string, 1),
-		ctxCmndResponseTimeoutInSeconds: DefaultCtxCmndResponseTimeoutInSeconds,
-		mainContext:                     mainContext,
-		mainContextCancel:               mainContextCancel,
+		server:                    server,
+		qos:                       qos,
+		isOwnServer:               false,
+		connected:                 make(chan string, 1),
+		disconnected:              make(chan string, 1),
+		channelsMutex:             new(sync.RWMutex),
+		settings:                  newSharedSettings(),
+		mainContext:               mainContext,
+		mainContextCancel:         mainContextCancel,
+		registry:                  registry,
+		sessionHook:               sessionHook,
+		discoveryLWTSubscriptions: newDiscoveryLWTSubscriptions(),
+		pending:                   newPendingCommands(),
+		circuitBreakers:           newCircuitBreakers(),
+		offlineQueue:              newOfflineQueue(),
+		switchLimiter:             newSwitchLimiter(),
+		dryRun:                    newDryRun(),
 	}, nil
 }
 
 // GetCtxCmndResponseTimeoutInSeconds returns the command response timeout duration in seconds.
 func (sonoffBasicR2 SonoffBasicR2) GetCtxCmndResponseTimeoutInSeconds() uint {
-	return sonoffBasicR2.ctxCmndResponseTimeoutInSeconds
+	return sonoffBasicR2.getSettings().ctxCmndResponseTimeoutInSeconds
 }
 
 // SetCtxCmndResponseTimeoutInSeconds sets the command response timeout duration in seconds.
 func (sonoffBasicR2 *SonoffBasicR2) SetCtxCmndResponseTimeoutInSeconds(value uint) {
-	sonoffBasicR2.ctxCmndResponseTimeoutInSeconds = value
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.ctxCmndResponseTimeoutInSeconds = value
+	})
+}
+
+// GetDiscoveryOnServe returns whether Serve broadcasts a discovery request to all devices.
+func (sonoffBasicR2 SonoffBasicR2) GetDiscoveryOnServe() bool {
+	return sonoffBasicR2.getSettings().discoveryOnServe
+}
+
+// SetDiscoveryOnServe sets whether Serve broadcasts a discovery request to all devices (see Discover).
+func (sonoffBasicR2 *SonoffBasicR2) SetDiscoveryOnServe(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.discoveryOnServe = value
+	})
+}
+
+// GetNativeDiscovery returns whether Serve subscribes to Tasmota native discovery messages.
+func (sonoffBasicR2 SonoffBasicR2) GetNativeDiscovery() bool {
+	return sonoffBasicR2.getSettings().nativeDiscovery
+}
+
+// SetNativeDiscovery sets whether Serve subscribes to Tasmota native discovery messages (tasmota/discovery/+/config).
+// Discovered devices are registered with their own topic layout instead of the default %prefix%/%topic%/.
+func (sonoffBasicR2 *SonoffBasicR2) SetNativeDiscovery(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.nativeDiscovery = value
+	})
+}
+
+// GetTelemetryTracking returns whether Serve subscribes to telemetry and power messages of the devices.
+func (sonoffBasicR2 SonoffBasicR2) GetTelemetryTracking() bool {
+	return sonoffBasicR2.getSettings().telemetryTracking
+}
+
+// SetTelemetryTracking sets whether Serve subscribes to telemetry (tele/+/STATE) and power (stat/+/POWER) messages.
+// The received values are stored in Device.State and reported with DeviceEventStateUpdated.
+func (sonoffBasicR2 *SonoffBasicR2) SetTelemetryTracking(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.telemetryTracking = value
+	})
+}
+
+// GetObserver returns the observer notified about the command traffic.
+func (sonoffBasicR2 SonoffBasicR2) GetObserver() Observer {
+	return sonoffBasicR2.getSettings().observer
+}
+
+// SetObserver sets the observer notified about the command traffic, e.g. a metrics collector.
+func (sonoffBasicR2 *SonoffBasicR2) SetObserver(value Observer) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.observer = value
+	})
+}
+
+// GetPowerConfirmation returns whether the power commands wait for the confirmation of the device.
+func (sonoffBasicR2 SonoffBasicR2) GetPowerConfirmation() bool {
+	return sonoffBasicR2.getSettings().powerConfirmation
+}
+
+// SetPowerConfirmation sets whether the power commands wait for the RESULT of the device instead of only publishing the command.
+// Confirmed commands fail with ErrTimeout when the device does not answer, so they can be retried according to the retry policy.
+func (sonoffBasicR2 *SonoffBasicR2) SetPowerConfirmation(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.powerConfirmation = value
+	})
 }
 
 // TeleConnected returns a channel that emits the ID of a device when it is connected to the MQTT broker.
+// The device registry is updated before the ID is emitted, so Device(id) already contains the session details.
 func (sonoffBasicR2 SonoffBasicR2) TeleConnected() <-chan string {
 	return sonoffBasicR2.connected
 }
 
 // TeleDisconnected returns a channel that emits the ID of a device when it is disconnected from the MQTT broker.
+// The device registry is updated before the ID is emitted, so Device(id) already contains the session details.
 func (sonoffBasicR2 SonoffBasicR2) TeleDisconnected() <-chan string {
 	return sonoffBasicR2.disconnected
 }
 
+// Server returns the MQTT server used to communicate with the devices.
+// It is intended for components built on top of SonoffBasicR2 that publish their own topics.
+func (sonoffBasicR2 SonoffBasicR2) Server() MochiMQTTV2 {
+	return sonoffBasicR2.server
+}
+
+// GetQos returns the QoS level used for publishing.
+func (sonoffBasicR2 SonoffBasicR2) GetQos() byte {
+	return sonoffBasicR2.qos
+}
+
+// SessionHook returns the hook that tracks TCP sessions of the devices.
+// It only needs to be registered manually on servers that are wrapped and therefore not detected by NewSonoffBasicR2WithServer.
+func (sonoffBasicR2 SonoffBasicR2) SessionHook() *SessionHook {
+	return sonoffBasicR2.sessionHook
+}
+
+// Device returns the last known state of the device with the given ID.
+func (sonoffBasicR2 SonoffBasicR2) Device(id string) (Device, bool) {
+	return sonoffBasicR2.registry.get(id)
+}
+
+// Devices returns the last known state of all devices seen by the library, sorted by ID.
+func (sonoffBasicR2 SonoffBasicR2) Devices() []Device {
+	return sonoffBasicR2.registry.all()
+}
+
+// Deregister removes the device from the registry and reports DeviceEventDeregistered.
+// A device that connects again is registered anew.
+func (sonoffBasicR2 SonoffBasicR2) Deregister(id string) bool {
+	_, ok := sonoffBasicR2.registry.remove(id)
+
+	return ok
+}
+
+// OnDeviceEvent registers a handler that is called on every change in the device registry,
+// such as LWT connects/disconnects and broker session changes. It returns a function that removes the handler.
+func (sonoffBasicR2 SonoffBasicR2) OnDeviceEvent(handler DeviceEventFn) func() {
+	return sonoffBasicR2.registry.listen(handler)
+}
+
 // Serve starts the MQTT server and subscribes to connection status topics for devices.
 // It handles the telemetric connection status (`LWT` - Last Will and Testament) from Tasmota devices.
+// Retained LWT messages of an external broker are processed right away, so devices that are already online are reported too.
 func (sonoffBasicR2 SonoffBasicR2) Serve() error {
 	// Subscribe to telemetric messages for connection status (Online/Offline)
 	topicTeleConnected := sonoffBasicR2.getFullTeleTopic(TasmotaTeleTopicLWTValueAll, TasmotaTeleTopicLWT)
 	subscribeConnected := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
 		// If the device is online, send the ID to the connected channel
 		if string(pk.Payload) == TasmotaTeleTopicLWTResponseOnline {
-			select {
-			case sonoffBasicR2.connected <- strings.Split(pk.TopicName, "/")[1]:
-			case <-sonoffBasicR2.mainContext.Done():
-			}
+			sonoffBasicR2.teleConnected(strings.Split(pk.TopicName, "/")[1], pk.Origin)
 		}
 	}
 
@@ -230,10 +403,7 @@ func (sonoffBasicR2 SonoffBasicR2) Serve() error {
 	subscribeDisconnected := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
 		// If the device is offline, send the ID to the disconnected channel
 		if string(pk.Payload) == TasmotaTeleTopicLWTResponseOffline {
-			select {
-			case sonoffBasicR2.disconnected <- strings.Split(pk.TopicName, "/")[1]:
-			case <-sonoffBasicR2.mainContext.Done():
-			}
+			sonoffBasicR2.teleDisconnected(strings.Split(pk.TopicName, "/")[1])
 		}
 	}
 
@@ -243,6 +413,35 @@ func (sonoffBasicR2 SonoffBasicR2) Serve() error {
 		return err
 	}
 
+	settings := sonoffBasicR2.getSettings()
+
+	// Subscribe to Tasmota native discovery to learn the topic layout of the devices
+	if settings.nativeDiscovery {
+		err = sonoffBasicR2.subscribeNativeDiscovery()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Subscribe to telemetry and power messages to keep the device state up to date
+	if settings.telemetryTracking {
+		err = sonoffBasicR2.subscribeTelemetry()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Enumerate devices that were online before the start (retained LWT messages are already delivered by Subscribe)
+	if settings.discoveryOnServe {
+		go func() {
+			if _, err := sonoffBasicR2.Discover(); err != nil {
+				sonoffBasicR2.logger().Error("discovery failed", LogKeyError, err)
+			}
+		}()
+	}
+
 	// Start the MQTT server if SonoffBasicR2 manages its own server
 	if sonoffBasicR2.isOwnServer {
 		return sonoffBasicR2.server.Serve()
@@ -251,12 +450,82 @@ func (sonoffBasicR2 SonoffBasicR2) Serve() error {
 	return nil
 }
 
+// teleConnected marks the device as online in the registry and sends its ID to the connected channel.
+func (sonoffBasicR2 SonoffBasicR2) teleConnected(id string, clientID string) {
+	sonoffBasicR2.markConnected(id, clientID)
+	sonoffBasicR2.notify(sonoffBasicR2.connected, id)
+}
+
+// markConnected marks the device as online in the registry, delivers its queued commands and restores its desired state.
+func (sonoffBasicR2 SonoffBasicR2) markConnected(id string, clientID string) {
+	device := sonoffBasicR2.registry.markOnline(id, clientID)
+
+	sonoffBasicR2.logger().Info("device connected", LogKeyDevice, id, LogKeyClientID, device.Session.ClientID)
+
+	// Deliver the queued commands and restore the desired state without blocking the LWT handler
+	go func() {
+		sonoffBasicR2.flushOfflineQueue(id)
+		sonoffBasicR2.reconcileDesiredState(id)
+	}()
+}
+
+// teleDisconnected marks the device as offline in the registry and sends its ID to the disconnected channel.
+func (sonoffBasicR2 SonoffBasicR2) teleDisconnected(id string) {
+	sonoffBasicR2.registry.markOffline(id)
+
+	// Wake up the commands still waiting for a response of the device.
+	// During Close the devices disconnect because the server shuts down, so the commands report ErrClosed.
+	cause := ErrDeviceOffline
+
+	if sonoffBasicR2.mainContext.Err() != nil {
+		cause = ErrClosed
+	}
+
+	woken := sonoffBasicR2.pending.cancel(id, cause)
+
+	sonoffBasicR2.logger().Info("device disconnected", LogKeyDevice, id, LogKeyPending, woken)
+
+	sonoffBasicR2.notify(sonoffBasicR2.disconnected, id)
+}
+
+// notify sends the ID to the connected or disconnected channel unless SonoffBasicR2 is closed.
+// The read lock keeps Close from closing the channel while an LWT handler is sending to it.
+func (sonoffBasicR2 SonoffBasicR2) notify(channel chan string, id string) {
+	sonoffBasicR2.notifyContext(sonoffBasicR2.mainContext, channel, id)
+}
+
+// notifyContext is like notify but also gives up when the context is done, e.g. when a discovery ends.
+func (sonoffBasicR2 SonoffBasicR2) notifyContext(ctx context.Context, channel chan string, id string) bool {
+	sonoffBasicR2.channelsMutex.RLock()
+	defer sonoffBasicR2.channelsMutex.RUnlock()
+
+	if sonoffBasicR2.mainContext.Err() != nil {
+		return false
+	}
+
+	select {
+	case channel <- id:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-sonoffBasicR2.mainContext.Done():
+		return false
+	}
+}
+
 // Close closes the MQTT server and stops the internal channels.
 func (sonoffBasicR2 SonoffBasicR2) Close() error {
+	// Unblock the LWT handlers that are sending and wait for them before closing the channels
+	sonoffBasicR2.mainContextCancel()
+
+	sonoffBasicR2.channelsMutex.Lock()
+
 	close(sonoffBasicR2.connected)
 	close(sonoffBasicR2.disconnected)
 
-	sonoffBasicR2.mainContextCancel()
+	sonoffBasicR2.channelsMutex.Unlock()
+
+	sonoffBasicR2.dropOfflineQueue()
 
 	// Close the MQTT server if SonoffBasicR2 manages its own server
 	if sonoffBasicR2.isOwnServer {
@@ -270,179 +539,505 @@ func (sonoffBasicR2 SonoffBasicR2) Close() error {
 // This includes the device's overall configuration and current state.
 // The response is unmarshaled into the AutoGenerated structure.
 func (sonoffBasicR2 SonoffBasicR2) Status(id string) (*Status, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatusAll, TasmotaStatTopicStatus, "")
+	return sonoffBasicR2.StatusContext(context.Background(), id)
+}
+
+// StatusContext is like Status but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusContext(ctx context.Context, id string) (*Status, error) {
+	result, err := getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatusAll, TasmotaStatTopicStatus, "", UnmarshalStatus)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return UnmarshalStatus([]byte(response))
+	sonoffBasicR2.updateStateFromStatus(id, result)
+
+	return result, nil
 }
 
 // StatusOne retrieves specific system-related information (STATUS 1) from the Sonoff device.
 // This includes details like uptime, boot count, and other system parameters.
 func (sonoffBasicR2 SonoffBasicR2) StatusOne(id string) (*StatusOne, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusOne, TasmotaStatTopicStatusOneValue)
+	return sonoffBasicR2.StatusOneContext(context.Background(), id)
+}
+
+// StatusOneContext is like StatusOne but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusOneContext(ctx context.Context, id string) (*StatusOne, error) {
+	result, err := getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusOne, TasmotaStatTopicStatusOneValue, UnmarshalStatusOne)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return UnmarshalStatusOne([]byte(response))
+	sonoffBasicR2.updateStateFromStatusOne(id, result)
+
+	return result, nil
 }
 
 // StatusTwo retrieves firmware-related information (STATUS 2) from the Sonoff device.
 // This includes firmware version, build date, and other firmware-specific data.
 func (sonoffBasicR2 SonoffBasicR2) StatusTwo(id string) (*StatusTwo, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusTwo, TasmotaStatTopicStatusTwoValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusTwoContext(context.Background(), id)
+}
 
-	return UnmarshalStatusTwo([]byte(response))
+// StatusTwoContext is like StatusTwo but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusTwoContext(ctx context.Context, id string) (*StatusTwo, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusTwo, TasmotaStatTopicStatusTwoValue, UnmarshalStatusTwo)
 }
 
 // StatusThree retrieves logging-related settings (STATUS 3) from the Sonoff device.
 // This includes serial, web, and MQTT log configurations.
 func (sonoffBasicR2 SonoffBasicR2) StatusThree(id string) (*StatusThree, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusThree, TasmotaStatTopicStatusThreeValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusThreeContext(context.Background(), id)
+}
 
-	return UnmarshalStatusThree([]byte(response))
+// StatusThreeContext is like StatusThree but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusThreeContext(ctx context.Context, id string) (*StatusThree, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusThree, TasmotaStatTopicStatusThreeValue, UnmarshalStatusThree)
 }
 
 // StatusFour retrieves memory and storage-related information (STATUS 4) from the Sonoff device.
 // This includes program size, free heap space, flash size, and other memory metrics.
 func (sonoffBasicR2 SonoffBasicR2) StatusFour(id string) (*StatusFour, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusFour, TasmotaStatTopicStatusFourValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusFourContext(context.Background(), id)
+}
 
-	return UnmarshalStatusFour([]byte(response))
+// StatusFourContext is like StatusFour but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusFourContext(ctx context.Context, id string) (*StatusFour, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusFour, TasmotaStatTopicStatusFourValue, UnmarshalStatusFour)
 }
 
 // StatusFive retrieves network configuration details (STATUS 5) from the Sonoff device.
 // This includes IP address, gateway, subnet mask, and DNS server information.
 func (sonoffBasicR2 SonoffBasicR2) StatusFive(id string) (*StatusFive, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusFive, TasmotaStatTopicStatusFiveValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusFiveContext(context.Background(), id)
+}
 
-	return UnmarshalStatusFive([]byte(response))
+// StatusFiveContext is like StatusFive but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusFiveContext(ctx context.Context, id string) (*StatusFive, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusFive, TasmotaStatTopicStatusFiveValue, UnmarshalStatusFive)
 }
 
 // StatusSix retrieves MQTT configuration information (STATUS 6) from the Sonoff device.
 // This includes MQTT host, port, client ID, and other MQTT settings.
 func (sonoffBasicR2 SonoffBasicR2) StatusSix(id string) (*StatusSix, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusSix, TasmotaStatTopicStatusSixValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusSixContext(context.Background(), id)
+}
 
-	return UnmarshalStatusSix([]byte(response))
+// StatusSixContext is like StatusSix but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusSixContext(ctx context.Context, id string) (*StatusSix, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusSix, TasmotaStatTopicStatusSixValue, UnmarshalStatusSix)
 }
 
 // StatusSeven retrieves time and date settings (STATUS 7) from the Sonoff device.
 // This includes local time, daylight savings settings, and timezone information.
 func (sonoffBasicR2 SonoffBasicR2) StatusSeven(id string) (*StatusSeven, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusSeven, TasmotaStatTopicStatusSevenValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusSevenContext(context.Background(), id)
+}
 
-	return UnmarshalStatusSeven([]byte(response))
+// StatusSevenContext is like StatusSeven but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusSevenContext(ctx context.Context, id string) (*StatusSeven, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusSeven, TasmotaStatTopicStatusSevenValue, UnmarshalStatusSeven)
 }
 
 // StatusEight retrieves sensor data (STATUS 8) from the Sonoff device.
 // This includes the most recent readings from the device's sensors.
 func (sonoffBasicR2 SonoffBasicR2) StatusEight(id string) (*StatusEight, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusEight, TasmotaStatTopicStatusEightValue)
-
-	if err != nil {
-		return nil, err
-	}
+	return sonoffBasicR2.StatusEightContext(context.Background(), id)
+}
 
-	return UnmarshalStatusEight([]byte(response))
+// StatusEightContext is like StatusEight but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusEightContext(ctx context.Context, id string) (*StatusEight, error) {
+	return getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusEight, TasmotaStatTopicStatusEightValue, UnmarshalStatusEight)
 }
 
 // StatusEleven retrieves runtime status information (STATUS 11) from the Sonoff device.
 // This includes uptime, heap usage, WiFi information, and more.
 func (sonoffBasicR2 SonoffBasicR2) StatusEleven(id string) (*StatusEleven, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusEleven, TasmotaStatTopicStatusElevenValue)
+	return sonoffBasicR2.StatusElevenContext(context.Background(), id)
+}
+
+// StatusElevenContext is like StatusEleven but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusElevenContext(ctx context.Context, id string) (*StatusEleven, error) {
+	result, err := getStatus(ctx, sonoffBasicR2, id, TasmotaCmndTopicStatus, TasmotaStatTopicStatusEleven, TasmotaStatTopicStatusElevenValue, UnmarshalStatusEleven)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return UnmarshalStatusEleven([]byte(response))
+	sonoffBasicR2.updateStateFromStatusEleven(id, result)
+
+	return result, nil
 }
 
 // StatusPhysicalButton retrieves the current configuration of the physical button on the Sonoff device.
 // It checks the status of SetOption73, which controls whether the physical button is enabled (OFF) or disabled (ON).
 func (sonoffBasicR2 SonoffBasicR2) StatusPhysicalButton(id string) (bool, error) {
-	response, err := sonoffBasicR2.getCmndResponse(id, TasmotaCmndTopicPhysicalButton, TasmotaStatTopicResult, "")
+	return sonoffBasicR2.StatusPhysicalButtonContext(context.Background(), id)
+}
 
-	if err != nil {
+// StatusPhysicalButtonContext is like StatusPhysicalButton but uses the context for cancellation and tracing.
+func (sonoffBasicR2 SonoffBasicR2) StatusPhysicalButtonContext(ctx context.Context, id string) (enabled bool, err error) {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionReadStatus, TasmotaCmndTopicPhysicalButton, ""); err != nil {
 		return false, err
 	}
 
-	var data map[string]string
+	ctx, span := sonoffBasicR2.startCommandSpan(ctx, id, TasmotaCmndTopicPhysicalButton)
 
-	if err := json.Unmarshal([]byte(response), &data); err != nil {
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	response, err := sonoffBasicR2.getCmndResponseWithRetry(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, TasmotaCmndTopicPhysicalButton, TasmotaStatTopicResult, "")
+
+	if err != nil {
 		return false, err
 	}
 
-	result, ok := data["SetOption73"]
+	_, decodeSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanDecode, "")
 
-	if !ok {
-		return false, errors.New("SetOption73 not found")
+	result, err := decodePhysicalButton(response)
+
+	endSpan(decodeSpan, err)
+
+	if err != nil {
+		setSpanOutcome(span, TraceOutcomeDecodeFailed)
+
+		sonoffBasicR2.observeDecodeFailed(id, TasmotaCmndTopicPhysicalButton, err)
+		sonoffBasicR2.logDecodeFailed(id, sonoffBasicR2.getFullStatTopic(id, TasmotaStatTopicResult), err)
+
+		return false, newPayloadError(id, TasmotaCmndTopicPhysicalButton, err)
 	}
 
+	setSpanOutcome(span, TraceOutcomeSuccess)
+
 	// If SetOption73 is "OFF", the physical button is enabled; otherwise, it's disabled.
 	return result == "OFF", nil
 }
 
 // PowerOn sends an MQTT command to turn on the device.
-func (sonoffBasicR2 SonoffBasicR2) PowerOn(id string) {
-	topicCmnd := sonoffBasicR2.getFullCmndTopic(id, TasmotaCmndTopicPower)
-	_ = sonoffBasicR2.server.Publish(topicCmnd, []byte(TasmotaCmndTopicPowerValueOn), false, sonoffBasicR2.qos)
+func (sonoffBasicR2 SonoffBasicR2) PowerOn(id string) error {
+	return sonoffBasicR2.PowerOnContext(context.Background(), id)
+}
+
+// PowerOnContext is like PowerOn but uses the context for tracing.
+func (sonoffBasicR2 SonoffBasicR2) PowerOnContext(ctx context.Context, id string) error {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionSwitch, TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOn); err != nil {
+		return err
+	}
+
+	if err := sonoffBasicR2.limitPower(ctx, id, TasmotaCmndTopicPowerValueOn); err != nil {
+		return err
+	}
+
+	sonoffBasicR2.setDesiredPower(id, TasmotaCmndTopicPowerValueOn)
+
+	return sonoffBasicR2.sendPower(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, TasmotaCmndTopicPowerValueOn)
 }
 
 // PowerOff sends an MQTT command to turn off the device.
-func (sonoffBasicR2 SonoffBasicR2) PowerOff(id string) {
-	topicCmnd := sonoffBasicR2.getFullCmndTopic(id, TasmotaCmndTopicPower)
-	_ = sonoffBasicR2.server.Publish(topicCmnd, []byte(TasmotaCmndTopicPowerValueOff), false, sonoffBasicR2.qos)
+func (sonoffBasicR2 SonoffBasicR2) PowerOff(id string) error {
+	return sonoffBasicR2.PowerOffContext(context.Background(), id)
+}
+
+// PowerOffContext is like PowerOff but uses the context for tracing.
+func (sonoffBasicR2 SonoffBasicR2) PowerOffContext(ctx context.Context, id string) error {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionSwitch, TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOff); err != nil {
+		return err
+	}
+
+	if err := sonoffBasicR2.limitPower(ctx, id, TasmotaCmndTopicPowerValueOff); err != nil {
+		return err
+	}
+
+	sonoffBasicR2.setDesiredPower(id, TasmotaCmndTopicPowerValueOff)
+
+	return sonoffBasicR2.sendPower(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, TasmotaCmndTopicPowerValueOff)
 }
 
 // PowerToggle sends an MQTT command to toggle the power state of the Sonoff device.
 // It switches the power between ON and OFF, depending on the current state.
-func (sonoffBasicR2 SonoffBasicR2) PowerToggle(id string) {
-	topicCmnd := sonoffBasicR2.getFullCmndTopic(id, TasmotaCmndTopicPower)
-	_ = sonoffBasicR2.server.Publish(topicCmnd, []byte(TasmotaCmndTopicPowerValueToggle), false, sonoffBasicR2.qos)
+func (sonoffBasicR2 SonoffBasicR2) PowerToggle(id string) error {
+	return sonoffBasicR2.PowerToggleContext(context.Background(), id)
+}
+
+// PowerToggleContext is like PowerToggle but uses the context for tracing.
+// The command is never retried, since a missing confirmation does not mean that the toggle was not applied.
+func (sonoffBasicR2 SonoffBasicR2) PowerToggleContext(ctx context.Context, id string) error {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionSwitch, TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueToggle); err != nil {
+		return err
+	}
+
+	if err := sonoffBasicR2.limitPower(ctx, id, TasmotaCmndTopicPowerValueToggle); err != nil {
+		return err
+	}
+
+	// Without power confirmation the result is never reported, so the desired state is inverted up front
+	if !sonoffBasicR2.getSettings().powerConfirmation {
+		sonoffBasicR2.toggleDesiredPower(id)
+	}
+
+	return sonoffBasicR2.sendPower(ctx, NoRetry, id, TasmotaCmndTopicPowerValueToggle)
 }
 
 // PhysicalButtonOn sends an MQTT command to enable the physical button on the Sonoff device.
 // This allows the device's physical button to control power toggling. It corresponds to the Tasmota command SetOption73.
-func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOn(id string) {
-	topicCmnd := sonoffBasicR2.getFullCmndTopic(id, TasmotaCmndTopicPhysicalButton)
-	_ = sonoffBasicR2.server.Publish(topicCmnd, []byte(TasmotaCmndTopicPhysicalButtonValueOn), false, sonoffBasicR2.qos)
+func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOn(id string) error {
+	return sonoffBasicR2.PhysicalButtonOnContext(context.Background(), id)
+}
+
+// PhysicalButtonOnContext is like PhysicalButtonOn but uses the context for tracing.
+func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOnContext(ctx context.Context, id string) error {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionConfigure, TasmotaCmndTopicPhysicalButton, TasmotaCmndTopicPhysicalButtonValueOn); err != nil {
+		return err
+	}
+
+	return sonoffBasicR2.publishCmnd(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, TasmotaCmndTopicPhysicalButton, TasmotaCmndTopicPhysicalButtonValueOn)
 }
 
 // PhysicalButtonOff sends an MQTT command to disable the physical button on the Sonoff device.
 // This prevents the device's physical button from toggling the power. It corresponds to the Tasmota command SetOption73.
-func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOff(id string) {
-	topicCmnd := sonoffBasicR2.getFullCmndTopic(id, TasmotaCmndTopicPhysicalButton)
-	_ = sonoffBasicR2.server.Publish(topicCmnd, []byte(TasmotaCmndTopicPhysicalButtonValueOff), false, sonoffBasicR2.qos)
+func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOff(id string) error {
+	return sonoffBasicR2.PhysicalButtonOffContext(context.Background(), id)
+}
+
+// PhysicalButtonOffContext is like PhysicalButtonOff but uses the context for tracing.
+func (sonoffBasicR2 SonoffBasicR2) PhysicalButtonOffContext(ctx context.Context, id string) error {
+	if err := sonoffBasicR2.authorize(ctx, id, ActionConfigure, TasmotaCmndTopicPhysicalButton, TasmotaCmndTopicPhysicalButtonValueOff); err != nil {
+		return err
+	}
+
+	return sonoffBasicR2.publishCmnd(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, TasmotaCmndTopicPhysicalButton, TasmotaCmndTopicPhysicalButtonValueOff)
+}
+
+// getStatus sends a status command to the device and unmarshals the response.
+// Malformed payloads are reported to the observer.
+func getStatus[T any](ctx context.Context, sonoffBasicR2 SonoffBasicR2, id string, topicCmnd string, topicStat string, value string, unmarshal func([]byte) (*T, error)) (result *T, err error) {
+	command := getCommandName(topicCmnd, value)
+
+	if err := sonoffBasicR2.authorize(ctx, id, ActionReadStatus, command, value); err != nil {
+		return nil, err
+	}
+
+	ctx, span := sonoffBasicR2.startCommandSpan(ctx, id, command)
+
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	response, err := sonoffBasicR2.getCmndResponseWithRetry(ctx, sonoffBasicR2.getRetryPolicy(ctx), id, topicCmnd, topicStat, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, decodeSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanDecode, "")
+
+	result, err = unmarshal([]byte(response))
+
+	endSpan(decodeSpan, err)
+
+	if err != nil {
+		setSpanOutcome(span, TraceOutcomeDecodeFailed)
+
+		sonoffBasicR2.observeDecodeFailed(id, command, err)
+		sonoffBasicR2.logDecodeFailed(id, sonoffBasicR2.getFullStatTopic(id, topicStat), err)
+
+		return nil, newPayloadError(id, command, err)
+	}
+
+	setSpanOutcome(span, TraceOutcomeSuccess)
+
+	return result, nil
+}
+
+// decodePhysicalButton extracts the value of SetOption73 from the RESULT response.
+func decodePhysicalButton(response string) (string, error) {
+	var data map[string]string
+
+	if err := json.Unmarshal([]byte(response), &data); err != nil {
+		return "", err
+	}
+
+	result, ok := data["SetOption73"]
+
+	if !ok {
+		return "", errors.New("SetOption73 not found")
+	}
+
+	return result, nil
+}
+
+// publishCmnd publishes a command to the device without waiting for a response.
+// Failed attempts are repeated according to the retry policy. Commands to offline devices may be queued (see SetOfflineQueueTTL).
+func (sonoffBasicR2 SonoffBasicR2) publishCmnd(ctx context.Context, policy RetryPolicy, id string, topicCmnd string, value string) (err error) {
+	ctx, span := sonoffBasicR2.startCommandSpan(ctx, id, topicCmnd)
+
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	queued := sonoffBasicR2.enqueueOffline(ctx, id, topicCmnd, value, func(ctx context.Context) error {
+		return sonoffBasicR2.publishCmnd(ctx, policy, id, topicCmnd, value)
+	})
+
+	if queued != nil {
+		setSpanOutcome(span, TraceOutcomeQueued)
+
+		return newCommandError(id, topicCmnd, queued)
+	}
+
+	call := CommandCall{DeviceID: id, Command: topicCmnd, Topic: topicCmnd, Payload: value}
+
+	return sonoffBasicR2.retry(ctx, policy, id, topicCmnd, value, func(ctx context.Context) error {
+		_, err := sonoffBasicR2.intercept(ctx, call, func(ctx context.Context, call CommandCall) (string, error) {
+			return "", sonoffBasicR2.publish(ctx, call.DeviceID, call.Topic, call.Payload)
+		})
+
+		return err
+	})
+}
+
+// publish sends a single attempt of a command without a response and sets the outcome on the command span.
+func (sonoffBasicR2 SonoffBasicR2) publish(ctx context.Context, id string, topicCmnd string, value string) (err error) {
+	span := trace.SpanFromContext(ctx)
+
+	if sonoffBasicR2.mainContext.Err() != nil {
+		setSpanOutcome(span, TraceOutcomeClosed)
+
+		return newCommandError(id, topicCmnd, ErrClosed)
+	}
+
+	if sonoffBasicR2.isFailFastOffline(id) {
+		setSpanOutcome(span, TraceOutcomeOffline)
+
+		err = newCommandError(id, topicCmnd, ErrDeviceOffline)
+
+		sonoffBasicR2.audit(ctx, id, topicCmnd, value, "", 0, err)
+
+		return err
+	}
+
+	start := time.Now()
+	fullTopicCmnd := sonoffBasicR2.getFullCmndTopic(id, topicCmnd)
+
+	_, publishSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanPublish, fullTopicCmnd)
+
+	errPublish := sonoffBasicR2.server.Publish(fullTopicCmnd, []byte(value), false, sonoffBasicR2.qos)
+
+	endSpan(publishSpan, errPublish)
+
+	duration := time.Since(start)
+
+	if errPublish != nil {
+		err = newPublishError(id, topicCmnd, errPublish)
+
+		setSpanOutcome(span, TraceOutcomePublishFailed)
+
+		sonoffBasicR2.logger().Error("command publish failed", LogKeyDevice, id, LogKeyTopic, fullTopicCmnd, LogKeyCommand, topicCmnd, LogKeyError, errPublish)
+	} else {
+		setSpanOutcome(span, TraceOutcomeSuccess)
+
+		sonoffBasicR2.logger().Debug("command published", LogKeyDevice, id, LogKeyTopic, fullTopicCmnd, LogKeyCommand, topicCmnd, LogKeyDuration, duration)
+	}
+
+	sonoffBasicR2.observeCommandCompleted(id, topicCmnd, duration, err)
+	sonoffBasicR2.audit(ctx, id, topicCmnd, value, "", duration, err)
+
+	return err
+}
+
+// sendPower sends the POWER command to the device.
+// With power confirmation enabled it waits for the RESULT of the device and records the confirmed power state.
+func (sonoffBasicR2 SonoffBasicR2) sendPower(ctx context.Context, policy RetryPolicy, id string, value string) (err error) {
+	if !sonoffBasicR2.getSettings().powerConfirmation {
+		return sonoffBasicR2.publishCmnd(ctx, policy, id, TasmotaCmndTopicPower, value)
+	}
+
+	ctx, span := sonoffBasicR2.startCommandSpan(ctx, id, TasmotaCmndTopicPower)
+
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	queued := sonoffBasicR2.enqueueOffline(ctx, id, TasmotaCmndTopicPower, value, func(ctx context.Context) error {
+		return sonoffBasicR2.sendPower(ctx, policy, id, value)
+	})
+
+	if queued != nil {
+		setSpanOutcome(span, TraceOutcomeQueued)
+
+		return newCommandError(id, TasmotaCmndTopicPower, queued)
+	}
+
+	response, err := sonoffBasicR2.getCmndResponseWithRetry(ctx, policy, id, TasmotaCmndTopicPower, TasmotaStatTopicResult, value)
+
+	if err != nil {
+		return err
+	}
+
+	_, decodeSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanDecode, "")
+
+	power, err := decodePower(response)
+
+	endSpan(decodeSpan, err)
+
+	if err != nil {
+		setSpanOutcome(span, TraceOutcomeDecodeFailed)
+
+		sonoffBasicR2.observeDecodeFailed(id, TasmotaCmndTopicPower, err)
+		sonoffBasicR2.logDecodeFailed(id, sonoffBasicR2.getFullStatTopic(id, TasmotaStatTopicResult), err)
+
+		return newPayloadError(id, TasmotaCmndTopicPower, err)
+	}
+
+	setSpanOutcome(span, TraceOutcomeSuccess)
+
+	sonoffBasicR2.updateStatePower(id, power)
+
+	// The result of a confirmed toggle is known, so it becomes the desired state
+	if value == TasmotaCmndTopicPowerValueToggle {
+		sonoffBasicR2.setDesiredPower(id, sonoffBasicR2.getPowerValue(id, power))
+	}
+
+	return nil
+}
+
+// decodePower extracts the power state from the RESULT response of the POWER command.
+func decodePower(response string) (string, error) {
+	var data map[string]any
+
+	if err := json.Unmarshal([]byte(response), &data); err != nil {
+		return "", err
+	}
+
+	result, ok := data["POWER"].(string)
+
+	if !ok {
+		return "", errors.New("POWER not found")
+	}
+
+	return result, nil
+}
+
+// getCmndResponseWithRetry sends the command and waits for the response, repeating failed attempts according to the retry policy.
+func (sonoffBasicR2 SonoffBasicR2) getCmndResponseWithRetry(ctx context.Context, policy RetryPolicy, id string, topicCmnd string, topicStat string, value string) (string, error) {
+	var response string
+
+	command := getCommandName(topicCmnd, value)
+	call := CommandCall{DeviceID: id, Command: command, Topic: topicCmnd, Payload: value, ResponseTopic: topicStat}
+
+	err := sonoffBasicR2.retry(ctx, policy, id, command, value, func(ctx context.Context) error {
+		var err error
+
+		response, err = sonoffBasicR2.intercept(ctx, call, func(ctx context.Context, call CommandCall) (string, error) {
+			return sonoffBasicR2.getCmndResponse(ctx, call.DeviceID, call.Topic, call.ResponseTopic, call.Payload)
+		})
+
+		return err
+	})
+
+	return response, err
 }
 
 // generateSubscriptionId generates a unique subscription ID for MQTT topics using a random number generator.
@@ -451,8 +1046,13 @@ func (sonoffBasicR2 SonoffBasicR2) generateSubscriptionId() int {
 }
 
 // Helper methods for constructing the full MQTT topic paths for command (cmnd), telemetry (tele), and status (stat) topics.
+// Devices announced via native discovery use their own FullTopic and prefixes.
 func (sonoffBasicR2 SonoffBasicR2) getFullTopic(prefix string, id string, topic string) string {
-	return fmt.Sprintf("%s/%s/%s", prefix, id, topic)
+	if device, ok := sonoffBasicR2.registry.get(id); ok {
+		return device.GetFullTopic(prefix, topic)
+	}
+
+	return Device{ID: id}.GetFullTopic(prefix, topic)
 }
 
 // getFullStatTopic constructs the full MQTT topic for device status ("stat") messages.
@@ -476,18 +1076,59 @@ func (sonoffBasicR2 SonoffBasicR2) getFullTeleTopic(id string, topic string) str
 // getCmndResponse sends a command to the Sonoff device and waits for a response.
 // It publishes the command on the "cmnd" topic and subscribes to the corresponding "stat" topic to capture the response.
 // If a response is not received within the defined timeout, it returns an error.
-func (sonoffBasicR2 SonoffBasicR2) getCmndResponse(id string, topicCmnd string, topicStat string, value string) (string, error) {
+// The steps are traced as children of the command span in the context.
+func (sonoffBasicR2 SonoffBasicR2) getCmndResponse(ctx context.Context, id string, topicCmnd string, topicStat string, value string) (response string, err error) {
 	// Get the full topic for status and command
 	fullTopicStat := sonoffBasicR2.getFullStatTopic(id, topicStat)
 	fullTopicCmnd := sonoffBasicR2.getFullCmndTopic(id, topicCmnd)
 
+	// Report the outcome of the round-trip to the observer
+	start := time.Now()
+	command := getCommandName(topicCmnd, value)
+	span := trace.SpanFromContext(ctx)
+
+	if sonoffBasicR2.mainContext.Err() != nil {
+		setSpanOutcome(span, TraceOutcomeClosed)
+
+		return "", newCommandError(id, command, ErrClosed)
+	}
+
+	defer func() {
+		sonoffBasicR2.observeCommandCompleted(id, command, time.Since(start), err)
+	}()
+
+	// Do not wait for a device that is known to be offline
+	if sonoffBasicR2.isFailFastOffline(id) {
+		setSpanOutcome(span, TraceOutcomeOffline)
+
+		sonoffBasicR2.logger().Debug("device offline, command not sent", LogKeyDevice, id, LogKeyCommand, command)
+
+		err = newCommandError(id, command, ErrDeviceOffline)
+
+		sonoffBasicR2.audit(ctx, id, command, value, "", 0, err)
+
+		return "", err
+	}
+
 	// Set a timeout for the response
-	ctx, cancel := context.WithTimeout(
-		sonoffBasicR2.mainContext,
-		time.Duration(sonoffBasicR2.ctxCmndResponseTimeoutInSeconds)*time.Second,
+	ctxTimeout, cancelTimeout := context.WithTimeout(
+		ctx,
+		time.Duration(sonoffBasicR2.getSettings().ctxCmndResponseTimeoutInSeconds)*time.Second,
 	)
 
-	defer cancel()
+	defer cancelTimeout()
+
+	// Stop waiting when SonoffBasicR2 is closed or the device goes offline
+	ctxResponse, cancel := context.WithCancelCause(ctxTimeout)
+
+	defer cancel(nil)
+
+	stop := context.AfterFunc(sonoffBasicR2.mainContext, func() {
+		cancel(ErrClosed)
+	})
+
+	defer stop()
+	defer sonoffBasicR2.pending.add(id, cancel)()
 
 	// Channel to capture the response
 	result := make(chan string, 1)
@@ -499,32 +1140,101 @@ func (sonoffBasicR2 SonoffBasicR2) getCmndResponse(id string, topicCmnd string,
 	subscribeResponse := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
 		select {
 		case result <- string(pk.Payload):
-		case <-ctx.Done():
+		case <-ctxResponse.Done():
 		}
 	}
 
 	// Subscribe to the status topic to receive the response
-	err := sonoffBasicR2.server.Subscribe(fullTopicStat, subscriptionId, subscribeResponse)
+	_, subscribeSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanSubscribe, fullTopicStat)
+
+	err = sonoffBasicR2.server.Subscribe(fullTopicStat, subscriptionId, subscribeResponse)
 
-	defer func(server MochiMQTTV2, filter string, subscriptionId int) {
-		_ = server.Unsubscribe(filter, subscriptionId)
-	}(sonoffBasicR2.server, fullTopicStat, subscriptionId)
+	endSpan(subscribeSpan, err)
+
+	defer sonoffBasicR2.logUnsubscribe(fullTopicStat, subscriptionId)
 
 	if err != nil {
-		return "", err
+		setSpanOutcome(span, TraceOutcomeSubscribeFailed)
+
+		sonoffBasicR2.logger().Error("subscribe failed", LogKeyDevice, id, LogKeyTopic, fullTopicStat, LogKeyCommand, command, LogKeyError, err)
+
+		return "", newCommandError(id, command, err)
 	}
 
 	// Publish the command to the device
-	_ = sonoffBasicR2.server.Publish(fullTopicCmnd, []byte(value), false, sonoffBasicR2.qos)
+	_, publishSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanPublish, fullTopicCmnd)
+
+	errPublish := sonoffBasicR2.server.Publish(fullTopicCmnd, []byte(value), false, sonoffBasicR2.qos)
+
+	endSpan(publishSpan, errPublish)
+
+	// Audit the command with the response (if any) once the round-trip is over
+	defer func() {
+		sonoffBasicR2.audit(ctx, id, command, value, response, time.Since(start), err)
+	}()
+
+	if errPublish != nil {
+		setSpanOutcome(span, TraceOutcomePublishFailed)
+
+		sonoffBasicR2.logger().Error("command publish failed", LogKeyDevice, id, LogKeyTopic, fullTopicCmnd, LogKeyCommand, command, LogKeyError, errPublish)
+
+		return "", newPublishError(id, command, errPublish)
+	}
+
+	sonoffBasicR2.logger().Debug("command published", LogKeyDevice, id, LogKeyTopic, fullTopicCmnd, LogKeyCommand, command)
 
 	// Wait for a response or timeout
+	_, waitSpan := sonoffBasicR2.startStepSpan(ctx, traceSpanWait, fullTopicStat)
+
 	select {
-	case <-ctx.Done():
-		return "", fmt.Errorf(
-			"operation not completed in %d seconds",
-			sonoffBasicR2.ctxCmndResponseTimeoutInSeconds,
-		)
+	case <-ctxResponse.Done():
+		// The caller gave up before the timeout
+		if ctx.Err() != nil {
+			err = newCommandError(id, command, ctx.Err())
+
+			setSpanOutcome(span, TraceOutcomeCanceled)
+			endSpan(waitSpan, err)
+
+			sonoffBasicR2.logger().Debug("command canceled", LogKeyDevice, id, LogKeyCommand, command, LogKeyDuration, time.Since(start), LogKeyError, ctx.Err())
+
+			return "", err
+		}
+
+		// SonoffBasicR2 was closed or the device went offline while waiting
+		switch cause := context.Cause(ctxResponse); cause {
+		case ErrClosed:
+			err = newCommandError(id, command, ErrClosed)
+
+			setSpanOutcome(span, TraceOutcomeClosed)
+			endSpan(waitSpan, err)
+
+			return "", err
+		case ErrDeviceOffline:
+			err = newCommandError(id, command, ErrDeviceOffline)
+
+			setSpanOutcome(span, TraceOutcomeOffline)
+			endSpan(waitSpan, err)
+
+			sonoffBasicR2.logger().Warn("device went offline while waiting", LogKeyDevice, id, LogKeyCommand, command, LogKeyDuration, time.Since(start))
+
+			return "", err
+		}
+
+		err = sonoffBasicR2.newTimeoutError(id, command)
+
+		setSpanOutcome(span, TraceOutcomeTimeout)
+		endSpan(waitSpan, err)
+
+		sonoffBasicR2.observeCommandTimedOut(id, command)
+
+		sonoffBasicR2.logger().Warn("command timed out", LogKeyDevice, id, LogKeyTopic, fullTopicStat, LogKeyCommand, command, LogKeyDuration, time.Since(start))
+
+		return "", err
 	case data := <-result:
+		endSpan(waitSpan, nil)
+
+		sonoffBasicR2.logger().Debug("command response received", LogKeyDevice, id, LogKeyTopic, fullTopicStat, LogKeyCommand, command, LogKeyDuration, time.Since(start))
+
 		return data, nil
 	}
 }
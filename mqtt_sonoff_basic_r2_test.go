@@ -1,6 +1,7 @@
 package mqtt_sonoff_basic_r2
 
 import (
+	"context"
 	"fmt"
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
@@ -16,7 +17,11 @@ type MockMQTTServer struct {
 	subscribeChan chan mqtt.InlineSubFn
 }
 
-func NewMockMQTTServer() (*SonoffBasicR2, *MockMQTTServer, error) {
+// MockOption configures the SonoffBasicR2 or the mock server before Serve.
+// Expectations set by an option take precedence over the default ones.
+type MockOption func(sonoffServer *SonoffBasicR2, mockServer *MockMQTTServer)
+
+func NewMockMQTTServer(options ...MockOption) (*SonoffBasicR2, *MockMQTTServer, error) {
 	mockServer := new(MockMQTTServer)
 	mockServer.subscribeChan = make(chan mqtt.InlineSubFn, 1)
 	sonoffServer, err := NewSonoffBasicR2WithServer(mockServer, 1)
@@ -27,6 +32,10 @@ func NewMockMQTTServer() (*SonoffBasicR2, *MockMQTTServer, error) {
 
 	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(MockCtxCmndResponseTimeoutInSeconds)
 
+	for _, option := range options {
+		option(sonoffServer, mockServer)
+	}
+
 	mockServer.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	mockServer.On("Unsubscribe", mock.Anything, mock.Anything).Return(nil)
 	mockServer.On("Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
@@ -60,6 +69,17 @@ func (m *MockMQTTServer) Publish(topic string, payload []byte, retain bool, qos
 	return m.Called(topic, payload, retain, qos).Error(0)
 }
 
+type MockMQTTServerWithHooks struct {
+	MockMQTTServer
+	hooks []mqtt.Hook
+}
+
+func (m *MockMQTTServerWithHooks) AddHook(hook mqtt.Hook, config any) error {
+	m.hooks = append(m.hooks, hook)
+
+	return nil
+}
+
 func TestSonoffBasicR2_Close(t *testing.T) {
 	sonoffServer, _, err := NewMockMQTTServer()
 
@@ -611,7 +631,7 @@ func TestSonoffBasicR2_getCmndResponse(t *testing.T) {
 	assert.NoError(t, err)
 
 	go func() {
-		response, err := sonoffServer.getCmndResponse("1", "TEST", "TEST1", "TEST2")
+		response, err := sonoffServer.getCmndResponse(context.Background(), "1", "TEST", "TEST1", "TEST2")
 
 		assert.NoError(t, err)
 
@@ -637,3 +657,86 @@ func TestSonoffBasicR2_getCmndResponse(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestSonoffBasicR2_getCmndResponseCanceled(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	_, err = sonoffServer.StatusContext(ctx, "1")
+
+	assert.ErrorIs(t, err, context.Canceled)
+
+	<-mockServer.subscribeChan
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_SessionHook(t *testing.T) {
+	mockServer := new(MockMQTTServerWithHooks)
+
+	sonoffServer, err := NewSonoffBasicR2WithServer(mockServer, 0)
+
+	assert.NoError(t, err)
+	assert.Len(t, mockServer.hooks, 1)
+	assert.Equal(t, sonoffServer.SessionHook(), mockServer.hooks[0])
+}
+
+func TestSonoffBasicR2_Device(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	events := make(chan DeviceEvent, 2)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		events <- event
+	})
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handler := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Origin: "DVES_1", Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	event := <-events
+
+	assert.Equal(t, DeviceEventConnected, event.Type)
+	assert.Equal(t, "DVES_1", event.Device.Session.ClientID)
+
+	device, ok := sonoffServer.Device("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, device.Online)
+	assert.Len(t, sonoffServer.Devices(), 1)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_Deregister(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	assert.Equal(t, mockServer, sonoffServer.Server())
+	assert.Equal(t, byte(1), sonoffServer.GetQos())
+
+	sonoffServer.registry.markOnline("1", "")
+
+	assert.Equal(t, true, sonoffServer.Deregister("1"))
+	assert.Equal(t, false, sonoffServer.Deregister("1"))
+	assert.Len(t, sonoffServer.Devices(), 0)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,195 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"fmt"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"sync"
+)
+
+// MQTT topics of Tasmota native discovery
+const (
+	// TasmotaDiscoveryPrefix is the topic prefix under which Tasmota publishes retained discovery messages.
+	TasmotaDiscoveryPrefix = "tasmota/discovery"
+
+	// TasmotaDiscoveryTopicConfig is the discovery message describing the device and its topic layout.
+	TasmotaDiscoveryTopicConfig = "config"
+
+	// TasmotaDiscoveryValueAll subscribes to the discovery messages of all devices.
+	TasmotaDiscoveryValueAll = "+"
+)
+
+// subscribeNativeDiscovery subscribes to the discovery config messages of all devices.
+func (sonoffBasicR2 SonoffBasicR2) subscribeNativeDiscovery() error {
+	topicDiscovery := sonoffBasicR2.getFullDiscoveryTopic(TasmotaDiscoveryValueAll, TasmotaDiscoveryTopicConfig)
+	subscribeDiscovery := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		// An empty payload clears the retained message, there is nothing to register
+		if len(pk.Payload) == 0 {
+			return
+		}
+
+		config, err := UnmarshalDiscoveryConfig(pk.Payload)
+
+		if err != nil {
+			sonoffBasicR2.logDecodeFailed("", pk.TopicName, err)
+
+			return
+		}
+
+		if config.Topic == "" {
+			return
+		}
+
+		sonoffBasicR2.discoveredNative(config)
+	}
+
+	return sonoffBasicR2.server.Subscribe(topicDiscovery, sonoffBasicR2.generateSubscriptionId(), subscribeDiscovery)
+}
+
+// discoveryLWTSubscription is the subscription of the LWT topic of a device with a custom topic layout.
+type discoveryLWTSubscription struct {
+	filter         string
+	subscriptionId int
+}
+
+// discoveryLWTSubscriptions keeps the LWT subscriptions of the devices with a custom topic layout, keyed by their MAC,
+// so the subscription follows the device when its Topic or FullTopic changes.
+type discoveryLWTSubscriptions struct {
+	mutex         sync.Mutex
+	subscriptions map[string]discoveryLWTSubscription
+}
+
+// newDiscoveryLWTSubscriptions creates an empty set of LWT subscriptions.
+func newDiscoveryLWTSubscriptions() *discoveryLWTSubscriptions {
+	return &discoveryLWTSubscriptions{
+		subscriptions: make(map[string]discoveryLWTSubscription),
+	}
+}
+
+// swap replaces the subscription of the device (nil removes it) and returns the previous one.
+// It reports false if the device is already subscribed to the same filter, so nothing has to change.
+func (subscriptions *discoveryLWTSubscriptions) swap(key string, current *discoveryLWTSubscription) (*discoveryLWTSubscription, bool) {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	previous, loaded := subscriptions.subscriptions[key]
+
+	switch {
+	case !loaded && current == nil:
+		return nil, false
+	case loaded && current != nil && previous.filter == current.filter:
+		return nil, false
+	case current == nil:
+		delete(subscriptions.subscriptions, key)
+	default:
+		subscriptions.subscriptions[key] = *current
+	}
+
+	if !loaded {
+		return nil, true
+	}
+
+	return &previous, true
+}
+
+// isCurrent reports whether the subscription is still the one of the device.
+func (subscriptions *discoveryLWTSubscriptions) isCurrent(key string, subscription discoveryLWTSubscription) bool {
+	subscriptions.mutex.Lock()
+	defer subscriptions.mutex.Unlock()
+
+	return subscriptions.subscriptions[key] == subscription
+}
+
+// discoveredNative registers the device announced via native discovery.
+// Devices with a custom topic layout are not covered by the tele/+/LWT subscription, so their LWT topic is subscribed separately.
+// The subscription of a previous layout of the device (identified by its MAC) is removed,
+// and so is its registry entry when the device announced a new Topic.
+func (sonoffBasicR2 SonoffBasicR2) discoveredNative(config *DiscoveryConfig) {
+	if config.MAC != "" {
+		for _, device := range sonoffBasicR2.registry.all() {
+			if device.ID != config.Topic && device.Discovery != nil && device.Discovery.MAC == config.MAC {
+				sonoffBasicR2.registry.remove(device.ID)
+
+				sonoffBasicR2.logger().Info("device announced a new topic", LogKeyDevice, device.ID, LogKeyTopic, config.Topic)
+			}
+		}
+	}
+
+	sonoffBasicR2.registry.update(config.Topic, DeviceEventDiscovered, func(device *Device) {
+		device.Discovery = config
+	})
+
+	sonoffBasicR2.logger().Debug("device announced", LogKeyDevice, config.Topic)
+
+	key := config.MAC
+
+	if key == "" {
+		key = config.Topic
+	}
+
+	var current *discoveryLWTSubscription
+
+	topicTeleLWT := config.GetFullTopic(TasmotaPrefixTele, TasmotaTeleTopicLWT)
+
+	if !config.IsDefaultLayout() {
+		current = &discoveryLWTSubscription{filter: topicTeleLWT, subscriptionId: sonoffBasicR2.generateSubscriptionId()}
+
+		// A session that started before the announcement belongs to the device now
+		sonoffBasicR2.sessionHook.announce(config.Topic, topicTeleLWT)
+	}
+
+	previous, changed := sonoffBasicR2.discoveryLWTSubscriptions.swap(key, current)
+
+	if !changed {
+		return
+	}
+
+	onlinePayload := config.OnlinePayload
+	offlinePayload := config.OfflinePayload
+
+	if onlinePayload == "" {
+		onlinePayload = TasmotaTeleTopicLWTResponseOnline
+	}
+
+	if offlinePayload == "" {
+		offlinePayload = TasmotaTeleTopicLWTResponseOffline
+	}
+
+	subscribeLWT := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		switch string(pk.Payload) {
+		case onlinePayload:
+			sonoffBasicR2.teleConnected(config.Topic, pk.Origin)
+		case offlinePayload:
+			sonoffBasicR2.teleDisconnected(config.Topic)
+		}
+	}
+
+	// Subscribe outside the broker goroutine, since retained LWT messages are delivered synchronously
+	go func() {
+		if previous != nil {
+			sonoffBasicR2.logUnsubscribe(previous.filter, previous.subscriptionId)
+		}
+
+		if current == nil {
+			return
+		}
+
+		err := sonoffBasicR2.server.Subscribe(current.filter, current.subscriptionId, subscribeLWT)
+
+		if err != nil {
+			sonoffBasicR2.logger().Error("subscribe failed", LogKeyDevice, config.Topic, LogKeyTopic, current.filter, LogKeyError, err)
+
+			return
+		}
+
+		// The layout changed again while subscribing, and the newer announcement could not unsubscribe this filter yet
+		if !sonoffBasicR2.discoveryLWTSubscriptions.isCurrent(key, *current) {
+			sonoffBasicR2.logUnsubscribe(current.filter, current.subscriptionId)
+		}
+	}()
+}
+
+// getFullDiscoveryTopic constructs the full MQTT topic for native discovery messages of the device with the given MAC.
+func (sonoffBasicR2 SonoffBasicR2) getFullDiscoveryTopic(mac string, topic string) string {
+	return fmt.Sprintf("%s/%s/%s", TasmotaDiscoveryPrefix, mac, topic)
+}
@@ -0,0 +1,201 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"fmt"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"testing"
+	"time"
+)
+
+func WithMockNativeDiscovery() MockOption {
+	return func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetNativeDiscovery(true)
+	}
+}
+
+func TestSonoffBasicR2_NativeDiscovery(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockNativeDiscovery())
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, sonoffServer.GetNativeDiscovery())
+
+	events := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		events <- event
+	})
+
+	fullDiscoveryTopic := sonoffServer.getFullDiscoveryTopic("A4CF12ABCDEF", TasmotaDiscoveryTopicConfig)
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullDiscoveryTopic, Payload: []byte(JsonDiscoveryConfigData)})
+
+	event := <-events
+
+	assert.Equal(t, DeviceEventDiscovered, event.Type)
+	assert.Equal(t, "tasmota_ABCDEF", event.Device.ID)
+	assert.Equal(t, "12.5.0", event.Device.Discovery.SoftwareVersion)
+	assert.Equal(t, 1, event.Device.Discovery.RelayCount())
+
+	assert.Equal(t, sonoffServer.getFullDiscoveryTopic(TasmotaDiscoveryValueAll, TasmotaDiscoveryTopicConfig), mockServer.Calls[2].Arguments.Get(0).(string))
+	assert.Len(t, mockServer.Calls, 3)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_NativeDiscoveryCustomLayout(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockNativeDiscovery())
+
+	assert.NoError(t, err)
+
+	payload := strings.ReplaceAll(JsonDiscoveryConfigData, `"%prefix%/%topic%/"`, `"home/%topic%/%prefix%/"`)
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(payload)})
+
+	assert.Equal(t, "home/tasmota_ABCDEF/cmnd/POWER", sonoffServer.getFullCmndTopic("tasmota_ABCDEF", TasmotaCmndTopicPower))
+	assert.Equal(t, "home/tasmota_ABCDEF/stat/RESULT", sonoffServer.getFullStatTopic("tasmota_ABCDEF", TasmotaStatTopicResult))
+
+	handlerLWT := <-mockServer.subscribeChan
+	handlerLWT(nil, packets.Subscription{}, packets.Packet{TopicName: "home/tasmota_ABCDEF/tele/LWT", Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "tasmota_ABCDEF", <-sonoffServer.TeleConnected())
+
+	err = sonoffServer.PowerOn("tasmota_ABCDEF")
+
+	assert.NoError(t, err)
+
+	mockServer.AssertCalled(t, "Publish", "home/tasmota_ABCDEF/cmnd/POWER", []byte(TasmotaCmndTopicPowerValueOn), false, byte(1))
+
+	handlerLWT(nil, packets.Subscription{}, packets.Packet{TopicName: "home/tasmota_ABCDEF/tele/LWT", Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "tasmota_ABCDEF", <-sonoffServer.TeleDisconnected())
+
+	err = sonoffServer.PowerOn("tasmota_ABCDEF")
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+// silentT collects the result of mock assertions that are polled with assert.Eventually.
+type silentT struct {
+	failed bool
+}
+
+func (t *silentT) Logf(format string, args ...any) {}
+
+func (t *silentT) Errorf(format string, args ...any) {
+	t.failed = true
+}
+
+func (t *silentT) FailNow() {
+	t.failed = true
+}
+
+func TestSonoffBasicR2_NativeDiscoveryLayoutChange(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockNativeDiscovery())
+
+	assert.NoError(t, err)
+
+	handler := <-mockServer.subscribeChan
+
+	announce := func(fullTopic string) {
+		payload := strings.ReplaceAll(JsonDiscoveryConfigData, `"%prefix%/%topic%/"`, fullTopic)
+
+		handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(payload)})
+	}
+
+	isUnsubscribed := func(filter string) func() bool {
+		return func() bool {
+			silent := new(silentT)
+
+			return mockServer.AssertCalled(silent, "Unsubscribe", filter, mock.Anything)
+		}
+	}
+
+	announce(`"home/%topic%/%prefix%/"`)
+
+	<-mockServer.subscribeChan
+
+	// The same layout is not subscribed again
+	announce(`"home/%topic%/%prefix%/"`)
+
+	// A new layout of the device (same MAC) replaces the subscription of the old LWT topic
+	announce(`"office/%topic%/%prefix%/"`)
+
+	<-mockServer.subscribeChan
+
+	assert.Equal(t, true, isUnsubscribed("home/tasmota_ABCDEF/tele/LWT")())
+	assert.Equal(t, false, isUnsubscribed("office/tasmota_ABCDEF/tele/LWT")())
+
+	// The default layout is covered by tele/+/LWT
+	announce(`"%prefix%/%topic%/"`)
+
+	assert.Eventually(t, isUnsubscribed("office/tasmota_ABCDEF/tele/LWT"), time.Second, 10*time.Millisecond)
+
+	mockServer.AssertNumberOfCalls(t, "Subscribe", 5)
+	mockServer.AssertNumberOfCalls(t, "Unsubscribe", 2)
+
+	deregistered := make(chan DeviceEvent, 1)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		if event.Type == DeviceEventDeregistered {
+			deregistered <- event
+		}
+	})
+
+	// A new Topic of the device (same MAC) replaces its registry entry
+	payload := strings.ReplaceAll(JsonDiscoveryConfigData, `"tasmota_ABCDEF"`, `"kitchen"`)
+
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(payload)})
+
+	assert.Equal(t, "tasmota_ABCDEF", (<-deregistered).Device.ID)
+
+	devices := sonoffServer.Devices()
+
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "kitchen", devices[0].ID)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_NativeDiscoveryInvalidPayload(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockNativeDiscovery())
+
+	assert.NoError(t, err)
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte{}})
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte("test")})
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"ip":"192.168.1.50"}`)})
+
+	assert.Len(t, sonoffServer.Devices(), 0)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_getFullDiscoveryTopic(t *testing.T) {
+	sonoffServer, _, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	fullDiscoveryTopicWithDefaultFormat := fmt.Sprintf("%s/%s/%s", TasmotaDiscoveryPrefix, "A4CF12ABCDEF", TasmotaDiscoveryTopicConfig)
+
+	assert.Equal(t, fullDiscoveryTopicWithDefaultFormat, sonoffServer.getFullDiscoveryTopic("A4CF12ABCDEF", TasmotaDiscoveryTopicConfig))
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
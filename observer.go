@@ -0,0 +1,63 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"time"
+)
+
+// Observer receives notifications about the command traffic of SonoffBasicR2, e.g. to collect metrics.
+// Methods are called synchronously and must not block.
+type Observer interface {
+	// CommandCompleted is called after every command with its duration and resulting error.
+	// For commands with a response the duration covers the whole round-trip.
+	CommandCompleted(id string, command string, duration time.Duration, err error)
+
+	// CommandTimedOut is called when a device does not answer a command within the response timeout.
+	CommandTimedOut(id string, command string)
+
+	// DecodeFailed is called when the response of a device cannot be decoded.
+	DecodeFailed(id string, command string, err error)
+}
+
+// RetryObserver is implemented by observers that are also notified about retried commands.
+type RetryObserver interface {
+	// CommandRetried is called when a failed attempt of a command is repeated according to the retry policy.
+	CommandRetried(id string, command string, attempt int, err error)
+}
+
+// observeCommandCompleted notifies the observer about a completed command.
+func (sonoffBasicR2 SonoffBasicR2) observeCommandCompleted(id string, command string, duration time.Duration, err error) {
+	if observer := sonoffBasicR2.getSettings().observer; observer != nil {
+		observer.CommandCompleted(id, command, duration, err)
+	}
+}
+
+// observeCommandTimedOut notifies the observer about a command without a response.
+func (sonoffBasicR2 SonoffBasicR2) observeCommandTimedOut(id string, command string) {
+	if observer := sonoffBasicR2.getSettings().observer; observer != nil {
+		observer.CommandTimedOut(id, command)
+	}
+}
+
+// observeDecodeFailed notifies the observer about a response that cannot be decoded.
+func (sonoffBasicR2 SonoffBasicR2) observeDecodeFailed(id string, command string, err error) {
+	if observer := sonoffBasicR2.getSettings().observer; observer != nil {
+		observer.DecodeFailed(id, command, err)
+	}
+}
+
+// observeCommandRetried notifies the observer about a failed attempt that is repeated, if it implements RetryObserver.
+func (sonoffBasicR2 SonoffBasicR2) observeCommandRetried(id string, command string, attempt int, err error) {
+	if retryObserver, ok := sonoffBasicR2.getSettings().observer.(RetryObserver); ok {
+		retryObserver.CommandRetried(id, command, attempt, err)
+	}
+}
+
+// getCommandName returns the name under which a command is reported, e.g. STATUS11 or POWER.
+// The value is only part of the name for STATUS, where it selects the kind of status.
+func getCommandName(topicCmnd string, value string) string {
+	if topicCmnd == TasmotaCmndTopicStatus {
+		return topicCmnd + value
+	}
+
+	return topicCmnd
+}
@@ -0,0 +1,105 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockObserver struct {
+	mutex     sync.Mutex
+	completed []string
+	timedOut  []string
+	retried   []string
+	failed    []string
+	errors    []error
+}
+
+func (m *MockObserver) CommandCompleted(id string, command string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.completed = append(m.completed, id+"/"+command)
+	m.errors = append(m.errors, err)
+}
+
+func (m *MockObserver) CommandTimedOut(id string, command string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.timedOut = append(m.timedOut, id+"/"+command)
+}
+
+func (m *MockObserver) CommandRetried(id string, command string, attempt int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.retried = append(m.retried, id+"/"+command)
+}
+
+func (m *MockObserver) DecodeFailed(id string, command string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.failed = append(m.failed, id+"/"+command)
+}
+
+func TestSonoffBasicR2_Observer(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	observer := new(MockObserver)
+
+	assert.Nil(t, sonoffServer.GetObserver())
+
+	sonoffServer.SetObserver(observer)
+
+	assert.Equal(t, observer, sonoffServer.GetObserver())
+
+	sonoffServer.PowerOn("1")
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte("test")})
+
+	assert.Error(t, <-responseChan)
+
+	go func() {
+		_, err := sonoffServer.StatusTwo("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	assert.Error(t, <-responseChan)
+
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+
+	assert.Equal(t, []string{"1/POWER", "1/STATUS11", "1/STATUS2"}, observer.completed)
+	assert.Equal(t, []error{nil, nil}, observer.errors[:2])
+	assert.Error(t, observer.errors[2])
+	assert.Equal(t, []string{"1/STATUS2"}, observer.timedOut)
+	assert.Equal(t, []string{"1/STATUS11"}, observer.failed)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestGetCommandName(t *testing.T) {
+	assert.Equal(t, "STATUS11", getCommandName(TasmotaCmndTopicStatus, TasmotaStatTopicStatusElevenValue))
+	assert.Equal(t, "STATUS0", getCommandName(TasmotaCmndTopicStatusAll, ""))
+	assert.Equal(t, "POWER", getCommandName(TasmotaCmndTopicPower, TasmotaCmndTopicPowerValueOn))
+}
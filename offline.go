@@ -0,0 +1,79 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"sync"
+)
+
+// pendingCommands keeps track of the commands waiting for a response, so they can be woken up when their device goes offline.
+type pendingCommands struct {
+	mutex   sync.Mutex
+	next    uint64
+	waiters map[string]map[uint64]context.CancelCauseFunc
+}
+
+// newPendingCommands creates an empty set of pending commands.
+func newPendingCommands() *pendingCommands {
+	return &pendingCommands{
+		waiters: make(map[string]map[uint64]context.CancelCauseFunc),
+	}
+}
+
+// add registers the cancel function of a command waiting for the device and returns a function that removes it again.
+func (pending *pendingCommands) add(id string, cancel context.CancelCauseFunc) func() {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	pending.next++
+	key := pending.next
+
+	if pending.waiters[id] == nil {
+		pending.waiters[id] = make(map[uint64]context.CancelCauseFunc)
+	}
+
+	pending.waiters[id][key] = cancel
+
+	return func() {
+		pending.mutex.Lock()
+		defer pending.mutex.Unlock()
+
+		delete(pending.waiters[id], key)
+
+		if len(pending.waiters[id]) == 0 {
+			delete(pending.waiters, id)
+		}
+	}
+}
+
+// cancel wakes up all commands waiting for the device with the given cause and returns how many there were.
+func (pending *pendingCommands) cancel(id string, cause error) int {
+	pending.mutex.Lock()
+	waiters := pending.waiters[id]
+	delete(pending.waiters, id)
+	pending.mutex.Unlock()
+
+	for _, cancel := range waiters {
+		cancel(cause)
+	}
+
+	return len(waiters)
+}
+
+// GetFailFastOffline returns whether commands to devices known to be offline fail immediately.
+func (sonoffBasicR2 SonoffBasicR2) GetFailFastOffline() bool {
+	return sonoffBasicR2.getSettings().failFastOffline
+}
+
+// SetFailFastOffline sets whether commands to devices known to be offline fail immediately with ErrDeviceOffline (default true).
+// When disabled, the commands are still sent and wait for the response timeout.
+// Commands waiting for a response are woken up with ErrDeviceOffline as soon as the device reports "Offline", regardless of this setting.
+func (sonoffBasicR2 *SonoffBasicR2) SetFailFastOffline(value bool) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.failFastOffline = value
+	})
+}
+
+// isFailFastOffline reports whether a command to the device must fail right away because the device is offline.
+func (sonoffBasicR2 SonoffBasicR2) isFailFastOffline(id string) bool {
+	return sonoffBasicR2.getSettings().failFastOffline && sonoffBasicR2.registry.offline(id)
+}
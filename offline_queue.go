@@ -0,0 +1,252 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QueuedCommand is a command to an offline device that is sent as soon as the device reports "Online".
+// It is returned inside the *CommandError of the call that queued it and works as a future for the result of the delivery.
+type QueuedCommand struct {
+	DeviceID string
+	Command  string
+	Value    string
+	QueuedAt time.Time
+
+	ctx   context.Context
+	send  func(ctx context.Context) error
+	timer *time.Timer
+	once  sync.Once
+	done  chan struct{}
+	err   error
+}
+
+// Error returns the message of ErrQueued, so the queued command can be returned as the error of the call.
+func (command *QueuedCommand) Error() string {
+	return ErrQueued.Error()
+}
+
+// Unwrap returns ErrQueued.
+func (command *QueuedCommand) Unwrap() error {
+	return ErrQueued
+}
+
+// Done returns a channel that is closed when the command is delivered, expired, superseded or dropped.
+func (command *QueuedCommand) Done() <-chan struct{} {
+	return command.done
+}
+
+// Err returns the result of the delivery after Done is closed, or nil before.
+func (command *QueuedCommand) Err() error {
+	select {
+	case <-command.done:
+		return command.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the command is done and returns the result of the delivery, or the error of the context.
+func (command *QueuedCommand) Wait(ctx context.Context) error {
+	select {
+	case <-command.done:
+		return command.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnDone calls the callback with the result of the delivery once the command is done.
+func (command *QueuedCommand) OnDone(callback func(err error)) {
+	go func() {
+		<-command.done
+
+		callback(command.err)
+	}()
+}
+
+// complete stores the result of the delivery and wakes up the waiters. Only the first result is kept.
+func (command *QueuedCommand) complete(err error) {
+	command.once.Do(func() {
+		command.timer.Stop()
+		command.err = err
+
+		close(command.done)
+	})
+}
+
+// offlineQueue keeps the queued commands of the offline devices in the order they were queued.
+type offlineQueue struct {
+	mutex    sync.Mutex
+	commands map[string][]*QueuedCommand
+}
+
+// newOfflineQueue creates an empty offline queue.
+func newOfflineQueue() *offlineQueue {
+	return &offlineQueue{
+		commands: make(map[string][]*QueuedCommand),
+	}
+}
+
+// add queues the command when offline reports true and returns the commands it supersedes.
+// Commands with an absolute value (e.g. POWER ON/OFF) replace the queued commands of the same kind ("latest wins"),
+// while toggles are always appended. The check and the insert happen under the lock, so a device coming online
+// cannot miss a command queued at the same time.
+func (queue *offlineQueue) add(command *QueuedCommand, offline func() bool) (queued bool, superseded []*QueuedCommand) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if !offline() {
+		return false, nil
+	}
+
+	var commands []*QueuedCommand
+
+	for _, other := range queue.commands[command.DeviceID] {
+		if command.Value != TasmotaCmndTopicPowerValueToggle && other.Command == command.Command {
+			superseded = append(superseded, other)
+		} else {
+			commands = append(commands, other)
+		}
+	}
+
+	queue.commands[command.DeviceID] = append(commands, command)
+
+	return true, superseded
+}
+
+// remove takes the command out of the queue and reports whether it was still queued.
+func (queue *offlineQueue) remove(command *QueuedCommand) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	commands := queue.commands[command.DeviceID]
+
+	for i, other := range commands {
+		if other == command {
+			queue.commands[command.DeviceID] = append(commands[:i:i], commands[i+1:]...)
+
+			if len(queue.commands[command.DeviceID]) == 0 {
+				delete(queue.commands, command.DeviceID)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// take removes and returns the queued commands of the device.
+func (queue *offlineQueue) take(id string) []*QueuedCommand {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	commands := queue.commands[id]
+	delete(queue.commands, id)
+
+	return commands
+}
+
+// takeAll removes and returns the queued commands of all devices.
+func (queue *offlineQueue) takeAll() []*QueuedCommand {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	var result []*QueuedCommand
+
+	for id, commands := range queue.commands {
+		result = append(result, commands...)
+		delete(queue.commands, id)
+	}
+
+	return result
+}
+
+// offlineQueueBypassKey marks the context of a queued command that is being delivered, so it is not queued again.
+type offlineQueueBypassKey struct{}
+
+// GetOfflineQueueTTL returns how long commands to offline devices are kept in the queue.
+func (sonoffBasicR2 SonoffBasicR2) GetOfflineQueueTTL() time.Duration {
+	return sonoffBasicR2.getSettings().offlineQueueTTL
+}
+
+// SetOfflineQueueTTL enables the offline queue: POWER and SetOption73 commands to devices known to be offline are queued
+// for up to the given duration and sent when the device reports "Online" again. Zero disables the queue (default).
+// The call that queues a command returns ErrQueued; use errors.As to get the *QueuedCommand and wait for the delivery.
+func (sonoffBasicR2 *SonoffBasicR2) SetOfflineQueueTTL(value time.Duration) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.offlineQueueTTL = value
+	})
+}
+
+// enqueueOffline queues the command when the offline queue is enabled and the device is known to be offline.
+// It returns nil when the command has to be sent right away.
+func (sonoffBasicR2 SonoffBasicR2) enqueueOffline(ctx context.Context, id string, topicCmnd string, value string, send func(ctx context.Context) error) *QueuedCommand {
+	// In dry-run mode the command is recorded right away, it must not be published when dry-run mode ends
+	settings := sonoffBasicR2.getSettings()
+
+	if settings.offlineQueueTTL <= 0 || settings.dryRun || ctx.Value(offlineQueueBypassKey{}) != nil {
+		return nil
+	}
+
+	command := &QueuedCommand{
+		DeviceID: id,
+		Command:  topicCmnd,
+		Value:    value,
+		QueuedAt: time.Now(),
+		ctx:      context.WithoutCancel(ctx),
+		send:     send,
+		done:     make(chan struct{}),
+	}
+
+	// The timer is created before the command is visible to other goroutines, so complete can always stop it
+	command.timer = time.AfterFunc(settings.offlineQueueTTL, func() {
+		if sonoffBasicR2.offlineQueue.remove(command) {
+			sonoffBasicR2.logger().Warn("queued command expired", LogKeyDevice, id, LogKeyCommand, topicCmnd)
+
+			command.complete(newCommandError(id, topicCmnd, ErrQueueExpired))
+		}
+	})
+
+	queued, superseded := sonoffBasicR2.offlineQueue.add(command, func() bool {
+		return sonoffBasicR2.registry.offline(id)
+	})
+
+	if !queued {
+		command.timer.Stop()
+
+		return nil
+	}
+
+	for _, other := range superseded {
+		other.complete(newCommandError(id, other.Command, ErrSuperseded))
+	}
+
+	sonoffBasicR2.logger().Info("command queued", LogKeyDevice, id, LogKeyCommand, topicCmnd, LogKeyDuration, settings.offlineQueueTTL)
+
+	return command
+}
+
+// flushOfflineQueue sends the queued commands of the device in the order they were queued.
+func (sonoffBasicR2 SonoffBasicR2) flushOfflineQueue(id string) {
+	commands := sonoffBasicR2.offlineQueue.take(id)
+
+	if len(commands) == 0 {
+		return
+	}
+
+	sonoffBasicR2.logger().Info("sending queued commands", LogKeyDevice, id, LogKeyQueued, len(commands))
+
+	for _, command := range commands {
+		command.complete(command.send(context.WithValue(command.ctx, offlineQueueBypassKey{}, true)))
+	}
+}
+
+// dropOfflineQueue completes all queued commands with ErrClosed.
+func (sonoffBasicR2 SonoffBasicR2) dropOfflineQueue() {
+	for _, command := range sonoffBasicR2.offlineQueue.takeAll() {
+		command.complete(newCommandError(command.DeviceID, command.Command, ErrClosed))
+	}
+}
@@ -0,0 +1,129 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func WithMockOfflineQueue(ttl time.Duration) MockOption {
+	return func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetOfflineQueueTTL(ttl)
+	}
+}
+
+func disconnectMockDevice(sonoffServer *SonoffBasicR2, mockServer *MockMQTTServer, id string) {
+	handler := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic(id, TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	<-sonoffServer.TeleDisconnected()
+}
+
+func TestSonoffBasicR2_OfflineQueue(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockOfflineQueue(time.Minute))
+
+	assert.NoError(t, err)
+
+	disconnectMockDevice(sonoffServer, mockServer, "1")
+
+	assert.Equal(t, time.Minute, sonoffServer.GetOfflineQueueTTL())
+
+	var first, second, toggle *QueuedCommand
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.ErrorIs(t, err, ErrQueued)
+	assert.ErrorAs(t, err, &first)
+
+	err = sonoffServer.PowerToggle("1")
+
+	assert.ErrorAs(t, err, &toggle)
+
+	err = sonoffServer.PowerOff("1")
+
+	assert.ErrorAs(t, err, &second)
+	assert.Equal(t, "1", second.DeviceID)
+	assert.Equal(t, TasmotaCmndTopicPower, second.Command)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, second.Value)
+
+	// POWER OFF replaces the queued POWER ON and the toggle
+	<-first.Done()
+
+	assert.ErrorIs(t, first.Err(), ErrSuperseded)
+	assert.ErrorIs(t, toggle.Err(), ErrSuperseded)
+	assert.NoError(t, second.Err())
+
+	// Status commands are not queued
+	_, err = sonoffServer.StatusEleven("1")
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	results := make(chan error, 1)
+
+	second.OnDone(func(err error) {
+		results <- err
+	})
+
+	handler := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT), Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+	assert.NoError(t, second.Wait(context.Background()))
+	assert.NoError(t, <-results)
+
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), []byte(TasmotaCmndTopicPowerValueOff), false, byte(1))
+	mockServer.AssertNumberOfCalls(t, "Publish", 1)
+
+	// Online devices get the command right away
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_OfflineQueueExpired(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockOfflineQueue(10 * time.Millisecond))
+
+	assert.NoError(t, err)
+
+	disconnectMockDevice(sonoffServer, mockServer, "1")
+
+	var queued *QueuedCommand
+
+	err = sonoffServer.PhysicalButtonOff("1")
+
+	assert.ErrorAs(t, err, &queued)
+	assert.ErrorIs(t, queued.Wait(context.Background()), ErrQueueExpired)
+	mockServer.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_OfflineQueueClosed(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockOfflineQueue(time.Minute))
+
+	assert.NoError(t, err)
+
+	disconnectMockDevice(sonoffServer, mockServer, "1")
+
+	var queued *QueuedCommand
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.ErrorAs(t, err, &queued)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+	assert.ErrorIs(t, queued.Wait(context.Background()), ErrClosed)
+}
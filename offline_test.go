@@ -0,0 +1,142 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestPendingCommands(t *testing.T) {
+	pending := newPendingCommands()
+
+	ctxOne, cancelOne := context.WithCancelCause(context.Background())
+	ctxTwo, cancelTwo := context.WithCancelCause(context.Background())
+	ctxThree, cancelThree := context.WithCancelCause(context.Background())
+
+	pending.add("1", cancelOne)
+	removeTwo := pending.add("1", cancelTwo)
+	pending.add("2", cancelThree)
+
+	removeTwo()
+
+	assert.Equal(t, 1, pending.cancel("1", ErrDeviceOffline))
+	assert.Equal(t, 0, pending.cancel("1", ErrDeviceOffline))
+
+	assert.Equal(t, ErrDeviceOffline, context.Cause(ctxOne))
+	assert.NoError(t, ctxTwo.Err())
+	assert.NoError(t, ctxThree.Err())
+}
+
+func TestSonoffBasicR2_FailFastOffline(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, sonoffServer.GetFailFastOffline())
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handlerConnected := mockServer.Calls[0].Arguments.Get(2).(mqtt.InlineSubFn)
+	handlerDisconnected := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+	handlerDisconnected(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleDisconnected())
+
+	start := time.Now()
+
+	_, err = sonoffServer.StatusEleven("1")
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+	assert.NotErrorIs(t, err, ErrTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+
+	// Unknown devices are not considered offline
+	err = sonoffServer.PowerOn("2")
+
+	assert.NoError(t, err)
+
+	mockServer.AssertNotCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), mock.Anything, mock.Anything, mock.Anything)
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("2", TasmotaCmndTopicPower), mock.Anything, mock.Anything, mock.Anything)
+
+	handlerConnected(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Payload: []byte(TasmotaTeleTopicLWTResponseOnline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleConnected())
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_SetFailFastOffline(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetFailFastOffline(false)
+
+	assert.Equal(t, false, sonoffServer.GetFailFastOffline())
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handler := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleDisconnected())
+
+	err = sonoffServer.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), mock.Anything, mock.Anything, mock.Anything)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_OfflineWhileWaiting(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(10)
+
+	fullTeleTopic := sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicLWT)
+
+	handler := mockServer.Calls[1].Arguments.Get(2).(mqtt.InlineSubFn)
+	responseChan := make(chan error, 1)
+	start := time.Now()
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	handler(nil, packets.Subscription{}, packets.Packet{TopicName: fullTeleTopic, Payload: []byte(TasmotaTeleTopicLWTResponseOffline)})
+
+	assert.Equal(t, "1", <-sonoffServer.TeleDisconnected())
+
+	err = <-responseChan
+
+	assert.ErrorIs(t, err, ErrDeviceOffline)
+	assert.NotErrorIs(t, err, ErrTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,189 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrafficRecorderHookID is the ID under which TrafficRecorder is registered on the broker.
+const TrafficRecorderHookID = "mqtt-sonoff-basic-r2-recorder"
+
+// ErrHooksNotSupported is returned by AddHook when the server of SonoffBasicR2 does not accept hooks.
+var ErrHooksNotSupported = errors.New("server does not accept hooks")
+
+// TrafficRecord is a single MQTT message captured by TrafficRecorder.
+// ClientID is the broker client that published the message ("inline" for SonoffBasicR2 itself), Will marks LWT messages.
+type TrafficRecord struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Qos      byte      `json:"qos,omitempty"`
+	Retain   bool      `json:"retain,omitempty"`
+	Will     bool      `json:"will,omitempty"`
+}
+
+// TrafficRecorder is a Mochi MQTT hook that writes all cmnd/, stat/ and tele/ traffic passing through the broker
+// to a file, one timestamped JSON object per line. Topics with a custom FullTopic are recognized by any of their levels.
+// The recording can be read with ReadTrafficRecording and fed back into SonoffBasicR2 with TrafficReplayer.
+type TrafficRecorder struct {
+	mqtt.HookBase
+	mutex sync.Mutex
+	file  *os.File
+	err   error
+}
+
+// NewTrafficRecorder creates (or truncates) the file and records the traffic into it.
+// Register it with SonoffBasicR2.AddHook or with the AddHook method of an external server.
+func NewTrafficRecorder(path string) (*TrafficRecorder, error) {
+	file, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrafficRecorder{file: file}, nil
+}
+
+// ID returns the ID of the hook.
+func (recorder *TrafficRecorder) ID() string {
+	return TrafficRecorderHookID
+}
+
+// Provides indicates which hook methods the hook implements.
+func (recorder *TrafficRecorder) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnWillSent,
+	}, []byte{b})
+}
+
+// OnPublish records the message before it is delivered, so a command is always recorded before its response.
+func (recorder *TrafficRecorder) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	recorder.record(cl, pk, false)
+
+	return pk, nil
+}
+
+// OnWillSent records the LWT of a client that disconnected without a DISCONNECT packet.
+func (recorder *TrafficRecorder) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	recorder.record(cl, pk, true)
+}
+
+// Err returns the first error that occurred while writing the file.
+// Hooks cannot report errors to the broker, so failed records are dropped and only the first error is kept.
+func (recorder *TrafficRecorder) Err() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return recorder.err
+}
+
+// Close closes the file. Messages published afterwards are not recorded.
+func (recorder *TrafficRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.file == nil {
+		return os.ErrClosed
+	}
+
+	err := recorder.file.Close()
+
+	recorder.file = nil
+
+	return err
+}
+
+// record appends the message to the file if it belongs to the Tasmota traffic.
+func (recorder *TrafficRecorder) record(cl *mqtt.Client, pk packets.Packet, will bool) {
+	if !isTasmotaTrafficTopic(pk.TopicName) {
+		return
+	}
+
+	data, err := json.Marshal(TrafficRecord{
+		Time:     time.Now(),
+		ClientID: cl.ID,
+		Topic:    pk.TopicName,
+		Payload:  string(pk.Payload),
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Will:     will,
+	})
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.file == nil {
+		return
+	}
+
+	if err == nil {
+		_, err = recorder.file.Write(append(data, '\n'))
+	}
+
+	if err != nil && recorder.err == nil {
+		recorder.err = err
+	}
+}
+
+// ReadTrafficRecording reads a file written by TrafficRecorder and returns the records in the order they were recorded.
+func ReadTrafficRecording(path string) ([]TrafficRecord, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	result := make([]TrafficRecord, 0)
+	scanner := bufio.NewScanner(file)
+
+	// Payloads like STATUS 0 are larger than the default buffer of the scanner
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var record TrafficRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+
+		result = append(result, record)
+	}
+
+	return result, scanner.Err()
+}
+
+// AddHook registers a hook (like TrafficRecorder) on the server of SonoffBasicR2.
+// It returns ErrHooksNotSupported if the server does not accept hooks.
+func (sonoffBasicR2 SonoffBasicR2) AddHook(hook mqtt.Hook) error {
+	hookAdder, ok := sonoffBasicR2.server.(mochiMQTTV2HookAdder)
+
+	if !ok {
+		return ErrHooksNotSupported
+	}
+
+	return hookAdder.AddHook(hook, nil)
+}
+
+// isTasmotaTrafficTopic reports whether the topic has a cmnd, stat or tele level.
+func isTasmotaTrafficTopic(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		switch level {
+		case TasmotaPrefixCmnd, TasmotaPrefixStat, TasmotaPrefixTele:
+			return true
+		}
+	}
+
+	return false
+}
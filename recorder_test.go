@@ -0,0 +1,127 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newPublishPacket(topic string, payload string, retain bool) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: retain, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+	}
+}
+
+func TestTrafficRecorder_Provides(t *testing.T) {
+	recorder, err := NewTrafficRecorder(filepath.Join(t.TempDir(), "traffic.jsonl"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, TrafficRecorderHookID, recorder.ID())
+	assert.Equal(t, true, recorder.Provides(mqtt.OnPublish))
+	assert.Equal(t, true, recorder.Provides(mqtt.OnWillSent))
+	assert.Equal(t, false, recorder.Provides(mqtt.OnConnect))
+	assert.NoError(t, recorder.Close())
+}
+
+func TestTrafficRecorder_Record(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recorder, err := NewTrafficRecorder(path)
+
+	assert.NoError(t, err)
+
+	device := &mqtt.Client{ID: "DVES_1"}
+	inline := &mqtt.Client{ID: mqtt.InlineClientId}
+
+	pk, err := recorder.OnPublish(device, newPublishPacket("tele/sonoff/LWT", "Online", true))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "tele/sonoff/LWT", pk.TopicName)
+
+	_, _ = recorder.OnPublish(inline, newPublishPacket("cmnd/sonoff/POWER", "ON", false))
+	_, _ = recorder.OnPublish(device, newPublishPacket("stat/sonoff/RESULT", `{"POWER":"ON"}`, false))
+	_, _ = recorder.OnPublish(device, newPublishPacket("tasmota/sonoff/tele/STATE", `{"POWER":"ON"}`, false))
+	_, _ = recorder.OnPublish(device, newPublishPacket("homeassistant/switch/sonoff/config", "{}", true))
+	_, _ = recorder.OnPublish(device, newPublishPacket("$SYS/broker/uptime", "10", false))
+
+	recorder.OnWillSent(device, newPublishPacket("tele/sonoff/LWT", "Offline", true))
+
+	assert.NoError(t, recorder.Close())
+	assert.ErrorIs(t, recorder.Close(), os.ErrClosed)
+
+	// Closed recorders drop the messages
+	_, _ = recorder.OnPublish(device, newPublishPacket("tele/sonoff/STATE", "{}", false))
+
+	assert.NoError(t, recorder.Err())
+
+	records, err := ReadTrafficRecording(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(records))
+
+	topics := make([]string, 0)
+
+	for _, record := range records {
+		topics = append(topics, record.Topic)
+
+		assert.Equal(t, false, record.Time.IsZero())
+	}
+
+	assert.Equal(t, []string{
+		"tele/sonoff/LWT",
+		"cmnd/sonoff/POWER",
+		"stat/sonoff/RESULT",
+		"tasmota/sonoff/tele/STATE",
+		"tele/sonoff/LWT",
+	}, topics)
+	assert.Equal(t, TrafficRecord{
+		Time:     records[0].Time,
+		ClientID: "DVES_1",
+		Topic:    "tele/sonoff/LWT",
+		Payload:  "Online",
+		Qos:      1,
+		Retain:   true,
+	}, records[0])
+	assert.Equal(t, mqtt.InlineClientId, records[1].ClientID)
+	assert.Equal(t, "ON", records[1].Payload)
+	assert.Equal(t, false, records[1].Will)
+	assert.Equal(t, "Offline", records[4].Payload)
+	assert.Equal(t, true, records[4].Will)
+}
+
+func TestReadTrafficRecording_Errors(t *testing.T) {
+	_, err := ReadTrafficRecording(filepath.Join(t.TempDir(), "missing.jsonl"))
+
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	path := filepath.Join(t.TempDir(), "broken.jsonl")
+
+	assert.NoError(t, os.WriteFile(path, []byte("{\n"), 0o600))
+
+	_, err = ReadTrafficRecording(path)
+
+	assert.Error(t, err)
+}
+
+func TestSonoffBasicR2_AddHook(t *testing.T) {
+	recorder, err := NewTrafficRecorder(filepath.Join(t.TempDir(), "traffic.jsonl"))
+
+	assert.NoError(t, err)
+
+	mockServer := new(MockMQTTServerWithHooks)
+	sonoffServer, err := NewSonoffBasicR2WithServer(mockServer, 0)
+
+	assert.NoError(t, err)
+	assert.NoError(t, sonoffServer.AddHook(recorder))
+	assert.Equal(t, []mqtt.Hook{sonoffServer.SessionHook(), recorder}, mockServer.hooks)
+
+	sonoffServer, err = NewSonoffBasicR2WithServer(new(MockMQTTServer), 0)
+
+	assert.NoError(t, err)
+	assert.ErrorIs(t, sonoffServer.AddHook(recorder), ErrHooksNotSupported)
+	assert.NoError(t, recorder.Close())
+}
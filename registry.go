@@ -0,0 +1,319 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeviceSession describes the MQTT session a Tasmota device holds on the broker.
+// It is filled by SessionHook, so it is only available when the hook is registered on the broker.
+type DeviceSession struct {
+	ClientID       string
+	RemoteAddr     string
+	Listener       string
+	ConnectedAt    time.Time
+	EstablishedAt  time.Time
+	DisconnectedAt time.Time
+	DisconnectErr  error
+}
+
+// DeviceState is the last known runtime state of a Tasmota device.
+// It is taken from status responses and, with telemetry tracking enabled, from tele STATE and stat POWER messages.
+type DeviceState struct {
+	Power     string
+	RSSI      int
+	Signal    int
+	Heap      int
+	UptimeSec int
+	BootCount int
+	UpdatedAt time.Time
+}
+
+// Device is a snapshot of everything the library knows about a single Tasmota device.
+// Discovery is only set for devices announced via Tasmota native discovery.
+type Device struct {
+	ID        string
+	Online    bool
+	LastSeen  time.Time
+	Session   DeviceSession
+	Discovery *DiscoveryConfig
+	State     DeviceState
+	Circuit   CircuitState
+
+	// DesiredPower is the power state last commanded by the application, when a DesiredStateStore is set.
+	DesiredPower string
+
+	// Tags are set with SetDeviceTags and used by the authorization policy.
+	Tags []string
+}
+
+// GetFullTopic builds the full topic of a command, status or telemetry message of the device.
+// Devices announced via native discovery use their own FullTopic and prefixes, all others use %prefix%/%topic%/.
+func (device Device) GetFullTopic(prefix string, topic string) string {
+	if device.Discovery != nil {
+		return device.Discovery.GetFullTopic(prefix, topic)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", prefix, device.ID, topic)
+}
+
+// IsPowerOn reports whether the last known power state of the device is ON.
+// Devices announced via native discovery report their own state texts (Tasmota StateText command), the ON text is the second one.
+func (device Device) IsPowerOn() bool {
+	return device.isPowerOnText(device.State.Power)
+}
+
+// isPowerOnText reports whether the power state reported by the device means ON.
+func (device Device) isPowerOnText(power string) bool {
+	if device.Discovery != nil && len(device.Discovery.StateTexts) >= 2 {
+		return power == device.Discovery.StateTexts[1]
+	}
+
+	return power == TasmotaCmndTopicPowerValueOn
+}
+
+// DeviceEventType identifies the kind of change reported by a DeviceEvent.
+type DeviceEventType int
+
+// Device event types
+const (
+	// DeviceEventConnected is emitted when a device reports "Online" on its LWT topic.
+	DeviceEventConnected DeviceEventType = iota + 1
+
+	// DeviceEventDisconnected is emitted when a device reports "Offline" on its LWT topic.
+	DeviceEventDisconnected
+
+	// DeviceEventSessionEstablished is emitted when the broker accepts the MQTT session of a device.
+	DeviceEventSessionEstablished
+
+	// DeviceEventSessionClosed is emitted when the broker closes the MQTT session of a device.
+	DeviceEventSessionClosed
+
+	// DeviceEventDiscovered is emitted when a device announces itself via Tasmota native discovery.
+	DeviceEventDiscovered
+
+	// DeviceEventDeregistered is emitted when a device is removed from the registry.
+	DeviceEventDeregistered
+
+	// DeviceEventStateUpdated is emitted when the runtime state (power, RSSI, heap, uptime) of a device is updated.
+	DeviceEventStateUpdated
+
+	// DeviceEventCircuitOpened is emitted when the circuit breaker of a device opens after repeated failures.
+	DeviceEventCircuitOpened
+
+	// DeviceEventCircuitHalfOpened is emitted when the circuit breaker of a device lets a probe command through after the cooldown.
+	DeviceEventCircuitHalfOpened
+
+	// DeviceEventCircuitClosed is emitted when the circuit breaker of a device closes after a successful command.
+	DeviceEventCircuitClosed
+
+	// DeviceEventPowerDrift is emitted when the power state of a reconnected device differs from the desired one.
+	DeviceEventPowerDrift
+
+	// DeviceEventFlapping is emitted when the relay of a device is switched more often than the flap protection allows.
+	DeviceEventFlapping
+)
+
+// String returns a human-readable name of the event type.
+func (eventType DeviceEventType) String() string {
+	switch eventType {
+	case DeviceEventConnected:
+		return "connected"
+	case DeviceEventDisconnected:
+		return "disconnected"
+	case DeviceEventSessionEstablished:
+		return "session_established"
+	case DeviceEventSessionClosed:
+		return "session_closed"
+	case DeviceEventDiscovered:
+		return "discovered"
+	case DeviceEventDeregistered:
+		return "deregistered"
+	case DeviceEventStateUpdated:
+		return "state_updated"
+	case DeviceEventCircuitOpened:
+		return "circuit_opened"
+	case DeviceEventCircuitHalfOpened:
+		return "circuit_half_opened"
+	case DeviceEventCircuitClosed:
+		return "circuit_closed"
+	case DeviceEventPowerDrift:
+		return "power_drift"
+	case DeviceEventFlapping:
+		return "flapping"
+	default:
+		return "unknown"
+	}
+}
+
+// DeviceEvent is a change in the device registry together with the device state right after the change.
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Time   time.Time
+	Device Device
+}
+
+// DeviceEventFn is a handler for device events.
+// Handlers are called synchronously from the MQTT broker goroutines and must not block.
+type DeviceEventFn func(event DeviceEvent)
+
+// deviceRegistry keeps track of known devices and notifies listeners about changes.
+type deviceRegistry struct {
+	mutex     sync.RWMutex
+	devices   map[string]*Device
+	listeners []DeviceEventFn
+}
+
+// newDeviceRegistry creates an empty device registry.
+func newDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{
+		devices: make(map[string]*Device),
+	}
+}
+
+// listen adds a handler that receives every subsequent device event and returns a function that removes it.
+func (registry *deviceRegistry) listen(handler DeviceEventFn) func() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	index := len(registry.listeners)
+	registry.listeners = append(registry.listeners, handler)
+
+	return func() {
+		registry.mutex.Lock()
+		defer registry.mutex.Unlock()
+
+		// The slice is copied, since events that are being emitted still iterate over the old one
+		registry.listeners = slices.Clone(registry.listeners)
+		registry.listeners[index] = nil
+	}
+}
+
+// get returns a copy of the device with the given ID.
+func (registry *deviceRegistry) get(id string) (Device, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	device, ok := registry.devices[id]
+
+	if !ok {
+		return Device{}, false
+	}
+
+	return *device, true
+}
+
+// offline reports whether the device is known to be offline, i.e. its last LWT message was "Offline".
+// Devices that never reported on their LWT topic are not considered offline.
+func (registry *deviceRegistry) offline(id string) bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	device, ok := registry.devices[id]
+
+	return ok && !device.Online && !device.LastSeen.IsZero()
+}
+
+// all returns copies of all known devices sorted by ID.
+func (registry *deviceRegistry) all() []Device {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	result := make([]Device, 0, len(registry.devices))
+
+	for _, device := range registry.devices {
+		result = append(result, *device)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// update applies the change to the device (creating it when needed) and emits an event of the given type.
+// An event type of zero updates the device silently.
+func (registry *deviceRegistry) update(id string, eventType DeviceEventType, change func(device *Device)) Device {
+	registry.mutex.Lock()
+
+	device, ok := registry.devices[id]
+
+	if !ok {
+		device = &Device{ID: id}
+		registry.devices[id] = device
+	}
+
+	change(device)
+
+	snapshot := *device
+	listeners := registry.listeners
+
+	registry.mutex.Unlock()
+
+	if eventType != 0 {
+		event := DeviceEvent{Type: eventType, Time: time.Now(), Device: snapshot}
+
+		for _, listener := range listeners {
+			if listener != nil {
+				listener(event)
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// markOnline records that the device reported "Online" on its LWT topic.
+// The client ID is taken from the origin of the LWT packet when the session hook did not see the connection.
+func (registry *deviceRegistry) markOnline(id string, clientID string) Device {
+	return registry.update(id, DeviceEventConnected, func(device *Device) {
+		device.Online = true
+		device.LastSeen = time.Now()
+
+		if device.Session.ClientID == "" {
+			device.Session.ClientID = clientID
+		}
+	})
+}
+
+// markOffline records that the device reported "Offline" on its LWT topic.
+func (registry *deviceRegistry) markOffline(id string) Device {
+	return registry.update(id, DeviceEventDisconnected, func(device *Device) {
+		device.Online = false
+		device.LastSeen = time.Now()
+	})
+}
+
+// remove deletes the device from the registry and emits DeviceEventDeregistered.
+func (registry *deviceRegistry) remove(id string) (Device, bool) {
+	registry.mutex.Lock()
+
+	device, ok := registry.devices[id]
+
+	if !ok {
+		registry.mutex.Unlock()
+
+		return Device{}, false
+	}
+
+	delete(registry.devices, id)
+
+	snapshot := *device
+	listeners := registry.listeners
+
+	registry.mutex.Unlock()
+
+	event := DeviceEvent{Type: DeviceEventDeregistered, Time: time.Now(), Device: snapshot}
+
+	for _, listener := range listeners {
+		if listener != nil {
+			listener(event)
+		}
+	}
+
+	return snapshot, true
+}
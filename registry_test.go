@@ -0,0 +1,172 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDeviceRegistry_markOnline(t *testing.T) {
+	registry := newDeviceRegistry()
+	events := make([]DeviceEvent, 0)
+
+	registry.listen(func(event DeviceEvent) {
+		events = append(events, event)
+	})
+
+	device := registry.markOnline("1", "DVES_1")
+
+	assert.Equal(t, "1", device.ID)
+	assert.Equal(t, true, device.Online)
+	assert.Equal(t, "DVES_1", device.Session.ClientID)
+	assert.Equal(t, false, device.LastSeen.IsZero())
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, DeviceEventConnected, events[0].Type)
+	assert.Equal(t, device, events[0].Device)
+}
+
+func TestDeviceRegistry_markOffline(t *testing.T) {
+	registry := newDeviceRegistry()
+	events := make([]DeviceEvent, 0)
+
+	registry.markOnline("1", "DVES_1")
+
+	registry.listen(func(event DeviceEvent) {
+		events = append(events, event)
+	})
+
+	device := registry.markOffline("1")
+
+	assert.Equal(t, false, device.Online)
+	assert.Equal(t, "DVES_1", device.Session.ClientID)
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, DeviceEventDisconnected, events[0].Type)
+}
+
+func TestDeviceRegistry_listen(t *testing.T) {
+	registry := newDeviceRegistry()
+	first := 0
+	second := 0
+
+	stop := registry.listen(func(event DeviceEvent) {
+		first++
+	})
+
+	registry.listen(func(event DeviceEvent) {
+		second++
+	})
+
+	registry.markOnline("1", "DVES_1")
+
+	stop()
+	stop()
+
+	registry.markOffline("1")
+	registry.remove("1")
+
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 3, second)
+}
+
+func TestDeviceRegistry_update(t *testing.T) {
+	registry := newDeviceRegistry()
+	events := 0
+
+	registry.listen(func(event DeviceEvent) {
+		events++
+	})
+
+	registry.update("1", 0, func(device *Device) {
+		device.Session.RemoteAddr = "127.0.0.1:1"
+	})
+
+	device, ok := registry.get("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "127.0.0.1:1", device.Session.RemoteAddr)
+	assert.Equal(t, 0, events)
+
+	_, ok = registry.get("2")
+
+	assert.Equal(t, false, ok)
+}
+
+func TestDeviceRegistry_all(t *testing.T) {
+	registry := newDeviceRegistry()
+
+	registry.markOnline("2", "")
+	registry.markOnline("1", "")
+	registry.markOffline("3")
+
+	devices := registry.all()
+
+	assert.Len(t, devices, 3)
+	assert.Equal(t, "1", devices[0].ID)
+	assert.Equal(t, "2", devices[1].ID)
+	assert.Equal(t, "3", devices[2].ID)
+}
+
+func TestDeviceEventType_String(t *testing.T) {
+	assert.Equal(t, "connected", DeviceEventConnected.String())
+	assert.Equal(t, "disconnected", DeviceEventDisconnected.String())
+	assert.Equal(t, "session_established", DeviceEventSessionEstablished.String())
+	assert.Equal(t, "session_closed", DeviceEventSessionClosed.String())
+	assert.Equal(t, "discovered", DeviceEventDiscovered.String())
+	assert.Equal(t, "deregistered", DeviceEventDeregistered.String())
+	assert.Equal(t, "state_updated", DeviceEventStateUpdated.String())
+	assert.Equal(t, "unknown", DeviceEventType(0).String())
+}
+
+func TestDeviceRegistry_remove(t *testing.T) {
+	registry := newDeviceRegistry()
+	events := make([]DeviceEvent, 0)
+
+	registry.markOnline("1", "DVES_1")
+
+	registry.listen(func(event DeviceEvent) {
+		events = append(events, event)
+	})
+
+	device, ok := registry.remove("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "1", device.ID)
+
+	_, ok = registry.remove("1")
+
+	assert.Equal(t, false, ok)
+
+	_, ok = registry.get("1")
+
+	assert.Equal(t, false, ok)
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, DeviceEventDeregistered, events[0].Type)
+	assert.Equal(t, "1", events[0].Device.ID)
+}
+
+func TestDevice_GetFullTopic(t *testing.T) {
+	device := Device{ID: "1"}
+
+	assert.Equal(t, "cmnd/1/POWER", device.GetFullTopic(TasmotaPrefixCmnd, TasmotaCmndTopicPower))
+
+	device.Discovery = &DiscoveryConfig{Topic: "1", FullTopic: "home/%topic%/%prefix%/"}
+
+	assert.Equal(t, "home/1/cmnd/POWER", device.GetFullTopic(TasmotaPrefixCmnd, TasmotaCmndTopicPower))
+}
+
+func TestDevice_IsPowerOn(t *testing.T) {
+	device := Device{ID: "1", State: DeviceState{Power: TasmotaCmndTopicPowerValueOn}}
+
+	assert.Equal(t, true, device.IsPowerOn())
+
+	// Devices announced via native discovery use their own state texts
+	device.Discovery = &DiscoveryConfig{Topic: "1", StateTexts: []string{"AUS", "AN", "UMSCHALTEN", "HALTEN"}}
+
+	assert.Equal(t, false, device.IsPowerOn())
+
+	device.State.Power = "AN"
+
+	assert.Equal(t, true, device.IsPowerOn())
+}
@@ -0,0 +1,173 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"fmt"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficReplayerFilter is the filter of the inline subscription that sees the commands published by SonoffBasicR2.
+const trafficReplayerFilter = "#"
+
+// TrafficReplayer feeds a recording of TrafficRecorder back into SonoffBasicR2 for deterministic reproduction in tests.
+// The messages of the devices (stat/, tele/ and their LWT) are published in their recorded order through the inline client
+// of the broker. A command that SonoffBasicR2 published during the recording blocks the replay until SonoffBasicR2
+// publishes the same command (topic and payload) again, so the responses never arrive before their request.
+// Commands of other clients are skipped, because only devices act on them.
+type TrafficReplayer struct {
+	server         MochiMQTTV2
+	records        []TrafficRecord
+	speed          float64
+	subscriptionId int
+	mutex          sync.Mutex
+	received       map[string]int
+	signal         chan struct{}
+}
+
+// NewTrafficReplayer creates a replayer that publishes the records on the server of SonoffBasicR2 (see SonoffBasicR2.Server).
+// It starts watching the commands right away, so commands sent before Replay is called are not missed.
+func NewTrafficReplayer(server MochiMQTTV2, records []TrafficRecord) (*TrafficReplayer, error) {
+	replayer := &TrafficReplayer{
+		server:         server,
+		records:        records,
+		subscriptionId: rand.New(rand.NewSource(time.Now().UnixNano())).Intn(math.MaxInt32),
+		received:       make(map[string]int),
+		signal:         make(chan struct{}, 1),
+	}
+
+	if err := server.Subscribe(trafficReplayerFilter, replayer.subscriptionId, replayer.receive); err != nil {
+		return nil, err
+	}
+
+	return replayer, nil
+}
+
+// GetSpeed returns the speed of the replay relative to the recording.
+func (replayer *TrafficReplayer) GetSpeed() float64 {
+	return replayer.speed
+}
+
+// SetSpeed sets the speed of the replay relative to the recording, e.g. 1 keeps the recorded delays between the messages
+// and 10 replays ten times faster. Zero (default) publishes the messages without delays, only waiting for the commands.
+func (replayer *TrafficReplayer) SetSpeed(value float64) {
+	replayer.speed = value
+}
+
+// Replay publishes the recording and returns when all records are replayed.
+// It returns an error if a recorded command is not published by SonoffBasicR2 before the context is done.
+// SonoffBasicR2 must be serving, so its subscriptions receive the replayed messages.
+func (replayer *TrafficReplayer) Replay(ctx context.Context) error {
+	for index, record := range replayer.records {
+		if index > 0 && replayer.speed > 0 {
+			delay := time.Duration(float64(record.Time.Sub(replayer.records[index-1].Time)) / replayer.speed)
+
+			if err := sleepContext(ctx, delay); err != nil {
+				return fmt.Errorf("replay record %d: %w", index, err)
+			}
+		}
+
+		if isTasmotaCommandTopic(record.Topic) {
+			if record.ClientID != mqtt.InlineClientId {
+				continue
+			}
+
+			if err := replayer.wait(ctx, record); err != nil {
+				return fmt.Errorf("replay record %d: waiting for %s %q: %w", index, record.Topic, record.Payload, err)
+			}
+
+			continue
+		}
+
+		if err := replayer.server.Publish(record.Topic, []byte(record.Payload), record.Retain, record.Qos); err != nil {
+			return fmt.Errorf("replay record %d: %w", index, err)
+		}
+	}
+
+	return nil
+}
+
+// Close stops watching the commands published by SonoffBasicR2.
+func (replayer *TrafficReplayer) Close() error {
+	return replayer.server.Unsubscribe(trafficReplayerFilter, replayer.subscriptionId)
+}
+
+// receive counts the commands published by SonoffBasicR2. It runs synchronously in the publisher, so it must not block.
+func (replayer *TrafficReplayer) receive(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	if !isTasmotaCommandTopic(pk.TopicName) {
+		return
+	}
+
+	replayer.mutex.Lock()
+	replayer.received[getTrafficKey(pk.TopicName, string(pk.Payload))]++
+	replayer.mutex.Unlock()
+
+	select {
+	case replayer.signal <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until SonoffBasicR2 published the recorded command. Commands published in a different order are kept,
+// so concurrent commands match their records regardless of the order in which they were sent.
+func (replayer *TrafficReplayer) wait(ctx context.Context, record TrafficRecord) error {
+	key := getTrafficKey(record.Topic, record.Payload)
+
+	for !replayer.take(key) {
+		select {
+		case <-replayer.signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// take consumes a received command with the key.
+func (replayer *TrafficReplayer) take(key string) bool {
+	replayer.mutex.Lock()
+	defer replayer.mutex.Unlock()
+
+	if replayer.received[key] == 0 {
+		return false
+	}
+
+	replayer.received[key]--
+
+	return true
+}
+
+// getTrafficKey identifies a command by its topic and its payload.
+func getTrafficKey(topic string, payload string) string {
+	return topic + "\x00" + payload
+}
+
+// isTasmotaCommandTopic reports whether the topic has a cmnd level.
+func isTasmotaCommandTopic(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		if level == TasmotaPrefixCmnd {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sleepContext waits for the delay or until the context is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
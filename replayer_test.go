@@ -0,0 +1,109 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newReplaySonoffBasicR2(t *testing.T) (*SonoffBasicR2, *mqtt.Server) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	sonoffServer, err := NewSonoffBasicR2WithServer(server, 0)
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(MockCtxCmndResponseTimeoutInSeconds)
+
+	assert.NoError(t, sonoffServer.Serve())
+
+	return sonoffServer, server
+}
+
+func receiveReplayedID(t *testing.T, channel <-chan string) string {
+	select {
+	case id := <-channel:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device reported")
+
+		return ""
+	}
+}
+
+func TestTrafficReplayer_Replay(t *testing.T) {
+	sonoffServer, server := newReplaySonoffBasicR2(t)
+	start := time.Now()
+
+	records := []TrafficRecord{
+		{Time: start, ClientID: "DVES_1", Topic: "tele/porch/LWT", Payload: "Online", Retain: true},
+		{Time: start.Add(time.Second), ClientID: mqtt.InlineClientId, Topic: "cmnd/porch/STATUS", Payload: "11"},
+		{Time: start.Add(time.Second), ClientID: "DVES_1", Topic: "stat/porch/STATUS11", Payload: `{"StatusSTS":{"POWER":"OFF","Wifi":{"RSSI":64}}}`},
+		{Time: start.Add(2 * time.Second), ClientID: "dashboard", Topic: "cmnd/porch/POWER", Payload: "TOGGLE"},
+		{Time: start.Add(3 * time.Second), ClientID: mqtt.InlineClientId, Topic: "cmnd/porch/POWER", Payload: "ON"},
+		{Time: start.Add(3 * time.Second), ClientID: "DVES_1", Topic: "stat/porch/RESULT", Payload: `{"POWER":"ON"}`},
+		{Time: start.Add(4 * time.Second), ClientID: "DVES_1", Topic: "tele/porch/LWT", Payload: "Offline", Retain: true, Will: true},
+	}
+
+	replayer, err := NewTrafficReplayer(server, records)
+
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), replayer.GetSpeed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- replayer.Replay(ctx)
+	}()
+
+	assert.Equal(t, "porch", receiveReplayedID(t, sonoffServer.TeleConnected()))
+
+	statusEleven, err := sonoffServer.StatusEleven("porch")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 64, statusEleven.Wifi.RSSI)
+	assert.Equal(t, TasmotaCmndTopicPowerValueOff, statusEleven.POWER)
+
+	// The command of the dashboard is skipped, the replay waits for the command of SonoffBasicR2
+	assert.NoError(t, sonoffServer.PowerOn("porch"))
+	assert.Equal(t, "porch", receiveReplayedID(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, <-result)
+
+	assert.NoError(t, replayer.Close())
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestTrafficReplayer_MissingCommand(t *testing.T) {
+	sonoffServer, server := newReplaySonoffBasicR2(t)
+	start := time.Now()
+
+	records := []TrafficRecord{
+		{Time: start, ClientID: "DVES_1", Topic: "tele/porch/LWT", Payload: "Online", Retain: true},
+		{Time: start.Add(100 * time.Millisecond), ClientID: mqtt.InlineClientId, Topic: "cmnd/porch/POWER", Payload: "OFF"},
+	}
+
+	replayer, err := NewTrafficReplayer(server, records)
+
+	assert.NoError(t, err)
+
+	// The recorded delays are kept at speed 1
+	replayer.SetSpeed(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	err = replayer.Replay(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, `cmnd/porch/POWER "OFF"`)
+	assert.GreaterOrEqual(t, time.Since(begin), 100*time.Millisecond)
+	assert.Equal(t, "porch", receiveReplayedID(t, sonoffServer.TeleConnected()))
+
+	assert.NoError(t, replayer.Close())
+	assert.NoError(t, sonoffServer.Close())
+}
@@ -0,0 +1,177 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how often and how fast a command is repeated when it fails.
+// The zero value sends every command once.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Values below 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the second attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+
+	// Multiplier grows the wait after every attempt. Values below 1 keep the wait constant.
+	Multiplier float64
+
+	// Jitter randomizes the wait by up to the given fraction (0.2 means ±20%), so devices are not hit in lockstep.
+	Jitter float64
+
+	// RetryIf decides whether a failed attempt is repeated. When nil, only timeouts (ErrTimeout) are retried.
+	RetryIf func(err error) bool
+}
+
+// NoRetry is the default policy: every command is sent once.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryPolicy returns a policy suited for devices on weak WiFi:
+// up to 3 attempts with an exponential backoff from 500ms to 5s and 20% jitter, retrying timeouts only.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// ShouldRetry reports whether the failed attempt is repeated according to RetryIf.
+func (policy RetryPolicy) ShouldRetry(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if policy.RetryIf != nil {
+		return policy.RetryIf(err)
+	}
+
+	return errors.Is(err, ErrTimeout)
+}
+
+// Backoff returns the wait after the given failed attempt (starting with 1), without jitter.
+func (policy RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(policy.InitialBackoff)
+
+	if policy.Multiplier > 1 && attempt > 1 {
+		backoff *= math.Pow(policy.Multiplier, float64(attempt-1))
+	}
+
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	return time.Duration(backoff)
+}
+
+// jitter randomizes the backoff by up to the Jitter fraction of the policy.
+func (policy RetryPolicy) jitter(backoff time.Duration) time.Duration {
+	if policy.Jitter <= 0 || backoff <= 0 {
+		return backoff
+	}
+
+	return time.Duration(float64(backoff) * (1 + policy.Jitter*(2*rand.Float64()-1)))
+}
+
+// retryPolicyKey is the context key of the per-call retry policy.
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a context that makes commands use the given retry policy instead of the default one.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+// GetRetryPolicy returns the default retry policy of the commands.
+func (sonoffBasicR2 SonoffBasicR2) GetRetryPolicy() RetryPolicy {
+	return sonoffBasicR2.getSettings().retryPolicy
+}
+
+// SetRetryPolicy sets the default retry policy of the commands. It can be overridden per call with WithRetryPolicy.
+// PowerToggle is never retried, since a missing confirmation does not mean that the toggle was not applied.
+func (sonoffBasicR2 *SonoffBasicR2) SetRetryPolicy(value RetryPolicy) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.retryPolicy = value
+	})
+}
+
+// getRetryPolicy returns the retry policy from the context or the default one.
+func (sonoffBasicR2 SonoffBasicR2) getRetryPolicy(ctx context.Context) RetryPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		return policy
+	}
+
+	return sonoffBasicR2.getSettings().retryPolicy
+}
+
+// retry runs the attempt until it succeeds, the policy gives up or the context is done.
+// The command is rejected right away (and audited) when the circuit breaker of the device is open, and its outcome is counted by the breaker.
+func (sonoffBasicR2 SonoffBasicR2) retry(ctx context.Context, policy RetryPolicy, id string, command string, payload string, attempt func(ctx context.Context) error) error {
+	if err := sonoffBasicR2.allowCircuit(id, command); err != nil {
+		setSpanOutcome(trace.SpanFromContext(ctx), TraceOutcomeCircuitOpen)
+
+		sonoffBasicR2.audit(ctx, id, command, payload, "", 0, err)
+
+		return err
+	}
+
+	err := sonoffBasicR2.retryAttempts(ctx, policy, id, command, attempt)
+
+	sonoffBasicR2.recordCircuit(id, err)
+
+	return err
+}
+
+// retryAttempts repeats the attempt according to the policy.
+// The number of attempts is stored in the returned *CommandError and on the command span.
+func (sonoffBasicR2 SonoffBasicR2) retryAttempts(ctx context.Context, policy RetryPolicy, id string, command string, attempt func(ctx context.Context) error) error {
+	span := trace.SpanFromContext(ctx)
+
+	for n := 1; ; n++ {
+		err := attempt(ctx)
+
+		if err == nil || n >= policy.MaxAttempts || !policy.ShouldRetry(err) {
+			span.SetAttributes(attribute.Int(TraceAttributeAttempts, n))
+
+			var commandError *CommandError
+
+			if errors.As(err, &commandError) {
+				commandError.Attempts = n
+			}
+
+			return err
+		}
+
+		backoff := policy.jitter(policy.Backoff(n))
+
+		sonoffBasicR2.observeCommandRetried(id, command, n, err)
+
+		sonoffBasicR2.logger().Info("retrying command", LogKeyDevice, id, LogKeyCommand, command, LogKeyAttempt, n, LogKeyDuration, backoff, LogKeyError, err)
+
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int(TraceAttributeAttempts, n)))
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+
+			return &CommandError{DeviceID: id, Command: command, Attempts: n, Err: ctx.Err()}
+		case <-sonoffBasicR2.mainContext.Done():
+			timer.Stop()
+
+			return &CommandError{DeviceID: id, Command: command, Attempts: n, Err: ErrClosed}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"errors"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond, Multiplier: 2}
+
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 300*time.Millisecond, policy.Backoff(3))
+
+	policy.Multiplier = 0
+
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(3))
+}
+
+func TestRetryPolicy_Jitter(t *testing.T) {
+	policy := RetryPolicy{Jitter: 0.2}
+
+	for i := 0; i < 100; i++ {
+		backoff := policy.jitter(time.Second)
+
+		assert.GreaterOrEqual(t, backoff, 800*time.Millisecond)
+		assert.LessOrEqual(t, backoff, 1200*time.Millisecond)
+	}
+
+	assert.Equal(t, time.Second, RetryPolicy{}.jitter(time.Second))
+}
+
+func TestRetryPolicy_ShouldRetry(t *testing.T) {
+	policy := DefaultRetryPolicy()
+
+	assert.Equal(t, false, policy.ShouldRetry(nil))
+	assert.Equal(t, true, policy.ShouldRetry(newCommandError("1", "STATUS11", ErrTimeout)))
+	assert.Equal(t, false, policy.ShouldRetry(newCommandError("1", "STATUS11", ErrDeviceOffline)))
+
+	policy.RetryIf = func(err error) bool {
+		return errors.Is(err, ErrPublishFailed)
+	}
+
+	assert.Equal(t, false, policy.ShouldRetry(newCommandError("1", "STATUS11", ErrTimeout)))
+	assert.Equal(t, true, policy.ShouldRetry(newPublishError("1", "POWER", assert.AnError)))
+}
+
+func TestSonoffBasicR2_RetryPolicy(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Equal(t, RetryPolicy{}, sonoffServer.GetRetryPolicy())
+
+	observer := new(MockObserver)
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond}
+
+	sonoffServer.SetObserver(observer)
+	sonoffServer.SetRetryPolicy(policy)
+
+	assert.Equal(t, policy.MaxAttempts, sonoffServer.GetRetryPolicy().MaxAttempts)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	// The first attempt is not answered and times out
+	<-mockServer.subscribeChan
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"StatusSTS":{"POWER":"ON"}}`)})
+
+	assert.NoError(t, <-responseChan)
+
+	observer.mutex.Lock()
+
+	assert.Equal(t, []string{"1/STATUS11"}, observer.retried)
+	assert.Equal(t, []string{"1/STATUS11"}, observer.timedOut)
+
+	observer.mutex.Unlock()
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_WithRetryPolicy(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockPublishError())
+
+	assert.NoError(t, err)
+
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{
+		MaxAttempts: 3,
+		RetryIf: func(err error) bool {
+			return errors.Is(err, ErrPublishFailed)
+		},
+	})
+
+	err = sonoffServer.PowerOnContext(ctx, "1")
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, ErrPublishFailed)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, 3, commandError.Attempts)
+	assert.Equal(t, "1 POWER (3 attempts): publish failed: "+assert.AnError.Error(), err.Error())
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 3)
+
+	// A toggle is never repeated
+	err = sonoffServer.PowerToggleContext(ctx, "1")
+
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, 1, commandError.Attempts)
+
+	mockServer.AssertNumberOfCalls(t, "Publish", 4)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_RetryCanceled(t *testing.T) {
+	sonoffServer, _, err := NewMockMQTTServer(WithMockPublishError())
+
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel()
+
+	ctx = WithRetryPolicy(ctx, RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Hour,
+		RetryIf: func(err error) bool {
+			return true
+		},
+	})
+
+	err = sonoffServer.PhysicalButtonOnContext(ctx, "1")
+
+	var commandError *CommandError
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorAs(t, err, &commandError)
+	assert.Equal(t, 1, commandError.Attempts)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_PowerConfirmation(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, sonoffServer.GetPowerConfirmation())
+
+	sonoffServer.SetPowerConfirmation(true)
+
+	assert.Equal(t, true, sonoffServer.GetPowerConfirmation())
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		responseChan <- sonoffServer.PowerOn("1")
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"POWER":"ON"}`)})
+
+	assert.NoError(t, <-responseChan)
+
+	mockServer.AssertCalled(t, "Subscribe", sonoffServer.getFullStatTopic("1", TasmotaStatTopicResult), mock.Anything, mock.Anything)
+	mockServer.AssertCalled(t, "Publish", sonoffServer.getFullCmndTopic("1", TasmotaCmndTopicPower), []byte(TasmotaCmndTopicPowerValueOn), false, byte(1))
+
+	device, ok := sonoffServer.Device("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "ON", device.State.Power)
+
+	go func() {
+		responseChan <- sonoffServer.PowerOff("1")
+	}()
+
+	handler = <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"SetOption73":"OFF"}`)})
+
+	assert.ErrorIs(t, <-responseChan, ErrUnexpectedPayload)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,222 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"bytes"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionHookID is the ID under which SessionHook is registered on the broker.
+const SessionHookID = "mqtt-sonoff-basic-r2-session"
+
+// sessionHookClient links a broker client to the Tasmota device it belongs to.
+type sessionHookClient struct {
+	id     string
+	client *mqtt.Client
+}
+
+// sessionHookPending is a client with a will topic that does not belong to a known device yet.
+type sessionHookPending struct {
+	willTopic string
+	client    *mqtt.Client
+	session   DeviceSession
+}
+
+// SessionHook is a Mochi MQTT hook that tracks the TCP sessions of Tasmota devices.
+// Devices are recognized by their will topic (tele/<id>/LWT), which Tasmota always sets when connecting.
+// Devices with a custom topic layout are recognized once native discovery announced their LWT topic; a session that
+// started before the announcement is kept and assigned to the device when the announcement arrives.
+// The session details are stored in the device registry and are reported with device events.
+type SessionHook struct {
+	mqtt.HookBase
+	registry *deviceRegistry
+	mutex    sync.Mutex
+	clients  map[string]sessionHookClient
+	pending  map[string]sessionHookPending
+}
+
+// newSessionHook creates a session hook that writes into the given registry.
+func newSessionHook(registry *deviceRegistry) *SessionHook {
+	return &SessionHook{
+		registry: registry,
+		clients:  make(map[string]sessionHookClient),
+		pending:  make(map[string]sessionHookPending),
+	}
+}
+
+// ID returns the ID of the hook.
+func (hook *SessionHook) ID() string {
+	return SessionHookID
+}
+
+// Provides indicates which hook methods the hook implements.
+func (hook *SessionHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// OnConnect maps the broker client ID to the Tasmota topic and records the start of the session.
+func (hook *SessionHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if !pk.Connect.WillFlag {
+		return nil
+	}
+
+	session := DeviceSession{
+		ClientID:    cl.ID,
+		RemoteAddr:  cl.Net.Remote,
+		Listener:    cl.Net.Listener,
+		ConnectedAt: time.Now(),
+	}
+
+	id, ok := hook.resolve(pk.Connect.WillTopic)
+
+	hook.mutex.Lock()
+
+	if !ok {
+		// The will topic may belong to a device with a custom topic layout that is not announced yet
+		hook.pending[cl.ID] = sessionHookPending{willTopic: pk.Connect.WillTopic, client: cl, session: session}
+		delete(hook.clients, cl.ID)
+		hook.mutex.Unlock()
+
+		return nil
+	}
+
+	hook.clients[cl.ID] = sessionHookClient{id: id, client: cl}
+	delete(hook.pending, cl.ID)
+	hook.mutex.Unlock()
+
+	hook.registry.update(id, 0, func(device *Device) {
+		device.Session = session
+	})
+
+	return nil
+}
+
+// OnSessionEstablished records the moment the broker accepted the session of a Tasmota device.
+func (hook *SessionHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	id, ok := hook.lookup(cl)
+
+	if !ok {
+		hook.establishPending(cl)
+
+		return
+	}
+
+	hook.registry.update(id, DeviceEventSessionEstablished, func(device *Device) {
+		device.Session.EstablishedAt = time.Now()
+	})
+}
+
+// OnDisconnect records the end of the session of a Tasmota device.
+// Disconnects of sessions that were already taken over by a newer connection are ignored.
+func (hook *SessionHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	id, ok := hook.lookup(cl)
+
+	if !ok {
+		hook.mutex.Lock()
+
+		if entry, ok := hook.pending[cl.ID]; ok && entry.client == cl {
+			delete(hook.pending, cl.ID)
+		}
+
+		hook.mutex.Unlock()
+
+		return
+	}
+
+	hook.mutex.Lock()
+	delete(hook.clients, cl.ID)
+	hook.mutex.Unlock()
+
+	hook.registry.update(id, DeviceEventSessionClosed, func(device *Device) {
+		device.Session.DisconnectedAt = time.Now()
+		device.Session.DisconnectErr = err
+	})
+}
+
+// lookup returns the Tasmota topic of the client if the client is the current session of a device.
+func (hook *SessionHook) lookup(cl *mqtt.Client) (string, bool) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	entry, ok := hook.clients[cl.ID]
+
+	if !ok || entry.client != cl {
+		return "", false
+	}
+
+	return entry.id, true
+}
+
+// resolve returns the ID of the device with the will topic. Devices announced via native discovery are matched by
+// their LWT topic, which covers custom topic layouts, all other devices by the tele/<id>/LWT format.
+func (hook *SessionHook) resolve(willTopic string) (string, bool) {
+	for _, device := range hook.registry.all() {
+		if device.Discovery != nil && device.Discovery.GetFullTopic(TasmotaPrefixTele, TasmotaTeleTopicLWT) == willTopic {
+			return device.ID, true
+		}
+	}
+
+	return parseTeleLWTTopic(willTopic)
+}
+
+// establishPending records the moment the broker accepted a session that does not belong to a known device yet.
+func (hook *SessionHook) establishPending(cl *mqtt.Client) {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	if entry, ok := hook.pending[cl.ID]; ok && entry.client == cl {
+		entry.session.EstablishedAt = time.Now()
+		hook.pending[cl.ID] = entry
+	}
+}
+
+// announce assigns the sessions with the LWT topic of a device announced via native discovery to that device.
+func (hook *SessionHook) announce(id string, topicTeleLWT string) {
+	hook.mutex.Lock()
+
+	sessions := make([]DeviceSession, 0)
+
+	for clientID, entry := range hook.pending {
+		if entry.willTopic != topicTeleLWT {
+			continue
+		}
+
+		delete(hook.pending, clientID)
+
+		hook.clients[clientID] = sessionHookClient{id: id, client: entry.client}
+		sessions = append(sessions, entry.session)
+	}
+
+	hook.mutex.Unlock()
+
+	for _, session := range sessions {
+		var eventType DeviceEventType
+
+		if !session.EstablishedAt.IsZero() {
+			eventType = DeviceEventSessionEstablished
+		}
+
+		hook.registry.update(id, eventType, func(device *Device) {
+			device.Session = session
+		})
+	}
+}
+
+// parseTeleLWTTopic extracts the device ID from a topic in the tele/<id>/LWT format.
+// Custom topic layouts cannot be parsed, they are resolved through native discovery (see SessionHook.resolve).
+func parseTeleLWTTopic(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+
+	if len(parts) != 3 || parts[0] != TasmotaPrefixTele || parts[2] != TasmotaTeleTopicLWT || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
@@ -0,0 +1,188 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"errors"
+	"fmt"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTasmotaConnectPacket(id string) packets.Packet {
+	pk := packets.Packet{}
+	pk.Connect.WillFlag = true
+	pk.Connect.WillTopic = fmt.Sprintf("%s/%s/%s", TasmotaPrefixTele, id, TasmotaTeleTopicLWT)
+	pk.Connect.WillPayload = []byte(TasmotaTeleTopicLWTResponseOffline)
+
+	return pk
+}
+
+func TestSessionHook_Provides(t *testing.T) {
+	hook := newSessionHook(newDeviceRegistry())
+
+	assert.Equal(t, SessionHookID, hook.ID())
+	assert.Equal(t, true, hook.Provides(mqtt.OnConnect))
+	assert.Equal(t, true, hook.Provides(mqtt.OnSessionEstablished))
+	assert.Equal(t, true, hook.Provides(mqtt.OnDisconnect))
+	assert.Equal(t, false, hook.Provides(mqtt.OnPublish))
+}
+
+func TestSessionHook_Lifecycle(t *testing.T) {
+	registry := newDeviceRegistry()
+	hook := newSessionHook(registry)
+	events := make([]DeviceEventType, 0)
+
+	registry.listen(func(event DeviceEvent) {
+		events = append(events, event.Type)
+	})
+
+	cl := &mqtt.Client{ID: "DVES_1"}
+	cl.Net.Remote = "192.168.1.10:51234"
+	cl.Net.Listener = "t1"
+
+	assert.NoError(t, hook.OnConnect(cl, newTasmotaConnectPacket("sonoff")))
+
+	device, ok := registry.get("sonoff")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "DVES_1", device.Session.ClientID)
+	assert.Equal(t, "192.168.1.10:51234", device.Session.RemoteAddr)
+	assert.Equal(t, "t1", device.Session.Listener)
+	assert.Equal(t, false, device.Session.ConnectedAt.IsZero())
+
+	hook.OnSessionEstablished(cl, packets.Packet{})
+
+	device, _ = registry.get("sonoff")
+
+	assert.Equal(t, false, device.Session.EstablishedAt.IsZero())
+
+	disconnectErr := errors.New("EOF")
+
+	hook.OnDisconnect(cl, disconnectErr, true)
+
+	device, _ = registry.get("sonoff")
+
+	assert.Equal(t, false, device.Session.DisconnectedAt.IsZero())
+	assert.Equal(t, disconnectErr, device.Session.DisconnectErr)
+	assert.Equal(t, []DeviceEventType{DeviceEventSessionEstablished, DeviceEventSessionClosed}, events)
+}
+
+func TestSessionHook_IgnoresOtherClients(t *testing.T) {
+	registry := newDeviceRegistry()
+	hook := newSessionHook(registry)
+
+	cl := &mqtt.Client{ID: "dashboard"}
+
+	assert.NoError(t, hook.OnConnect(cl, packets.Packet{}))
+
+	pk := packets.Packet{}
+	pk.Connect.WillFlag = true
+	pk.Connect.WillTopic = "home/dashboard/status"
+
+	assert.NoError(t, hook.OnConnect(cl, pk))
+
+	hook.OnSessionEstablished(cl, packets.Packet{})
+	hook.OnDisconnect(cl, nil, true)
+
+	assert.Len(t, registry.all(), 0)
+}
+
+func TestSessionHook_IgnoresTakenOverSession(t *testing.T) {
+	registry := newDeviceRegistry()
+	hook := newSessionHook(registry)
+
+	oldClient := &mqtt.Client{ID: "DVES_1"}
+	newClient := &mqtt.Client{ID: "DVES_1"}
+
+	assert.NoError(t, hook.OnConnect(oldClient, newTasmotaConnectPacket("sonoff")))
+	assert.NoError(t, hook.OnConnect(newClient, newTasmotaConnectPacket("sonoff")))
+
+	hook.OnDisconnect(oldClient, nil, false)
+
+	device, _ := registry.get("sonoff")
+
+	assert.Equal(t, true, device.Session.DisconnectedAt.IsZero())
+}
+
+func TestParseTeleLWTTopic(t *testing.T) {
+	id, ok := parseTeleLWTTopic("tele/sonoff/LWT")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "sonoff", id)
+
+	_, ok = parseTeleLWTTopic("tele//LWT")
+
+	assert.Equal(t, false, ok)
+
+	_, ok = parseTeleLWTTopic("stat/sonoff/LWT")
+
+	assert.Equal(t, false, ok)
+
+	_, ok = parseTeleLWTTopic("tele/sonoff/STATE")
+
+	assert.Equal(t, false, ok)
+}
+
+func TestSessionHook_CustomLayout(t *testing.T) {
+	registry := newDeviceRegistry()
+	hook := newSessionHook(registry)
+	events := make([]DeviceEventType, 0)
+
+	registry.listen(func(event DeviceEvent) {
+		events = append(events, event.Type)
+	})
+
+	pk := newTasmotaConnectPacket("sonoff")
+	pk.Connect.WillTopic = "home/kitchen/tele/LWT"
+
+	cl := &mqtt.Client{ID: "DVES_1"}
+
+	// The device connects before it is announced via native discovery
+	assert.NoError(t, hook.OnConnect(cl, pk))
+
+	hook.OnSessionEstablished(cl, packets.Packet{})
+
+	_, ok := registry.get("kitchen")
+
+	assert.Equal(t, false, ok)
+
+	config := &DiscoveryConfig{Topic: "kitchen", FullTopic: "home/%topic%/%prefix%/"}
+
+	registry.update("kitchen", 0, func(device *Device) {
+		device.Discovery = config
+	})
+
+	hook.announce("kitchen", config.GetFullTopic(TasmotaPrefixTele, TasmotaTeleTopicLWT))
+
+	device, _ := registry.get("kitchen")
+
+	assert.Equal(t, "DVES_1", device.Session.ClientID)
+	assert.Equal(t, false, device.Session.ConnectedAt.IsZero())
+	assert.Equal(t, false, device.Session.EstablishedAt.IsZero())
+
+	hook.OnDisconnect(cl, nil, false)
+
+	// Once announced, the device is recognized when it connects again
+	reconnected := &mqtt.Client{ID: "DVES_1"}
+
+	assert.NoError(t, hook.OnConnect(reconnected, pk))
+
+	hook.OnSessionEstablished(reconnected, packets.Packet{})
+
+	device, _ = registry.get("kitchen")
+
+	assert.Equal(t, true, device.Session.DisconnectedAt.IsZero())
+	assert.Equal(t, []DeviceEventType{DeviceEventSessionEstablished, DeviceEventSessionClosed, DeviceEventSessionEstablished}, events)
+
+	// Clients with unknown will topics are forgotten when they disconnect
+	other := &mqtt.Client{ID: "other"}
+
+	pk.Connect.WillTopic = "clients/other/status"
+
+	assert.NoError(t, hook.OnConnect(other, pk))
+
+	hook.OnDisconnect(other, nil, false)
+
+	assert.Empty(t, hook.pending)
+}
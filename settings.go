@@ -0,0 +1,69 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// settings is the configuration of SonoffBasicR2 changed by its Set methods.
+type settings struct {
+	ctxCmndResponseTimeoutInSeconds uint
+	discoveryOnServe                bool
+	nativeDiscovery                 bool
+	telemetryTracking               bool
+	observer                        Observer
+	tracerProvider                  trace.TracerProvider
+	log                             *slog.Logger
+	failFastOffline                 bool
+	retryPolicy                     RetryPolicy
+	powerConfirmation               bool
+	circuitBreakerPolicy            CircuitBreakerPolicy
+	offlineQueueTTL                 time.Duration
+	desiredStateStore               DesiredStateStore
+	flapProtection                  FlapProtectionPolicy
+	auditSink                       AuditSink
+	authorizationPolicy             AuthorizationPolicy
+	interceptors                    []CommandInterceptor
+	dryRun                          bool
+}
+
+// sharedSettings keeps the settings behind a pointer that every copy of SonoffBasicR2 shares.
+// Serve hands copies of SonoffBasicR2 to the broker handlers, so a setting changed later must still reach them,
+// and the mutex keeps the change from racing with the commands that are running.
+type sharedSettings struct {
+	mutex sync.RWMutex
+	value settings
+}
+
+// newSharedSettings creates the default settings.
+func newSharedSettings() *sharedSettings {
+	return &sharedSettings{
+		value: settings{
+			ctxCmndResponseTimeoutInSeconds: DefaultCtxCmndResponseTimeoutInSeconds,
+			failFastOffline:                 true,
+		},
+	}
+}
+
+// load returns a copy of the current settings.
+func (shared *sharedSettings) load() settings {
+	shared.mutex.RLock()
+	defer shared.mutex.RUnlock()
+
+	return shared.value
+}
+
+// update applies the change to the settings.
+func (shared *sharedSettings) update(change func(value *settings)) {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	change(&shared.value)
+}
+
+// getSettings returns a copy of the current settings.
+func (sonoffBasicR2 SonoffBasicR2) getSettings() settings {
+	return sonoffBasicR2.settings.load()
+}
@@ -0,0 +1,188 @@
+// Package sonoffprom exposes Prometheus metrics about the devices and the command traffic of SonoffBasicR2.
+// Device gauges are read from the device registry on every scrape, command metrics are collected as a sonoff.Observer.
+package sonoffprom
+
+import (
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// DefaultNamespace is the namespace of all metrics.
+const DefaultNamespace = "sonoff"
+
+// Collector is a Prometheus collector for the devices and the command traffic of a SonoffBasicR2.
+type Collector struct {
+	sonoffBasicR2 *sonoff.SonoffBasicR2
+
+	online    *prometheus.Desc
+	power     *prometheus.Desc
+	rssi      *prometheus.Desc
+	heap      *prometheus.Desc
+	uptime    *prometheus.Desc
+	bootCount *prometheus.Desc
+
+	commands        *prometheus.CounterVec
+	timeouts        *prometheus.CounterVec
+	retries         *prometheus.CounterVec
+	decodeErrors    *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+}
+
+// NewCollector creates a collector for the given SonoffBasicR2 with metrics in the default namespace.
+func NewCollector(sonoffBasicR2 *sonoff.SonoffBasicR2) *Collector {
+	return NewCollectorWithNamespace(sonoffBasicR2, DefaultNamespace)
+}
+
+// NewCollectorWithNamespace creates a collector for the given SonoffBasicR2 with metrics in the given namespace.
+func NewCollectorWithNamespace(sonoffBasicR2 *sonoff.SonoffBasicR2, namespace string) *Collector {
+	deviceLabels := []string{"device"}
+
+	return &Collector{
+		sonoffBasicR2: sonoffBasicR2,
+
+		online:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "online"), "Whether the device is online (1) or offline (0) according to its LWT.", deviceLabels, nil),
+		power:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "power"), "Whether the relay of the device is on (1) or off (0).", deviceLabels, nil),
+		rssi:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "wifi_rssi_percent"), "WiFi signal quality reported by the device.", deviceLabels, nil),
+		heap:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "heap_kilobytes"), "Free heap reported by the device.", deviceLabels, nil),
+		uptime:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "uptime_seconds"), "Uptime reported by the device.", deviceLabels, nil),
+		bootCount: prometheus.NewDesc(prometheus.BuildFQName(namespace, "device", "boot_count"), "Boot count reported by the device.", deviceLabels, nil),
+
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Number of commands sent to devices, by result.",
+		}, []string{"device", "command", "result"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "command_timeouts_total",
+			Help:      "Number of commands a device did not answer within the response timeout.",
+		}, []string{"device", "command"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "command_retries_total",
+			Help:      "Number of failed command attempts that were repeated according to the retry policy.",
+		}, []string{"device", "command"}),
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decode_errors_total",
+			Help:      "Number of device responses that could not be decoded.",
+		}, []string{"device", "command"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Duration of commands, including the wait for the response of the device.",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"command"}),
+	}
+}
+
+// Register registers the collector on the given registerer and sets it as the observer of the SonoffBasicR2.
+// It can be called before or after Serve; commands sent before the registration are not counted.
+func (collector *Collector) Register(registerer prometheus.Registerer) error {
+	if err := registerer.Register(collector); err != nil {
+		return err
+	}
+
+	collector.sonoffBasicR2.SetObserver(collector)
+
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (collector *Collector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.online
+	descs <- collector.power
+	descs <- collector.rssi
+	descs <- collector.heap
+	descs <- collector.uptime
+	descs <- collector.bootCount
+
+	collector.commands.Describe(descs)
+	collector.timeouts.Describe(descs)
+	collector.retries.Describe(descs)
+	collector.decodeErrors.Describe(descs)
+	collector.commandDuration.Describe(descs)
+}
+
+// Collect implements prometheus.Collector.
+// Values that the device has not reported yet are left out instead of being exported as zero.
+func (collector *Collector) Collect(metrics chan<- prometheus.Metric) {
+	for _, device := range collector.sonoffBasicR2.Devices() {
+		metrics <- prometheus.MustNewConstMetric(collector.online, prometheus.GaugeValue, boolToFloat(device.Online), device.ID)
+
+		if device.State.Power != "" {
+			metrics <- prometheus.MustNewConstMetric(collector.power, prometheus.GaugeValue, boolToFloat(device.IsPowerOn()), device.ID)
+		}
+
+		if !device.State.UpdatedAt.IsZero() {
+			metrics <- prometheus.MustNewConstMetric(collector.rssi, prometheus.GaugeValue, float64(device.State.RSSI), device.ID)
+			metrics <- prometheus.MustNewConstMetric(collector.heap, prometheus.GaugeValue, float64(device.State.Heap), device.ID)
+			metrics <- prometheus.MustNewConstMetric(collector.uptime, prometheus.GaugeValue, float64(device.State.UptimeSec), device.ID)
+		}
+
+		if device.State.BootCount != 0 {
+			metrics <- prometheus.MustNewConstMetric(collector.bootCount, prometheus.GaugeValue, float64(device.State.BootCount), device.ID)
+		}
+	}
+
+	collector.commands.Collect(metrics)
+	collector.timeouts.Collect(metrics)
+	collector.retries.Collect(metrics)
+	collector.decodeErrors.Collect(metrics)
+	collector.commandDuration.Collect(metrics)
+}
+
+// CommandCompleted implements sonoff.Observer.
+// Commands to the group topic (see sonoff.TasmotaGroupTopicAll) are only part of the duration histogram.
+func (collector *Collector) CommandCompleted(id string, command string, duration time.Duration, err error) {
+	collector.commandDuration.WithLabelValues(command).Observe(duration.Seconds())
+
+	if !isDevice(id) {
+		return
+	}
+
+	result := "success"
+
+	if err != nil {
+		result = "error"
+	}
+
+	collector.commands.WithLabelValues(id, command, result).Inc()
+}
+
+// CommandTimedOut implements sonoff.Observer.
+func (collector *Collector) CommandTimedOut(id string, command string) {
+	if isDevice(id) {
+		collector.timeouts.WithLabelValues(id, command).Inc()
+	}
+}
+
+// CommandRetried implements sonoff.RetryObserver.
+func (collector *Collector) CommandRetried(id string, command string, attempt int, err error) {
+	if isDevice(id) {
+		collector.retries.WithLabelValues(id, command).Inc()
+	}
+}
+
+// DecodeFailed implements sonoff.Observer.
+func (collector *Collector) DecodeFailed(id string, command string, err error) {
+	if isDevice(id) {
+		collector.decodeErrors.WithLabelValues(id, command).Inc()
+	}
+}
+
+// isDevice reports whether the ID belongs to a single device and not to the group topic of all devices,
+// which must not become a value of the device label.
+func isDevice(id string) bool {
+	return id != sonoff.TasmotaGroupTopicAll
+}
+
+// boolToFloat converts a boolean into a gauge value.
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
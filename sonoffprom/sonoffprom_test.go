@@ -0,0 +1,199 @@
+package sonoffprom
+
+import (
+	"errors"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T) (*sonoff.SonoffBasicR2, *mqtt.Server) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2WithServer(server, 0)
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetTelemetryTracking(true)
+
+	return sonoffServer, server
+}
+
+func serve(t *testing.T, sonoffServer *sonoff.SonoffBasicR2, server *mqtt.Server) {
+	assert.NoError(t, sonoffServer.Serve())
+
+	go func() {
+		for range sonoffServer.TeleConnected() {
+		}
+	}()
+
+	t.Cleanup(func() {
+		_ = sonoffServer.Close()
+		_ = server.Close()
+	})
+}
+
+func TestCollector_Register(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	collector := NewCollector(sonoffServer)
+	registry := prometheus.NewRegistry()
+
+	serve(t, sonoffServer, server)
+
+	// The registration after Serve reaches the commands sent from the broker handlers as well
+	assert.NoError(t, collector.Register(registry))
+	assert.Equal(t, collector, sonoffServer.GetObserver())
+	assert.Error(t, collector.Register(registry))
+}
+
+func TestCollector_DeviceMetrics(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	collector := NewCollector(sonoffServer)
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, collector.Register(registry))
+
+	serve(t, sonoffServer, server)
+
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.NoError(t, server.Publish("tele/unknown/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true, 0))
+	assert.NoError(t, server.Publish("tele/sonoff/STATE", []byte(`{"UptimeSec":1623,"Heap":22,"POWER":"ON","Wifi":{"RSSI":68}}`), false, 0))
+
+	expected := `
+# HELP sonoff_device_heap_kilobytes Free heap reported by the device.
+# TYPE sonoff_device_heap_kilobytes gauge
+sonoff_device_heap_kilobytes{device="sonoff"} 22
+# HELP sonoff_device_online Whether the device is online (1) or offline (0) according to its LWT.
+# TYPE sonoff_device_online gauge
+sonoff_device_online{device="sonoff"} 1
+sonoff_device_online{device="unknown"} 1
+# HELP sonoff_device_power Whether the relay of the device is on (1) or off (0).
+# TYPE sonoff_device_power gauge
+sonoff_device_power{device="sonoff"} 1
+# HELP sonoff_device_uptime_seconds Uptime reported by the device.
+# TYPE sonoff_device_uptime_seconds gauge
+sonoff_device_uptime_seconds{device="sonoff"} 1623
+# HELP sonoff_device_wifi_rssi_percent WiFi signal quality reported by the device.
+# TYPE sonoff_device_wifi_rssi_percent gauge
+sonoff_device_wifi_rssi_percent{device="sonoff"} 68
+`
+
+	err := testutil.GatherAndCompare(
+		registry,
+		strings.NewReader(expected),
+		"sonoff_device_online",
+		"sonoff_device_power",
+		"sonoff_device_wifi_rssi_percent",
+		"sonoff_device_heap_kilobytes",
+		"sonoff_device_uptime_seconds",
+		"sonoff_device_boot_count",
+	)
+
+	assert.NoError(t, err)
+}
+
+func TestCollector_StateTexts(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	sonoffServer.SetNativeDiscovery(true)
+
+	collector := NewCollector(sonoffServer)
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, collector.Register(registry))
+
+	serve(t, sonoffServer, server)
+
+	config := `{"mac":"AABBCCDDEEFF","t":"kueche","ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"],"state":["AUS","AN","UMSCHALTEN","HALTEN"]}`
+
+	assert.NoError(t, server.Publish("tasmota/discovery/AABBCCDDEEFF/config", []byte(config), true, 0))
+	assert.NoError(t, server.Publish("tele/kueche/STATE", []byte(`{"UptimeSec":10,"POWER":"AN","Wifi":{"RSSI":50}}`), false, 0))
+
+	expected := `
+# HELP sonoff_device_power Whether the relay of the device is on (1) or off (0).
+# TYPE sonoff_device_power gauge
+sonoff_device_power{device="kueche"} 1
+`
+
+	err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "sonoff_device_power")
+
+	assert.NoError(t, err)
+}
+
+func TestCollector_CommandMetrics(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	collector := NewCollector(sonoffServer)
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, collector.Register(registry))
+
+	serve(t, sonoffServer, server)
+
+	sonoffServer.PowerOn("sonoff")
+	sonoffServer.PowerOff("sonoff")
+
+	collector.CommandCompleted("sonoff", "STATUS11", 2*time.Second, errors.New("timeout"))
+	collector.CommandTimedOut("sonoff", "STATUS11")
+	collector.CommandRetried("sonoff", "STATUS11", 1, errors.New("timeout"))
+	collector.DecodeFailed("sonoff", "STATUS0", errors.New("invalid character"))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(collector.commands.WithLabelValues("sonoff", "POWER", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.commands.WithLabelValues("sonoff", "STATUS11", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.timeouts.WithLabelValues("sonoff", "STATUS11")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.retries.WithLabelValues("sonoff", "STATUS11")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(collector.decodeErrors.WithLabelValues("sonoff", "STATUS0")))
+	assert.Equal(t, 2, testutil.CollectAndCount(collector.commandDuration))
+}
+
+func TestCollector_GroupTopic(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	collector := NewCollector(sonoffServer)
+	registry := prometheus.NewRegistry()
+
+	serve(t, sonoffServer, server)
+
+	assert.NoError(t, collector.Register(registry))
+
+	sonoffServer.SetDryRun(true)
+
+	_, err := sonoffServer.Discover()
+
+	assert.NoError(t, err)
+
+	collector.CommandTimedOut(sonoff.TasmotaGroupTopicAll, "STATUS")
+	collector.CommandRetried(sonoff.TasmotaGroupTopicAll, "STATUS", 1, errors.New("timeout"))
+	collector.DecodeFailed(sonoff.TasmotaGroupTopicAll, "STATUS", errors.New("invalid character"))
+
+	// The group topic is not a device, only the duration of the broadcast is observed
+	assert.Equal(t, 0, testutil.CollectAndCount(collector.commands))
+	assert.Equal(t, 0, testutil.CollectAndCount(collector.timeouts))
+	assert.Equal(t, 0, testutil.CollectAndCount(collector.retries))
+	assert.Equal(t, 0, testutil.CollectAndCount(collector.decodeErrors))
+	assert.Equal(t, 1, testutil.CollectAndCount(collector.commandDuration))
+}
+
+func TestNewCollectorWithNamespace(t *testing.T) {
+	sonoffServer, server := newServer(t)
+
+	collector := NewCollectorWithNamespace(sonoffServer, "relays")
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, collector.Register(registry))
+
+	serve(t, sonoffServer, server)
+	assert.NoError(t, server.Publish("tele/sonoff/LWT", []byte(sonoff.TasmotaTeleTopicLWTResponseOffline), true, 0))
+
+	count, err := testutil.GatherAndCount(registry, "relays_device_online")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,224 @@
+package sonoffsim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// mqttProtocolVersion is the MQTT version spoken by Tasmota (3.1.1).
+const mqttProtocolVersion = 4
+
+// client is a minimal MQTT 3.1.1 client, as much as a Tasmota device needs: connect with a will, subscribe and publish at QoS 0.
+// The packets are encoded and decoded with the codec of the mochi-mqtt broker.
+type client struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	packetID   uint16
+}
+
+// dial connects to the broker and waits for the CONNACK.
+func dial(ctx context.Context, address string, connect packets.ConnectParams) (*client, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mqttClient := &client{conn: conn, reader: bufio.NewReader(conn)}
+
+	connect.ProtocolName = []byte("MQTT")
+
+	err = mqttClient.write(&packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: mqttProtocolVersion,
+		Connect:         connect,
+	})
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	// Do not wait forever for a broker that does not answer
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+
+	packet, err := mqttClient.read()
+
+	_ = conn.SetReadDeadline(time.Time{})
+
+	switch {
+	case err != nil:
+		_ = conn.Close()
+
+		return nil, err
+	case packet.FixedHeader.Type != packets.Connack:
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("unexpected packet type %d instead of CONNACK", packet.FixedHeader.Type)
+	case packet.ReasonCode != packets.CodeSuccess.Code:
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("connection refused with code %d", packet.ReasonCode)
+	}
+
+	return mqttClient, nil
+}
+
+// subscribe subscribes to the topic filters at QoS 0. The SUBACK is received by read.
+func (mqttClient *client) subscribe(filters ...string) error {
+	subscriptions := make(packets.Subscriptions, 0, len(filters))
+
+	for _, filter := range filters {
+		subscriptions = append(subscriptions, packets.Subscription{Filter: filter})
+	}
+
+	return mqttClient.write(&packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		ProtocolVersion: mqttProtocolVersion,
+		PacketID:        mqttClient.nextPacketID(),
+		Filters:         subscriptions,
+	})
+}
+
+// publish publishes the payload at QoS 0.
+func (mqttClient *client) publish(topic string, payload []byte, retain bool) error {
+	return mqttClient.write(&packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Retain: retain},
+		ProtocolVersion: mqttProtocolVersion,
+		TopicName:       topic,
+		Payload:         payload,
+	})
+}
+
+// ping sends a PINGREQ to keep the connection alive.
+func (mqttClient *client) ping() error {
+	return mqttClient.write(&packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Pingreq},
+		ProtocolVersion: mqttProtocolVersion,
+	})
+}
+
+// disconnect sends a DISCONNECT, so the broker discards the will, and closes the connection.
+func (mqttClient *client) disconnect() error {
+	err := mqttClient.write(&packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Disconnect},
+		ProtocolVersion: mqttProtocolVersion,
+	})
+
+	return errors.Join(err, mqttClient.conn.Close())
+}
+
+// close drops the connection without a DISCONNECT, so the broker publishes the will.
+func (mqttClient *client) close() error {
+	return mqttClient.conn.Close()
+}
+
+// read reads the next packet. PUBLISH packets with QoS 1 are acknowledged right away.
+func (mqttClient *client) read() (packets.Packet, error) {
+	var packet packets.Packet
+
+	header, err := mqttClient.reader.ReadByte()
+
+	if err != nil {
+		return packet, err
+	}
+
+	if err = packet.FixedHeader.Decode(header); err != nil {
+		return packet, err
+	}
+
+	packet.FixedHeader.Remaining, _, err = packets.DecodeLength(mqttClient.reader)
+
+	if err != nil {
+		return packet, err
+	}
+
+	packet.ProtocolVersion = mqttProtocolVersion
+
+	data := make([]byte, packet.FixedHeader.Remaining)
+
+	if _, err = io.ReadFull(mqttClient.reader, data); err != nil {
+		return packet, err
+	}
+
+	switch packet.FixedHeader.Type {
+	case packets.Connack:
+		err = packet.ConnackDecode(data)
+	case packets.Publish:
+		err = packet.PublishDecode(data)
+
+		if err == nil && packet.FixedHeader.Qos > 0 {
+			err = mqttClient.write(&packets.Packet{
+				FixedHeader:     packets.FixedHeader{Type: packets.Puback},
+				ProtocolVersion: mqttProtocolVersion,
+				PacketID:        packet.PacketID,
+			})
+		}
+	case packets.Suback:
+		err = packet.SubackDecode(data)
+	}
+
+	return packet, err
+}
+
+// write encodes the packet and writes it to the connection.
+func (mqttClient *client) write(packet *packets.Packet) error {
+	var buffer bytes.Buffer
+	var err error
+
+	switch packet.FixedHeader.Type {
+	case packets.Connect:
+		err = packet.ConnectEncode(&buffer)
+	case packets.Subscribe:
+		err = packet.SubscribeEncode(&buffer)
+	case packets.Publish:
+		err = packet.PublishEncode(&buffer)
+	case packets.Puback:
+		err = packet.PubackEncode(&buffer)
+	case packets.Pingreq:
+		err = packet.PingreqEncode(&buffer)
+	case packets.Disconnect:
+		err = packet.DisconnectEncode(&buffer)
+	default:
+		err = fmt.Errorf("unsupported packet type %d", packet.FixedHeader.Type)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	mqttClient.writeMutex.Lock()
+	defer mqttClient.writeMutex.Unlock()
+
+	_, err = mqttClient.conn.Write(buffer.Bytes())
+
+	return err
+}
+
+// nextPacketID returns a new non-zero packet identifier.
+func (mqttClient *client) nextPacketID() uint16 {
+	mqttClient.writeMutex.Lock()
+	defer mqttClient.writeMutex.Unlock()
+
+	mqttClient.packetID++
+
+	if mqttClient.packetID == 0 {
+		mqttClient.packetID = 1
+	}
+
+	return mqttClient.packetID
+}
@@ -0,0 +1,250 @@
+package sonoffsim
+
+import (
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildDateTime is the build date reported in STATUS 2.
+var buildDateTime = time.Date(2024, time.January, 12, 10, 44, 21, 0, time.UTC)
+
+// getStatus builds the STATUS 0 response of a Sonoff Basic R2 from the state of the device. The mutex must be held.
+func (device *Device) getStatus() sonoff.Status {
+	now := time.Now()
+	uptime := now.Sub(device.startedAt)
+	mac := formatMac(device.mac, ":")
+	hostname := fmt.Sprintf("%s-%04d", device.id, int(device.mac[4]&0x0f)<<8|int(device.mac[5]))
+	ip := fmt.Sprintf("192.168.1.%d", 2+int(device.mac[5])%250)
+
+	var status sonoff.Status
+
+	status.Status = sonoff.StatusZero{
+		Module:       1,
+		DeviceName:   device.id,
+		FriendlyName: []string{device.id},
+		Topic:        device.id,
+		ButtonTopic:  "0",
+		Power:        "0",
+		PowerLock:    "0",
+		PowerOnState: 3,
+		LedState:     1,
+		LedMask:      "FFFF",
+		SaveData:     1,
+		SaveState:    1,
+		SwitchTopic:  "0",
+		SwitchMode:   []int{0, 0, 0, 0, 0, 0, 0, 0},
+	}
+
+	if device.power == sonoff.TasmotaCmndTopicPowerValueOn {
+		status.Status.Power = "1"
+	}
+
+	status.StatusPRM = sonoff.StatusOne{
+		Baudrate:      115200,
+		SerialConfig:  "8N1",
+		GroupTopic:    sonoff.TasmotaGroupTopicAll,
+		OtaURL:        "http://ota.tasmota.com/tasmota/release/tasmota.bin.gz",
+		RestartReason: device.restartReason,
+		Uptime:        formatUptime(uptime),
+		StartupUTC:    sonoff.TasmotaTime(device.startedAt.UTC().Truncate(time.Second)),
+		Sleep:         50,
+		CfgHolder:     4617,
+		BootCount:     device.bootCount,
+		BCResetTime:   sonoff.TasmotaTime(device.bootCountReset.Truncate(time.Second)),
+		SaveCount:     10 + device.bootCount,
+		SaveAddress:   "F5000",
+	}
+
+	status.StatusFWR = sonoff.StatusTwo{
+		Version:       device.version,
+		BuildDateTime: sonoff.TasmotaTime(buildDateTime),
+		Boot:          31,
+		Core:          "2_7_4_9",
+		SDK:           "2.2.2-dev(38a443e)",
+		CPUFrequency:  80,
+		Hardware:      "ESP8285N08",
+		CR:            "378/699",
+	}
+
+	status.StatusLOG = sonoff.StatusThree{
+		SerialLog:  2,
+		WebLog:     2,
+		MqttLog:    0,
+		SysLog:     0,
+		LogHost:    "",
+		LogPort:    514,
+		SSID:       []string{"sonoffsim", ""},
+		TelePeriod: int(device.telePeriod / time.Second),
+		Resolution: "558180C0",
+		SetOption:  []string{"00008009", "2805C80001000600003C5A0A192800000000", "00000080", "00006000", "00004000", "00000000"},
+	}
+
+	status.StatusMEM = sonoff.StatusFour{
+		ProgramSize:      629,
+		Free:             372,
+		Heap:             device.heap,
+		ProgramFlashSize: 1024,
+		FlashSize:        1024,
+		FlashChipID:      "14405E",
+		FlashFrequency:   40,
+		FlashMode:        "DOUT",
+		Features:         []string{"00000809", "8F9AC787", "04368001", "000000CF", "010013C0", "C000F981", "00004004", "00001000", "54000020", "00000080"},
+		Drivers:          "1,2,3,4,5,6,7,8,9,10,12,16,18,19,20,21,22,24,26,27,29,30,35,37,45,62",
+		Sensors:          "1,2,3,4,5,6",
+		I2CDriver:        "7,8,9,10,11,12,13,14,15,17,18,20,24,29,31,36,41,42,44,46,48,58,62",
+	}
+
+	status.StatusNET = sonoff.StatusFive{
+		Hostname:   hostname,
+		IPAddress:  ip,
+		Gateway:    "192.168.1.1",
+		Subnetmask: "255.255.255.0",
+		DNSServer1: "192.168.1.1",
+		DNSServer2: "0.0.0.0",
+		Mac:        mac,
+		Webserver:  2,
+		HTTPAPI:    1,
+		WifiConfig: 4,
+		WifiPower:  17,
+	}
+
+	host, port := splitBroker(device.broker)
+
+	status.StatusMQT = sonoff.StatusSix{
+		MqttHost:       host,
+		MqttPort:       port,
+		MqttClientMask: "DVES_%06X",
+		MqttClient:     device.clientID,
+		MqttUser:       "DVES_USER",
+		MqttCount:      device.mqttCount,
+		MAXPACKETSIZE:  1200,
+		KEEPALIVE:      int(device.keepalive / time.Second),
+		SOCKETTIMEOUT:  4,
+	}
+
+	status.StatusTIM = sonoff.StatusSeven{
+		UTC:      now.UTC().Truncate(time.Second),
+		Local:    sonoff.TasmotaTime(now.Truncate(time.Second)),
+		StartDST: sonoff.TasmotaTime(time.Date(now.Year(), time.March, 31, 2, 0, 0, 0, time.UTC)),
+		EndDST:   sonoff.TasmotaTime(time.Date(now.Year(), time.October, 27, 3, 0, 0, 0, time.UTC)),
+		Timezone: "+01:00",
+		Sunrise:  "07:48",
+		Sunset:   "17:25",
+	}
+
+	status.StatusSNS = sonoff.StatusEight{
+		Time: sonoff.TasmotaTime(now.Truncate(time.Second)),
+	}
+
+	status.StatusSTS = sonoff.StatusEleven{
+		Time:      sonoff.TasmotaTime(now.Truncate(time.Second)),
+		Uptime:    formatUptime(uptime),
+		UptimeSec: int(uptime / time.Second),
+		Heap:      device.heap,
+		SleepMode: "Dynamic",
+		Sleep:     50,
+		LoadAvg:   19,
+		MqttCount: device.mqttCount,
+		POWER:     device.power,
+	}
+
+	status.StatusSTS.Wifi.AP = 1
+	status.StatusSTS.Wifi.SSID = "sonoffsim"
+	status.StatusSTS.Wifi.BSSID = "30:B5:C2:5D:70:72"
+	status.StatusSTS.Wifi.Channel = 11
+	status.StatusSTS.Wifi.Mode = "11n"
+	status.StatusSTS.Wifi.RSSI = device.rssi
+	status.StatusSTS.Wifi.Signal = device.rssi/2 - 100
+	status.StatusSTS.Wifi.LinkCount = device.mqttCount
+	status.StatusSTS.Wifi.Downtime = "0T00:00:03"
+
+	return status
+}
+
+// getStatusPart returns the part of STATUS 0 that Tasmota sends for STATUS <index>, with its wrapper.
+func getStatusPart(status sonoff.Status, index int) any {
+	switch index {
+	case 0:
+		return status
+	case 1:
+		return map[string]any{"StatusPRM": status.StatusPRM}
+	case 2:
+		return map[string]any{"StatusFWR": status.StatusFWR}
+	case 3:
+		return map[string]any{"StatusLOG": status.StatusLOG}
+	case 4:
+		return map[string]any{"StatusMEM": status.StatusMEM}
+	case 5:
+		return map[string]any{"StatusNET": status.StatusNET}
+	case 6:
+		return map[string]any{"StatusMQT": status.StatusMQT}
+	case 7:
+		return map[string]any{"StatusTIM": status.StatusTIM}
+	case 8, 10:
+		return map[string]any{"StatusSNS": status.StatusSNS}
+	case 11:
+		return map[string]any{"StatusSTS": status.StatusSTS}
+	default:
+		return map[string]any{"Status": status.Status}
+	}
+}
+
+// getMac derives a stable Espressif MAC address from the device ID.
+func getMac(id string) [6]byte {
+	hash := fnv.New32a()
+
+	_, _ = hash.Write([]byte(id))
+
+	sum := hash.Sum32()
+
+	return [6]byte{0xA4, 0xCF, 0x12, byte(sum >> 16), byte(sum >> 8), byte(sum)}
+}
+
+// formatMac formats the MAC address with the separator.
+func formatMac(mac [6]byte, separator string) string {
+	parts := make([]string, 0, len(mac))
+
+	for _, part := range mac {
+		parts = append(parts, fmt.Sprintf("%02X", part))
+	}
+
+	return strings.Join(parts, separator)
+}
+
+// formatUptime formats the uptime like Tasmota (<days>T<hh>:<mm>:<ss>).
+func formatUptime(uptime time.Duration) string {
+	seconds := int(uptime / time.Second)
+
+	return fmt.Sprintf("%dT%02d:%02d:%02d", seconds/86400, seconds/3600%24, seconds/60%60, seconds%60)
+}
+
+// splitBroker returns the host and the port of the broker address (port 1883 when missing).
+func splitBroker(address string) (string, int) {
+	host, portText, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return address, 1883
+	}
+
+	port, err := strconv.Atoi(portText)
+
+	if err != nil {
+		return host, 1883
+	}
+
+	return host, port
+}
+
+// getOnOff returns ON for true and OFF for false.
+func getOnOff(value bool) string {
+	if value {
+		return "ON"
+	}
+
+	return "OFF"
+}
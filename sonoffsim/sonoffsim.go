@@ -0,0 +1,866 @@
+// Package sonoffsim emulates a Sonoff Basic R2 running Tasmota, for end-to-end tests and load tests without hardware.
+// A simulated device connects to a broker with an LWT will, answers STATUS 0..11, POWER and SetOption73 like the firmware does,
+// publishes tele/<id>/STATE every TelePeriod, and simulates button presses and reboots.
+package sonoffsim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVersion is the firmware version reported by the simulated devices.
+const DefaultVersion = "13.4.0(tasmota)"
+
+// DefaultKeepalive is the MQTT keepalive of the simulated devices (the KEEPALIVE of Tasmota).
+const DefaultKeepalive = 30 * time.Second
+
+// DefaultConnectTimeout limits the connection to the broker.
+const DefaultConnectTimeout = 10 * time.Second
+
+// DefaultReconnectDelay is the delay between two connection attempts after the connection is lost (the MqttRetry of Tasmota).
+const DefaultReconnectDelay = 10 * time.Second
+
+// Defaults of the reported runtime state.
+const (
+	DefaultRSSI = 76
+	DefaultHeap = 25
+)
+
+// Restart reasons reported in STATUS 1.
+const (
+	RestartReasonPowerOn  = "Power On"
+	RestartReasonSoftware = "Software/System restart"
+)
+
+var (
+	// ErrNotStarted is returned by Stop when the device is not started.
+	ErrNotStarted = errors.New("simulated device not started")
+
+	// ErrAlreadyStarted is returned by Start when the device is already started.
+	ErrAlreadyStarted = errors.New("simulated device already started")
+
+	// ErrNotConnected is returned by PressButton and Reboot while the device is not connected to the broker.
+	ErrNotConnected = errors.New("simulated device not connected")
+)
+
+// discardLogger is used until a logger is set with SetLogger.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Device is a simulated Sonoff Basic R2. Use NewDevice to create one and Start to connect it to the broker.
+// The settings must be changed before Start, except the runtime state (power, RSSI, heap, latency and failure rate).
+type Device struct {
+	mutex sync.Mutex
+
+	id          string
+	broker      string
+	clientID    string
+	version     string
+	telePeriod  time.Duration
+	keepalive   time.Duration
+	reconnect   time.Duration
+	latency     time.Duration
+	failureRate float64
+	log         *slog.Logger
+
+	power          string
+	setOption73    bool
+	rssi           int
+	heap           int
+	bootCount      int
+	mqttCount      int
+	restartReason  string
+	startedAt      time.Time
+	bootCountReset time.Time
+	mac            [6]byte
+
+	running bool
+	stop    chan struct{}
+	session *session
+}
+
+// session is a single connection of the device to the broker.
+type session struct {
+	client *client
+	done   chan struct{}
+	once   sync.Once
+	wait   sync.WaitGroup
+}
+
+// NewDevice creates a simulated device with the Tasmota topic id that connects to the broker address (host:port).
+// The device is off, has its physical button enabled and reports the DefaultVersion firmware.
+func NewDevice(id string, broker string) *Device {
+	mac := getMac(id)
+	now := time.Now()
+
+	return &Device{
+		id:             id,
+		broker:         broker,
+		clientID:       fmt.Sprintf("DVES_%02X%02X%02X", mac[3], mac[4], mac[5]),
+		version:        DefaultVersion,
+		keepalive:      DefaultKeepalive,
+		reconnect:      DefaultReconnectDelay,
+		power:          sonoff.TasmotaCmndTopicPowerValueOff,
+		rssi:           DefaultRSSI,
+		heap:           DefaultHeap,
+		bootCount:      1,
+		restartReason:  RestartReasonPowerOn,
+		startedAt:      now,
+		bootCountReset: now,
+		mac:            mac,
+	}
+}
+
+// GetID returns the Tasmota topic of the device.
+func (device *Device) GetID() string {
+	return device.id
+}
+
+// GetClientID returns the MQTT client ID of the device.
+func (device *Device) GetClientID() string {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.clientID
+}
+
+// SetClientID sets the MQTT client ID of the device (default DVES_ followed by the end of the MAC address).
+func (device *Device) SetClientID(value string) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.clientID = value
+}
+
+// GetVersion returns the firmware version reported by the device.
+func (device *Device) GetVersion() string {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.version
+}
+
+// SetVersion sets the firmware version reported by the device in STATUS 2 (default DefaultVersion).
+func (device *Device) SetVersion(value string) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.version = value
+}
+
+// GetTelePeriod returns the interval of the tele/<id>/STATE messages.
+func (device *Device) GetTelePeriod() time.Duration {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.telePeriod
+}
+
+// SetTelePeriod sets the interval of the tele/<id>/STATE messages (default 0, only one message after connecting).
+func (device *Device) SetTelePeriod(value time.Duration) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.telePeriod = value
+}
+
+// GetKeepalive returns the MQTT keepalive of the device.
+func (device *Device) GetKeepalive() time.Duration {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.keepalive
+}
+
+// SetKeepalive sets the MQTT keepalive of the device (default DefaultKeepalive).
+func (device *Device) SetKeepalive(value time.Duration) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.keepalive = value
+}
+
+// GetReconnectDelay returns the delay between two connection attempts after the connection is lost.
+func (device *Device) GetReconnectDelay() time.Duration {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.reconnect
+}
+
+// SetReconnectDelay sets the delay between two connection attempts after the connection is lost (default DefaultReconnectDelay).
+func (device *Device) SetReconnectDelay(value time.Duration) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.reconnect = value
+}
+
+// GetLatency returns the delay before the device answers a command.
+func (device *Device) GetLatency() time.Duration {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.latency
+}
+
+// SetLatency sets the delay before the device answers a command (default 0).
+func (device *Device) SetLatency(value time.Duration) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.latency = value
+}
+
+// GetFailureRate returns the probability that the device ignores a command.
+func (device *Device) GetFailureRate() float64 {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.failureRate
+}
+
+// SetFailureRate sets the probability (0 to 1) that the device ignores a command, so the command times out (default 0).
+func (device *Device) SetFailureRate(value float64) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.failureRate = value
+}
+
+// GetPower returns the state of the relay (ON or OFF).
+func (device *Device) GetPower() string {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.power
+}
+
+// SetPower sets the state of the relay (ON or OFF) without reporting it, like the state restored at boot.
+func (device *Device) SetPower(value string) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.power = value
+}
+
+// GetPhysicalButton returns whether the physical button switches the relay (SetOption73 OFF).
+func (device *Device) GetPhysicalButton() bool {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return !device.setOption73
+}
+
+// SetPhysicalButton sets whether the physical button switches the relay (default true).
+func (device *Device) SetPhysicalButton(value bool) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.setOption73 = !value
+}
+
+// GetRSSI returns the WiFi signal quality reported by the device, in percent.
+func (device *Device) GetRSSI() int {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.rssi
+}
+
+// SetRSSI sets the WiFi signal quality reported by the device, in percent (default DefaultRSSI).
+func (device *Device) SetRSSI(value int) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.rssi = value
+}
+
+// GetHeap returns the free heap reported by the device, in kilobytes.
+func (device *Device) GetHeap() int {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.heap
+}
+
+// SetHeap sets the free heap reported by the device, in kilobytes (default DefaultHeap).
+func (device *Device) SetHeap(value int) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.heap = value
+}
+
+// GetBootCount returns the boot count of the device, increased by every reboot.
+func (device *Device) GetBootCount() int {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.bootCount
+}
+
+// SetBootCount sets the boot count of the device (default 1).
+func (device *Device) SetBootCount(value int) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.bootCount = value
+}
+
+// GetLogger returns the logger of the device.
+func (device *Device) GetLogger() *slog.Logger {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.log
+}
+
+// SetLogger sets the logger of the device. Connections are logged at Info and commands at Debug.
+func (device *Device) SetLogger(value *slog.Logger) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	device.log = value
+}
+
+// Online returns whether the device is connected to the broker.
+func (device *Device) Online() bool {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.session != nil
+}
+
+// Start connects the device to the broker with the "Offline" will, subscribes to its command topics
+// and publishes "Online" on tele/<id>/LWT followed by its first tele/<id>/STATE.
+// When the connection is lost afterwards, the device connects again every reconnect delay until Stop.
+func (device *Device) Start() error {
+	device.mutex.Lock()
+
+	if device.running {
+		device.mutex.Unlock()
+
+		return ErrAlreadyStarted
+	}
+
+	stop := make(chan struct{})
+	device.running = true
+	device.stop = stop
+	device.mutex.Unlock()
+
+	if err := device.connect(stop); err != nil {
+		device.mutex.Lock()
+
+		// Not stopped while connecting
+		if device.stop == stop {
+			device.running = false
+			device.stop = nil
+
+			close(stop)
+		}
+
+		device.mutex.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Stop publishes "Offline" on tele/<id>/LWT and disconnects the device from the broker.
+func (device *Device) Stop() error {
+	device.mutex.Lock()
+
+	if !device.running {
+		device.mutex.Unlock()
+
+		return ErrNotStarted
+	}
+
+	current := device.session
+	device.running = false
+	device.session = nil
+
+	// Wake up a restart or a reconnect that is waiting
+	close(device.stop)
+
+	device.stop = nil
+	device.mutex.Unlock()
+
+	// The device is waiting to connect again
+	if current == nil {
+		return nil
+	}
+
+	err := current.client.publish(device.getTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT), []byte(sonoff.TasmotaTeleTopicLWTResponseOffline), true)
+
+	current.cancel()
+
+	err = errors.Join(err, current.client.disconnect())
+
+	current.wait.Wait()
+
+	device.logger().Info("device stopped", sonoff.LogKeyDevice, device.id)
+
+	return err
+}
+
+// Reboot drops the connection without a DISCONNECT, so the broker publishes the "Offline" will,
+// and connects again after the downtime with an increased boot count and a reset uptime.
+func (device *Device) Reboot(downtime time.Duration) error {
+	return device.restart(downtime, RestartReasonSoftware)
+}
+
+// PowerCycle is like Reboot, but reports a power loss (Power On) as the restart reason.
+// The relay keeps its state, like Tasmota with PowerOnState 3.
+func (device *Device) PowerCycle(downtime time.Duration) error {
+	return device.restart(downtime, RestartReasonPowerOn)
+}
+
+// restart drops the connection and connects again after the downtime with the restart reason.
+func (device *Device) restart(downtime time.Duration, reason string) error {
+	device.mutex.Lock()
+	current := device.session
+	stop := device.stop
+	device.session = nil
+	device.mutex.Unlock()
+
+	if current == nil {
+		return ErrNotConnected
+	}
+
+	current.cancel()
+
+	_ = current.client.close()
+
+	current.wait.Wait()
+
+	device.logger().Info("device rebooting", sonoff.LogKeyDevice, device.id, sonoff.LogKeyDuration, downtime)
+
+	timer := time.NewTimer(downtime)
+
+	select {
+	case <-timer.C:
+	case <-stop:
+		timer.Stop()
+
+		// Stopped during the downtime
+		return nil
+	}
+
+	device.mutex.Lock()
+	device.bootCount++
+	device.restartReason = reason
+	device.startedAt = time.Now()
+	device.mutex.Unlock()
+
+	if err := device.connect(stop); err != nil {
+		go device.reconnectLoop(stop)
+
+		return err
+	}
+
+	return nil
+}
+
+// PressButton simulates a short press of the physical button.
+// With the physical button enabled the relay toggles and the new state is reported on stat/<id>/RESULT and stat/<id>/POWER;
+// with the physical button disabled (SetOption73 ON) only the button action is reported on stat/<id>/RESULT.
+func (device *Device) PressButton() error {
+	device.mutex.Lock()
+	current := device.session
+	decoupled := device.setOption73
+	device.mutex.Unlock()
+
+	if current == nil {
+		return ErrNotConnected
+	}
+
+	if decoupled {
+		return device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicResult, map[string]any{
+			"Button1": map[string]string{"Action": "SINGLE"},
+		})
+	}
+
+	return device.switchPower(current, sonoff.TasmotaCmndTopicPowerValueToggle)
+}
+
+// connect connects the device to the broker and starts the loops of the session.
+// The mutex is not held while connecting, which may take up to DefaultConnectTimeout, so Stop is never held up.
+// A connection made after the device was stopped or restarted (stop is no longer the current one) is closed again.
+func (device *Device) connect(stop chan struct{}) error {
+	device.mutex.Lock()
+
+	params := packets.ConnectParams{
+		ClientIdentifier: device.clientID,
+		Keepalive:        uint16(device.keepalive / time.Second),
+		Clean:            true,
+		WillFlag:         true,
+		WillTopic:        device.getTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT),
+		WillPayload:      []byte(sonoff.TasmotaTeleTopicLWTResponseOffline),
+		WillRetain:       true,
+	}
+
+	device.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultConnectTimeout)
+	defer cancel()
+
+	mqttClient, err := dial(ctx, device.broker, params)
+
+	if err != nil {
+		return err
+	}
+
+	err = mqttClient.subscribe(
+		device.getTopic(sonoff.TasmotaPrefixCmnd, "#"),
+		fmt.Sprintf("%s/%s/#", sonoff.TasmotaPrefixCmnd, sonoff.TasmotaGroupTopicAll),
+	)
+
+	if err == nil {
+		err = mqttClient.publish(device.getTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT), []byte(sonoff.TasmotaTeleTopicLWTResponseOnline), true)
+	}
+
+	if err != nil {
+		_ = mqttClient.close()
+
+		return err
+	}
+
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	if device.stop != stop || device.session != nil {
+		_ = mqttClient.publish(device.getTopic(sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicLWT), []byte(sonoff.TasmotaTeleTopicLWTResponseOffline), true)
+		_ = mqttClient.disconnect()
+
+		return nil
+	}
+
+	current := &session{client: mqttClient, done: make(chan struct{})}
+
+	device.mqttCount++
+	device.session = current
+
+	current.wait.Add(3)
+
+	go device.readLoop(current)
+	go device.keepaliveLoop(current, device.keepalive)
+	go device.teleLoop(current, device.telePeriod)
+
+	device.getLogger().Info("device connected", sonoff.LogKeyDevice, device.id, sonoff.LogKeyClientID, device.clientID)
+
+	return nil
+}
+
+// cancel stops the loops of the session.
+func (current *session) cancel() {
+	current.once.Do(func() {
+		close(current.done)
+	})
+}
+
+// lost drops the session after the connection is lost and connects again in the background.
+func (device *Device) lost(current *session) {
+	device.mutex.Lock()
+
+	if device.session != current {
+		device.mutex.Unlock()
+
+		return
+	}
+
+	device.session = nil
+	stop := device.stop
+	device.mutex.Unlock()
+
+	current.cancel()
+
+	_ = current.client.close()
+
+	go device.reconnectLoop(stop)
+}
+
+// reconnectLoop connects the device again every reconnect delay, until it is connected or stopped.
+func (device *Device) reconnectLoop(stop chan struct{}) {
+	for {
+		timer := time.NewTimer(device.GetReconnectDelay())
+
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+
+			return
+		}
+
+		device.mutex.Lock()
+		connected := device.session != nil
+		device.mutex.Unlock()
+
+		if connected {
+			return
+		}
+
+		err := device.connect(stop)
+
+		if err == nil {
+			return
+		}
+
+		device.logger().Warn("reconnect failed", sonoff.LogKeyDevice, device.id, sonoff.LogKeyError, err)
+	}
+}
+
+// readLoop handles the commands received by the session until the connection is closed.
+func (device *Device) readLoop(current *session) {
+	defer current.wait.Done()
+
+	for {
+		packet, err := current.client.read()
+
+		if err != nil {
+			select {
+			case <-current.done:
+			default:
+				device.logger().Warn("connection lost", sonoff.LogKeyDevice, device.id, sonoff.LogKeyError, err)
+
+				device.lost(current)
+			}
+
+			return
+		}
+
+		if packet.FixedHeader.Type == packets.Publish {
+			device.handle(current, packet.TopicName, string(packet.Payload))
+		}
+	}
+}
+
+// keepaliveLoop pings the broker within the keepalive interval.
+func (device *Device) keepaliveLoop(current *session, keepalive time.Duration) {
+	defer current.wait.Done()
+
+	if keepalive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(keepalive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-current.done:
+			return
+		case <-ticker.C:
+			if err := current.client.ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// teleLoop publishes tele/<id>/STATE right away and then every tele period.
+func (device *Device) teleLoop(current *session, telePeriod time.Duration) {
+	defer current.wait.Done()
+
+	if err := device.publishState(current); err != nil {
+		return
+	}
+
+	if telePeriod <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(telePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-current.done:
+			return
+		case <-ticker.C:
+			if err := device.publishState(current); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle answers a command received on cmnd/<id>/<command> or cmnd/tasmotas/<command>.
+func (device *Device) handle(current *session, topic string, payload string) {
+	parts := strings.Split(topic, "/")
+
+	if len(parts) != 3 {
+		return
+	}
+
+	command := strings.ToUpper(parts[2])
+
+	device.mutex.Lock()
+	latency := device.latency
+	failed := device.failureRate > 0 && rand.Float64() < device.failureRate
+	device.mutex.Unlock()
+
+	if failed {
+		device.logger().Debug("command ignored", sonoff.LogKeyDevice, device.id, sonoff.LogKeyCommand, command)
+
+		return
+	}
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+
+		select {
+		case <-current.done:
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		}
+	}
+
+	device.logger().Debug("command received", sonoff.LogKeyDevice, device.id, sonoff.LogKeyCommand, command)
+
+	var err error
+
+	switch {
+	case strings.HasPrefix(command, sonoff.TasmotaCmndTopicStatus):
+		err = device.answerStatus(current, strings.TrimPrefix(command, sonoff.TasmotaCmndTopicStatus), payload)
+	case command == sonoff.TasmotaCmndTopicPower || command == sonoff.TasmotaCmndTopicPower+"1":
+		err = device.switchPower(current, strings.ToUpper(payload))
+	case command == sonoff.TasmotaCmndTopicPhysicalButton:
+		err = device.setPhysicalButtonOption(current, strings.ToUpper(payload))
+	default:
+		err = device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicResult, map[string]string{"Command": "Unknown"})
+	}
+
+	if err != nil {
+		device.logger().Warn("response publish failed", sonoff.LogKeyDevice, device.id, sonoff.LogKeyCommand, command, sonoff.LogKeyError, err)
+	}
+}
+
+// answerStatus answers STATUS <index>. The index is part of the command (STATUS0) or its payload (STATUS 1).
+// Without an index only the Status part is sent on stat/<id>/STATUS, like Tasmota does.
+func (device *Device) answerStatus(current *session, index string, payload string) error {
+	if index == "" {
+		index = strings.TrimSpace(payload)
+	}
+
+	device.mutex.Lock()
+	status := device.getStatus()
+	device.mutex.Unlock()
+
+	if index == "" {
+		return device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicStatusShort, map[string]any{"Status": status.Status})
+	}
+
+	number, err := strconv.Atoi(index)
+
+	if err != nil {
+		return device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicResult, map[string]string{"Command": "Error"})
+	}
+
+	return device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicStatusShort+index, getStatusPart(status, number))
+}
+
+// switchPower applies the POWER payload (empty only reports the state) and reports the state on stat/<id>/RESULT and stat/<id>/POWER.
+func (device *Device) switchPower(current *session, value string) error {
+	device.mutex.Lock()
+
+	switch value {
+	case sonoff.TasmotaCmndTopicPowerValueOn, "1":
+		device.power = sonoff.TasmotaCmndTopicPowerValueOn
+	case sonoff.TasmotaCmndTopicPowerValueOff, "0":
+		device.power = sonoff.TasmotaCmndTopicPowerValueOff
+	case sonoff.TasmotaCmndTopicPowerValueToggle, "2":
+		if device.power == sonoff.TasmotaCmndTopicPowerValueOn {
+			device.power = sonoff.TasmotaCmndTopicPowerValueOff
+		} else {
+			device.power = sonoff.TasmotaCmndTopicPowerValueOn
+		}
+	}
+
+	power := device.power
+
+	device.mutex.Unlock()
+
+	err := device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicResult, map[string]string{"POWER": power})
+
+	if err != nil {
+		return err
+	}
+
+	return current.client.publish(device.getTopic(sonoff.TasmotaPrefixStat, sonoff.TasmotaCmndTopicPower), []byte(power), false)
+}
+
+// setPhysicalButtonOption applies the SetOption73 payload (empty only reports the state) and reports it on stat/<id>/RESULT.
+func (device *Device) setPhysicalButtonOption(current *session, value string) error {
+	device.mutex.Lock()
+
+	switch value {
+	case "1", "ON":
+		device.setOption73 = true
+	case "0", "OFF":
+		device.setOption73 = false
+	}
+
+	state := getOnOff(device.setOption73)
+
+	device.mutex.Unlock()
+
+	return device.publishJSON(current, sonoff.TasmotaPrefixStat, sonoff.TasmotaStatTopicResult, map[string]string{"SetOption73": state})
+}
+
+// publishState publishes tele/<id>/STATE, which is STATUS 11 without the StatusSTS wrapper.
+func (device *Device) publishState(current *session) error {
+	device.mutex.Lock()
+	status := device.getStatus()
+	device.mutex.Unlock()
+
+	return device.publishJSON(current, sonoff.TasmotaPrefixTele, sonoff.TasmotaTeleTopicState, status.StatusSTS)
+}
+
+// publishJSON publishes the value as JSON on <prefix>/<id>/<topic>.
+func (device *Device) publishJSON(current *session, prefix string, topic string, value any) error {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	return current.client.publish(device.getTopic(prefix, topic), data, false)
+}
+
+// getTopic returns the full topic <prefix>/<id>/<topic> of the device.
+func (device *Device) getTopic(prefix string, topic string) string {
+	return fmt.Sprintf("%s/%s/%s", prefix, device.id, topic)
+}
+
+// logger returns the logger of the device, taking the mutex.
+func (device *Device) logger() *slog.Logger {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+
+	return device.getLogger()
+}
+
+// getLogger returns the logger of the device. The mutex must be held.
+func (device *Device) getLogger() *slog.Logger {
+	if device.log == nil {
+		return discardLogger
+	}
+
+	return device.log
+}
@@ -0,0 +1,246 @@
+package sonoffsim
+
+import (
+	"fmt"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T) (*sonoff.SonoffBasicR2, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	assert.NoError(t, err)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	assert.NoError(t, listener.Close())
+
+	sonoffServer, err := sonoff.NewSonoffBasicR2("127.0.0.1", uint16(port), 0)
+
+	assert.NoError(t, err)
+
+	sonoffServer.SetCtxCmndResponseTimeoutInSeconds(2)
+
+	return sonoffServer, fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func serve(sonoffServer *sonoff.SonoffBasicR2) {
+	go func() {
+		_ = sonoffServer.Serve()
+	}()
+}
+
+func start(t *testing.T, device *Device) {
+	assert.Eventually(t, func() bool {
+		return device.Start() == nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func receive(t *testing.T, channel <-chan string) string {
+	select {
+	case id := <-channel:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device reported")
+
+		return ""
+	}
+}
+
+func TestDevice_Commands(t *testing.T) {
+	sonoffServer, address := newServer(t)
+
+	serve(sonoffServer)
+
+	device := NewDevice("sim1", address)
+
+	device.SetVersion("12.5.0(tasmota)")
+	device.SetRSSI(64)
+
+	start(t, device)
+
+	assert.Equal(t, "sim1", receive(t, sonoffServer.TeleConnected()))
+	assert.Equal(t, true, device.Online())
+
+	status, err := sonoffServer.Status("sim1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sim1", status.Status.Topic)
+	assert.Equal(t, "0", status.Status.Power)
+	assert.Equal(t, "12.5.0(tasmota)", status.StatusFWR.Version)
+	assert.Equal(t, device.GetClientID(), status.StatusMQT.MqttClient)
+
+	statusOne, err := sonoffServer.StatusOne("sim1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, statusOne.BootCount)
+
+	statusEleven, err := sonoffServer.StatusEleven("sim1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 64, statusEleven.Wifi.RSSI)
+	assert.Equal(t, -68, statusEleven.Wifi.Signal)
+
+	err = sonoffServer.PowerOn("sim1")
+
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return device.GetPower() == sonoff.TasmotaCmndTopicPowerValueOn
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = sonoffServer.PhysicalButtonOff("sim1")
+
+	assert.NoError(t, err)
+
+	enabled, err := sonoffServer.StatusPhysicalButton("sim1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, enabled)
+	assert.Equal(t, false, device.GetPhysicalButton())
+
+	ids, err := sonoffServer.Discover()
+
+	assert.NoError(t, err)
+	assert.Contains(t, ids, "sim1")
+
+	err = device.Stop()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sim1", receive(t, sonoffServer.TeleDisconnected()))
+	assert.ErrorIs(t, device.Stop(), ErrNotStarted)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestDevice_ButtonAndReboot(t *testing.T) {
+	sonoffServer, address := newServer(t)
+
+	sonoffServer.SetPowerConfirmation(true)
+	sonoffServer.SetTelemetryTracking(true)
+
+	serve(sonoffServer)
+
+	device := NewDevice("sim2", address)
+
+	start(t, device)
+
+	assert.Equal(t, "sim2", receive(t, sonoffServer.TeleConnected()))
+	assert.ErrorIs(t, device.Start(), ErrAlreadyStarted)
+
+	err := device.PressButton()
+
+	assert.NoError(t, err)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOn, device.GetPower())
+
+	// Wait for the stat/sim2/POWER of the button press, so it is not taken as the response of the toggle
+	assert.Eventually(t, func() bool {
+		state, _ := sonoffServer.Device("sim2")
+
+		return state.State.Power == sonoff.TasmotaCmndTopicPowerValueOn
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = sonoffServer.PowerToggle("sim2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOff, device.GetPower())
+
+	err = device.Reboot(10 * time.Millisecond)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sim2", receive(t, sonoffServer.TeleDisconnected()))
+	assert.Equal(t, "sim2", receive(t, sonoffServer.TeleConnected()))
+
+	statusOne, err := sonoffServer.StatusOne("sim2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, statusOne.BootCount)
+	assert.Equal(t, RestartReasonSoftware, statusOne.RestartReason)
+
+	device.SetFailureRate(1)
+
+	_, err = sonoffServer.StatusTwo("sim2")
+
+	assert.ErrorIs(t, err, sonoff.ErrTimeout)
+
+	assert.NoError(t, device.Stop())
+	assert.Equal(t, "sim2", receive(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, sonoffServer.Close())
+}
+
+func TestDevice_StopWhileConnecting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	assert.NoError(t, err)
+
+	// The broker accepts the connection but never answers the CONNECT
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	device := NewDevice("sim4", listener.Addr().String())
+	started := make(chan error, 1)
+
+	go func() {
+		started <- device.Start()
+	}()
+
+	conn := <-accepted
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- device.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stop waited for the connection attempt")
+	}
+
+	assert.NoError(t, conn.Close())
+	assert.NoError(t, listener.Close())
+	assert.Error(t, <-started)
+	assert.Equal(t, false, device.Online())
+	assert.ErrorIs(t, device.Stop(), ErrNotStarted)
+}
+
+func TestDevice_StopDuringReboot(t *testing.T) {
+	sonoffServer, address := newServer(t)
+
+	serve(sonoffServer)
+
+	device := NewDevice("sim5", address)
+
+	start(t, device)
+
+	assert.Equal(t, "sim5", receive(t, sonoffServer.TeleConnected()))
+
+	rebooted := make(chan error, 1)
+
+	go func() {
+		rebooted <- device.Reboot(time.Minute)
+	}()
+
+	assert.Equal(t, "sim5", receive(t, sonoffServer.TeleDisconnected()))
+	assert.NoError(t, device.Stop())
+
+	select {
+	case err := <-rebooted:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Reboot did not end with Stop")
+	}
+
+	assert.Equal(t, false, device.Online())
+	assert.NoError(t, sonoffServer.Close())
+}
@@ -0,0 +1,561 @@
+// Package sonofftest provides an in-memory fake of the sonoff.Controller interface for the tests of applications.
+// Devices are scripted with SetDevice, Connect and Disconnect; latency and failures can be set per device.
+// Commands never touch an MQTT broker and are recorded for assertions.
+package sonofftest
+
+import (
+	"context"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultChannelSize is the buffer size of the TeleConnected and TeleDisconnected channels of the fake.
+// IDs that do not fit into the buffer are dropped, so tests that do not read the channels never block.
+const DefaultChannelSize = 64
+
+// FakeDevice is the scripted state of a device of the fake.
+// Status is returned by the Status methods, with the power state filled in from Power.
+type FakeDevice struct {
+	Online bool
+
+	// Power is ON or OFF.
+	Power string
+
+	// PhysicalButton reports whether the physical button is enabled (SetOption73 OFF).
+	PhysicalButton bool
+
+	Status sonoff.Status
+
+	// Latency delays every command to the device.
+	Latency time.Duration
+
+	// Err makes every command to the device fail. It is wrapped in a *sonoff.CommandError.
+	Err error
+}
+
+// Command is a command sent to the fake.
+type Command struct {
+	DeviceID string
+	Command  string
+	Payload  string
+}
+
+// Fake is an in-memory implementation of sonoff.Controller. Use NewFake to create one.
+type Fake struct {
+	mutex        sync.Mutex
+	devices      map[string]*FakeDevice
+	lastSeen     map[string]time.Time
+	commands     []Command
+	handlers     []sonoff.DeviceEventFn
+	connected    chan string
+	disconnected chan string
+	closed       bool
+}
+
+var _ sonoff.Controller = (*Fake)(nil)
+
+// NewFake creates a fake without any device.
+func NewFake() *Fake {
+	return &Fake{
+		devices:      make(map[string]*FakeDevice),
+		lastSeen:     make(map[string]time.Time),
+		connected:    make(chan string, DefaultChannelSize),
+		disconnected: make(chan string, DefaultChannelSize),
+	}
+}
+
+// SetDevice adds the device or replaces its scripted state, without reporting a connection.
+func (fake *Fake) SetDevice(id string, device FakeDevice) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.devices[id] = &device
+	fake.lastSeen[id] = time.Now()
+}
+
+// Connect marks the device as online (adding it when needed), sends its ID to TeleConnected and emits DeviceEventConnected.
+func (fake *Fake) Connect(id string) {
+	fake.setOnline(id, true, sonoff.DeviceEventConnected, fake.connected)
+}
+
+// Disconnect marks the device as offline, sends its ID to TeleDisconnected and emits DeviceEventDisconnected.
+func (fake *Fake) Disconnect(id string) {
+	fake.setOnline(id, false, sonoff.DeviceEventDisconnected, fake.disconnected)
+}
+
+// SetLatency delays every command to the device.
+func (fake *Fake) SetLatency(id string, latency time.Duration) {
+	fake.update(id, func(device *FakeDevice) {
+		device.Latency = latency
+	})
+}
+
+// Fail makes every command to the device fail with the error. A nil error makes the commands succeed again.
+func (fake *Fake) Fail(id string, err error) {
+	fake.update(id, func(device *FakeDevice) {
+		device.Err = err
+	})
+}
+
+// Commands returns the commands sent to the fake in the order they were sent, including failed ones.
+func (fake *Fake) Commands() []Command {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return slices.Clone(fake.commands)
+}
+
+// Serve does nothing, since the fake does not need a broker.
+func (fake *Fake) Serve() error {
+	return nil
+}
+
+// Close closes the channels; commands sent afterwards fail with sonoff.ErrClosed.
+func (fake *Fake) Close() error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if !fake.closed {
+		fake.closed = true
+
+		close(fake.connected)
+		close(fake.disconnected)
+	}
+
+	return nil
+}
+
+// TeleConnected returns the channel that receives the IDs of connected devices.
+func (fake *Fake) TeleConnected() <-chan string {
+	return fake.connected
+}
+
+// TeleDisconnected returns the channel that receives the IDs of disconnected devices.
+func (fake *Fake) TeleDisconnected() <-chan string {
+	return fake.disconnected
+}
+
+// Device returns a snapshot of the device.
+func (fake *Fake) Device(id string) (sonoff.Device, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	device, ok := fake.devices[id]
+
+	if !ok {
+		return sonoff.Device{}, false
+	}
+
+	return fake.snapshot(id, device), true
+}
+
+// Devices returns snapshots of all devices sorted by ID.
+func (fake *Fake) Devices() []sonoff.Device {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	result := make([]sonoff.Device, 0, len(fake.devices))
+
+	for id, device := range fake.devices {
+		result = append(result, fake.snapshot(id, device))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// OnDeviceEvent registers a handler for the connections, disconnections and power changes of the devices.
+// It returns a function that removes the handler.
+func (fake *Fake) OnDeviceEvent(handler sonoff.DeviceEventFn) func() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	index := len(fake.handlers)
+	fake.handlers = append(fake.handlers, handler)
+
+	return func() {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+
+		fake.handlers[index] = nil
+	}
+}
+
+// Discover returns the IDs of the online devices.
+func (fake *Fake) Discover() ([]string, error) {
+	result := make([]string, 0)
+
+	for _, device := range fake.Devices() {
+		if device.Online {
+			result = append(result, device.ID)
+		}
+	}
+
+	return result, nil
+}
+
+// Status returns the scripted STATUS 0 of the device.
+func (fake *Fake) Status(id string) (*sonoff.Status, error) {
+	return fake.StatusContext(context.Background(), id)
+}
+
+// StatusContext is like Status but uses the context for cancellation.
+func (fake *Fake) StatusContext(ctx context.Context, id string) (*sonoff.Status, error) {
+	return status(ctx, fake, id, sonoff.TasmotaCmndTopicStatusAll, func(status *sonoff.Status) *sonoff.Status {
+		return status
+	})
+}
+
+// StatusOne returns the scripted STATUS 1 of the device.
+func (fake *Fake) StatusOne(id string) (*sonoff.StatusOne, error) {
+	return fake.StatusOneContext(context.Background(), id)
+}
+
+// StatusOneContext is like StatusOne but uses the context for cancellation.
+func (fake *Fake) StatusOneContext(ctx context.Context, id string) (*sonoff.StatusOne, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusOne, func(status *sonoff.Status) *sonoff.StatusOne {
+		return &status.StatusPRM
+	})
+}
+
+// StatusTwo returns the scripted STATUS 2 of the device.
+func (fake *Fake) StatusTwo(id string) (*sonoff.StatusTwo, error) {
+	return fake.StatusTwoContext(context.Background(), id)
+}
+
+// StatusTwoContext is like StatusTwo but uses the context for cancellation.
+func (fake *Fake) StatusTwoContext(ctx context.Context, id string) (*sonoff.StatusTwo, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusTwo, func(status *sonoff.Status) *sonoff.StatusTwo {
+		return &status.StatusFWR
+	})
+}
+
+// StatusThree returns the scripted STATUS 3 of the device.
+func (fake *Fake) StatusThree(id string) (*sonoff.StatusThree, error) {
+	return fake.StatusThreeContext(context.Background(), id)
+}
+
+// StatusThreeContext is like StatusThree but uses the context for cancellation.
+func (fake *Fake) StatusThreeContext(ctx context.Context, id string) (*sonoff.StatusThree, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusThree, func(status *sonoff.Status) *sonoff.StatusThree {
+		return &status.StatusLOG
+	})
+}
+
+// StatusFour returns the scripted STATUS 4 of the device.
+func (fake *Fake) StatusFour(id string) (*sonoff.StatusFour, error) {
+	return fake.StatusFourContext(context.Background(), id)
+}
+
+// StatusFourContext is like StatusFour but uses the context for cancellation.
+func (fake *Fake) StatusFourContext(ctx context.Context, id string) (*sonoff.StatusFour, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusFour, func(status *sonoff.Status) *sonoff.StatusFour {
+		return &status.StatusMEM
+	})
+}
+
+// StatusFive returns the scripted STATUS 5 of the device.
+func (fake *Fake) StatusFive(id string) (*sonoff.StatusFive, error) {
+	return fake.StatusFiveContext(context.Background(), id)
+}
+
+// StatusFiveContext is like StatusFive but uses the context for cancellation.
+func (fake *Fake) StatusFiveContext(ctx context.Context, id string) (*sonoff.StatusFive, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusFive, func(status *sonoff.Status) *sonoff.StatusFive {
+		return &status.StatusNET
+	})
+}
+
+// StatusSix returns the scripted STATUS 6 of the device.
+func (fake *Fake) StatusSix(id string) (*sonoff.StatusSix, error) {
+	return fake.StatusSixContext(context.Background(), id)
+}
+
+// StatusSixContext is like StatusSix but uses the context for cancellation.
+func (fake *Fake) StatusSixContext(ctx context.Context, id string) (*sonoff.StatusSix, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusSix, func(status *sonoff.Status) *sonoff.StatusSix {
+		return &status.StatusMQT
+	})
+}
+
+// StatusSeven returns the scripted STATUS 7 of the device.
+func (fake *Fake) StatusSeven(id string) (*sonoff.StatusSeven, error) {
+	return fake.StatusSevenContext(context.Background(), id)
+}
+
+// StatusSevenContext is like StatusSeven but uses the context for cancellation.
+func (fake *Fake) StatusSevenContext(ctx context.Context, id string) (*sonoff.StatusSeven, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusSeven, func(status *sonoff.Status) *sonoff.StatusSeven {
+		return &status.StatusTIM
+	})
+}
+
+// StatusEight returns the scripted STATUS 8 of the device.
+func (fake *Fake) StatusEight(id string) (*sonoff.StatusEight, error) {
+	return fake.StatusEightContext(context.Background(), id)
+}
+
+// StatusEightContext is like StatusEight but uses the context for cancellation.
+func (fake *Fake) StatusEightContext(ctx context.Context, id string) (*sonoff.StatusEight, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusEight, func(status *sonoff.Status) *sonoff.StatusEight {
+		return &status.StatusSNS
+	})
+}
+
+// StatusEleven returns the scripted STATUS 11 of the device.
+func (fake *Fake) StatusEleven(id string) (*sonoff.StatusEleven, error) {
+	return fake.StatusElevenContext(context.Background(), id)
+}
+
+// StatusElevenContext is like StatusEleven but uses the context for cancellation.
+func (fake *Fake) StatusElevenContext(ctx context.Context, id string) (*sonoff.StatusEleven, error) {
+	return status(ctx, fake, id, sonoff.TasmotaStatTopicStatusEleven, func(status *sonoff.Status) *sonoff.StatusEleven {
+		return &status.StatusSTS
+	})
+}
+
+// StatusPhysicalButton returns whether the physical button of the device is enabled.
+func (fake *Fake) StatusPhysicalButton(id string) (bool, error) {
+	return fake.StatusPhysicalButtonContext(context.Background(), id)
+}
+
+// StatusPhysicalButtonContext is like StatusPhysicalButton but uses the context for cancellation.
+func (fake *Fake) StatusPhysicalButtonContext(ctx context.Context, id string) (bool, error) {
+	var enabled bool
+
+	err := fake.send(ctx, id, sonoff.TasmotaCmndTopicPhysicalButton, "", func(device *FakeDevice) {
+		enabled = device.PhysicalButton
+	})
+
+	return enabled, err
+}
+
+// PowerOn turns the device on.
+func (fake *Fake) PowerOn(id string) error {
+	return fake.PowerOnContext(context.Background(), id)
+}
+
+// PowerOnContext is like PowerOn but uses the context for cancellation.
+func (fake *Fake) PowerOnContext(ctx context.Context, id string) error {
+	return fake.power(ctx, id, sonoff.TasmotaCmndTopicPowerValueOn)
+}
+
+// PowerOff turns the device off.
+func (fake *Fake) PowerOff(id string) error {
+	return fake.PowerOffContext(context.Background(), id)
+}
+
+// PowerOffContext is like PowerOff but uses the context for cancellation.
+func (fake *Fake) PowerOffContext(ctx context.Context, id string) error {
+	return fake.power(ctx, id, sonoff.TasmotaCmndTopicPowerValueOff)
+}
+
+// PowerToggle toggles the power state of the device.
+func (fake *Fake) PowerToggle(id string) error {
+	return fake.PowerToggleContext(context.Background(), id)
+}
+
+// PowerToggleContext is like PowerToggle but uses the context for cancellation.
+func (fake *Fake) PowerToggleContext(ctx context.Context, id string) error {
+	return fake.power(ctx, id, sonoff.TasmotaCmndTopicPowerValueToggle)
+}
+
+// PhysicalButtonOn enables the physical button of the device.
+func (fake *Fake) PhysicalButtonOn(id string) error {
+	return fake.PhysicalButtonOnContext(context.Background(), id)
+}
+
+// PhysicalButtonOnContext is like PhysicalButtonOn but uses the context for cancellation.
+func (fake *Fake) PhysicalButtonOnContext(ctx context.Context, id string) error {
+	return fake.send(ctx, id, sonoff.TasmotaCmndTopicPhysicalButton, sonoff.TasmotaCmndTopicPhysicalButtonValueOn, func(device *FakeDevice) {
+		device.PhysicalButton = true
+	})
+}
+
+// PhysicalButtonOff disables the physical button of the device.
+func (fake *Fake) PhysicalButtonOff(id string) error {
+	return fake.PhysicalButtonOffContext(context.Background(), id)
+}
+
+// PhysicalButtonOffContext is like PhysicalButtonOff but uses the context for cancellation.
+func (fake *Fake) PhysicalButtonOffContext(ctx context.Context, id string) error {
+	return fake.send(ctx, id, sonoff.TasmotaCmndTopicPhysicalButton, sonoff.TasmotaCmndTopicPhysicalButtonValueOff, func(device *FakeDevice) {
+		device.PhysicalButton = false
+	})
+}
+
+// status sends a status command and returns the part of the scripted status selected by field.
+func status[T any](ctx context.Context, fake *Fake, id string, command string, field func(status *sonoff.Status) *T) (*T, error) {
+	var result *T
+
+	err := fake.send(ctx, id, command, "", func(device *FakeDevice) {
+		current := device.Status
+
+		current.StatusSTS.POWER = device.Power
+		current.Status.Power = "0"
+
+		if device.Power == sonoff.TasmotaCmndTopicPowerValueOn {
+			current.Status.Power = "1"
+		}
+
+		result = field(&current)
+	})
+
+	return result, err
+}
+
+// power sends a POWER command and emits DeviceEventStateUpdated.
+func (fake *Fake) power(ctx context.Context, id string, value string) error {
+	err := fake.send(ctx, id, sonoff.TasmotaCmndTopicPower, value, func(device *FakeDevice) {
+		switch {
+		case value != sonoff.TasmotaCmndTopicPowerValueToggle:
+			device.Power = value
+		case device.Power == sonoff.TasmotaCmndTopicPowerValueOn:
+			device.Power = sonoff.TasmotaCmndTopicPowerValueOff
+		default:
+			device.Power = sonoff.TasmotaCmndTopicPowerValueOn
+		}
+	})
+
+	if err == nil {
+		fake.emit(id, sonoff.DeviceEventStateUpdated)
+	}
+
+	return err
+}
+
+// send records the command, waits for the latency of the device and applies the command when it does not fail.
+// Unknown devices time out and offline devices fail with sonoff.ErrDeviceOffline, like SonoffBasicR2 does.
+func (fake *Fake) send(ctx context.Context, id string, command string, payload string, apply func(device *FakeDevice)) error {
+	fake.mutex.Lock()
+
+	fake.commands = append(fake.commands, Command{DeviceID: id, Command: command, Payload: payload})
+
+	closed := fake.closed
+	device, ok := fake.devices[id]
+
+	var latency time.Duration
+
+	if ok {
+		latency = device.Latency
+	}
+
+	fake.mutex.Unlock()
+
+	switch {
+	case closed:
+		return &sonoff.CommandError{DeviceID: id, Command: command, Err: sonoff.ErrClosed}
+	case !ok:
+		return &sonoff.CommandError{DeviceID: id, Command: command, Err: sonoff.ErrTimeout}
+	}
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+
+			return &sonoff.CommandError{DeviceID: id, Command: command, Err: ctx.Err()}
+		}
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	switch {
+	case device.Err != nil:
+		return &sonoff.CommandError{DeviceID: id, Command: command, Err: device.Err}
+	case !device.Online:
+		return &sonoff.CommandError{DeviceID: id, Command: command, Err: sonoff.ErrDeviceOffline}
+	}
+
+	apply(device)
+
+	fake.lastSeen[id] = time.Now()
+
+	return nil
+}
+
+// update changes the scripted state of the device, adding it when needed.
+func (fake *Fake) update(id string, change func(device *FakeDevice)) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	device, ok := fake.devices[id]
+
+	if !ok {
+		device = &FakeDevice{}
+		fake.devices[id] = device
+	}
+
+	change(device)
+}
+
+// setOnline changes the availability of the device, reports it on the channel and emits the event.
+func (fake *Fake) setOnline(id string, online bool, eventType sonoff.DeviceEventType, channel chan string) {
+	fake.update(id, func(device *FakeDevice) {
+		device.Online = online
+	})
+
+	fake.mutex.Lock()
+	fake.lastSeen[id] = time.Now()
+	fake.mutex.Unlock()
+
+	fake.emit(id, eventType)
+
+	// Sending under the lock keeps Close from closing the channel in between, and a full buffer must not block the caller
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if fake.closed {
+		return
+	}
+
+	select {
+	case channel <- id:
+	default:
+	}
+}
+
+// emit calls the event handlers with a snapshot of the device.
+func (fake *Fake) emit(id string, eventType sonoff.DeviceEventType) {
+	device, _ := fake.Device(id)
+
+	fake.mutex.Lock()
+	handlers := slices.Clone(fake.handlers)
+	fake.mutex.Unlock()
+
+	event := sonoff.DeviceEvent{Type: eventType, Time: time.Now(), Device: device}
+
+	for _, handler := range handlers {
+		if handler != nil {
+			handler(event)
+		}
+	}
+}
+
+// snapshot converts the scripted state of the device into a sonoff.Device.
+func (fake *Fake) snapshot(id string, device *FakeDevice) sonoff.Device {
+	return sonoff.Device{
+		ID:       id,
+		Online:   device.Online,
+		LastSeen: fake.lastSeen[id],
+		State: sonoff.DeviceState{
+			Power:     device.Power,
+			RSSI:      device.Status.StatusSTS.Wifi.RSSI,
+			Signal:    device.Status.StatusSTS.Wifi.Signal,
+			Heap:      device.Status.StatusSTS.Heap,
+			UptimeSec: device.Status.StatusSTS.UptimeSec,
+			BootCount: device.Status.StatusPRM.BootCount,
+			UpdatedAt: fake.lastSeen[id],
+		},
+	}
+}
@@ -0,0 +1,188 @@
+package sonofftest
+
+import (
+	"context"
+	"errors"
+	sonoff "github.com/fromsi/mqtt_sonoff_basic_r2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFake_Power(t *testing.T) {
+	fake := NewFake()
+
+	events := make([]sonoff.DeviceEventType, 0)
+
+	fake.OnDeviceEvent(func(event sonoff.DeviceEvent) {
+		events = append(events, event.Type)
+	})
+
+	fake.SetDevice("1", FakeDevice{Power: sonoff.TasmotaCmndTopicPowerValueOff})
+	fake.Connect("1")
+
+	assert.Equal(t, "1", <-fake.TeleConnected())
+
+	err := fake.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	status, err := fake.StatusEleven("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOn, status.POWER)
+
+	err = fake.PowerToggle("1")
+
+	assert.NoError(t, err)
+
+	statusAll, err := fake.Status("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "0", statusAll.Status.Power)
+
+	device, ok := fake.Device("1")
+
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, device.Online)
+	assert.Equal(t, sonoff.TasmotaCmndTopicPowerValueOff, device.State.Power)
+
+	assert.Equal(t, []sonoff.DeviceEventType{
+		sonoff.DeviceEventConnected,
+		sonoff.DeviceEventStateUpdated,
+		sonoff.DeviceEventStateUpdated,
+	}, events)
+
+	assert.Equal(t, []Command{
+		{DeviceID: "1", Command: sonoff.TasmotaCmndTopicPower, Payload: sonoff.TasmotaCmndTopicPowerValueOn},
+		{DeviceID: "1", Command: sonoff.TasmotaStatTopicStatusEleven},
+		{DeviceID: "1", Command: sonoff.TasmotaCmndTopicPower, Payload: sonoff.TasmotaCmndTopicPowerValueToggle},
+		{DeviceID: "1", Command: sonoff.TasmotaCmndTopicStatusAll},
+	}, fake.Commands())
+}
+
+func TestFake_PhysicalButton(t *testing.T) {
+	fake := NewFake()
+
+	fake.Connect("1")
+
+	err := fake.PhysicalButtonOn("1")
+
+	assert.NoError(t, err)
+
+	enabled, err := fake.StatusPhysicalButton("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, enabled)
+
+	err = fake.PhysicalButtonOff("1")
+
+	assert.NoError(t, err)
+
+	enabled, err = fake.StatusPhysicalButton("1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, false, enabled)
+}
+
+func TestFake_Errors(t *testing.T) {
+	fake := NewFake()
+
+	_, err := fake.StatusOne("unknown")
+
+	assert.ErrorIs(t, err, sonoff.ErrTimeout)
+
+	fake.SetDevice("1", FakeDevice{})
+
+	err = fake.PowerOn("1")
+
+	assert.ErrorIs(t, err, sonoff.ErrDeviceOffline)
+
+	fake.Connect("1")
+	fake.Fail("1", sonoff.ErrPublishFailed)
+
+	err = fake.PowerOn("1")
+
+	var commandError *sonoff.CommandError
+
+	assert.ErrorIs(t, err, sonoff.ErrPublishFailed)
+	assert.Equal(t, true, errors.As(err, &commandError))
+	assert.Equal(t, "1", commandError.DeviceID)
+
+	fake.Fail("1", nil)
+
+	err = fake.PowerOn("1")
+
+	assert.NoError(t, err)
+
+	fake.Disconnect("1")
+
+	assert.Equal(t, "1", <-fake.TeleDisconnected())
+
+	ids, err := fake.Discover()
+
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	err = fake.Close()
+
+	assert.NoError(t, err)
+
+	err = fake.Close()
+
+	assert.NoError(t, err)
+
+	err = fake.PowerOn("1")
+
+	assert.ErrorIs(t, err, sonoff.ErrClosed)
+}
+
+func TestFake_Latency(t *testing.T) {
+	fake := NewFake()
+
+	fake.Connect("1")
+	fake.SetLatency("1", time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := fake.StatusTwoContext(ctx, "1")
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	fake.SetLatency("1", time.Millisecond)
+
+	_, err = fake.StatusTwo("1")
+
+	assert.NoError(t, err)
+}
+
+func TestFake_Channels(t *testing.T) {
+	fake := NewFake()
+
+	// Nobody reads the channels, the IDs beyond the buffer are dropped
+	for i := 0; i < DefaultChannelSize+1; i++ {
+		fake.Connect("1")
+	}
+
+	assert.Equal(t, DefaultChannelSize, len(fake.TeleConnected()))
+
+	// Connecting while the fake is closed neither panics nor blocks
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			fake.Disconnect("1")
+		}
+	}()
+
+	assert.NoError(t, fake.Close())
+
+	<-done
+
+	assert.NotPanics(t, func() {
+		fake.Connect("1")
+	})
+}
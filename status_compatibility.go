@@ -0,0 +1,169 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Tasmota renamed some fields and changed their types between releases. The decoders below accept the payloads of
+// Tasmota 8.x through 14.x and map them to the current field names and types. The payloads of every release are kept
+// in testdata/tasmota and are checked by the golden tests.
+
+// tasmotaFlashModes are the names of the flash modes that Tasmota up to 11.x reports as numbers.
+var tasmotaFlashModes = []string{"QIO", "QOUT", "DIO", "DOUT"}
+
+// tasmotaPower is the relay bitmask of STATUS 0, a number up to Tasmota 12.x and a bit string since Tasmota 13.0.
+type tasmotaPower string
+
+// UnmarshalJSON accepts the bit string and converts the number into it.
+func (power *tasmotaPower) UnmarshalJSON(value []byte) error {
+	var text string
+
+	if err := json.Unmarshal(value, &text); err == nil {
+		*power = tasmotaPower(text)
+
+		return nil
+	}
+
+	var number uint64
+
+	if err := json.Unmarshal(value, &number); err != nil {
+		return err
+	}
+
+	*power = tasmotaPower(strconv.FormatUint(number, 2))
+
+	return nil
+}
+
+// tasmotaFlashMode is the flash mode of STATUS 4, a number up to Tasmota 11.x and a name since Tasmota 12.0.
+type tasmotaFlashMode string
+
+// UnmarshalJSON accepts the name and converts the known numbers into it.
+func (flashMode *tasmotaFlashMode) UnmarshalJSON(value []byte) error {
+	var text string
+
+	if err := json.Unmarshal(value, &text); err == nil {
+		*flashMode = tasmotaFlashMode(text)
+
+		return nil
+	}
+
+	var number int
+
+	if err := json.Unmarshal(value, &number); err != nil {
+		return err
+	}
+
+	if number >= 0 && number < len(tasmotaFlashModes) {
+		*flashMode = tasmotaFlashMode(tasmotaFlashModes[number])
+	} else {
+		*flashMode = tasmotaFlashMode(strconv.Itoa(number))
+	}
+
+	return nil
+}
+
+// tasmotaUTC is the UTC time of STATUS 7, without a time zone up to Tasmota 9.x and with the "Z" designator since Tasmota 10.0.
+type tasmotaUTC time.Time
+
+// UnmarshalJSON accepts RFC 3339 and the Tasmota format without a time zone, which is taken as UTC.
+func (utc *tasmotaUTC) UnmarshalJSON(value []byte) error {
+	var t time.Time
+
+	if err := t.UnmarshalJSON(value); err == nil {
+		*utc = tasmotaUTC(t)
+
+		return nil
+	}
+
+	var tasmotaTime TasmotaTime
+
+	if err := tasmotaTime.UnmarshalJSON(value); err != nil {
+		return err
+	}
+
+	*utc = tasmotaUTC(tasmotaTime)
+
+	return nil
+}
+
+// UnmarshalJSON decodes the Status of STATUS 0, accepting the numeric Power of Tasmota up to 12.x.
+func (statusZero *StatusZero) UnmarshalJSON(data []byte) error {
+	type plainStatusZero StatusZero
+
+	var value struct {
+		plainStatusZero
+		Power tasmotaPower `json:"Power"`
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*statusZero = StatusZero(value.plainStatusZero)
+	statusZero.Power = string(value.Power)
+
+	return nil
+}
+
+// UnmarshalJSON decodes STATUS 4, accepting the numeric FlashMode of Tasmota up to 11.x.
+func (statusFour *StatusFour) UnmarshalJSON(data []byte) error {
+	type plainStatusFour StatusFour
+
+	var value struct {
+		plainStatusFour
+		FlashMode tasmotaFlashMode `json:"FlashMode"`
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*statusFour = StatusFour(value.plainStatusFour)
+	statusFour.FlashMode = string(value.FlashMode)
+
+	return nil
+}
+
+// UnmarshalJSON decodes STATUS 5, mapping the single DNSServer of Tasmota up to 10.x to DNSServer1.
+func (statusFive *StatusFive) UnmarshalJSON(data []byte) error {
+	type plainStatusFive StatusFive
+
+	var value struct {
+		plainStatusFive
+		DNSServer string `json:"DNSServer"`
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*statusFive = StatusFive(value.plainStatusFive)
+
+	if statusFive.DNSServer1 == "" {
+		statusFive.DNSServer1 = value.DNSServer
+	}
+
+	return nil
+}
+
+// UnmarshalJSON decodes STATUS 7, accepting the UTC time without a time zone of Tasmota up to 9.x.
+func (statusSeven *StatusSeven) UnmarshalJSON(data []byte) error {
+	type plainStatusSeven StatusSeven
+
+	var value struct {
+		plainStatusSeven
+		UTC tasmotaUTC `json:"UTC"`
+	}
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	*statusSeven = StatusSeven(value.plainStatusSeven)
+	statusSeven.UTC = time.Time(value.UTC)
+
+	return nil
+}
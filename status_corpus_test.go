@@ -0,0 +1,294 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The corpus in testdata/tasmota holds the payloads of a Sonoff Basic R2 for several Tasmota releases, one directory per
+// version. The golden files in <version>/golden are the decoded payloads, regenerate them with: go test -run Corpus -update
+var updateGolden = flag.Bool("update", false, "update the golden files of the Tasmota corpus")
+
+const tasmotaCorpusPath = "testdata/tasmota"
+
+// optionalCorpusFiles are missing from the releases that do not support them (native discovery came with Tasmota 9.2).
+var optionalCorpusFiles = map[string]bool{
+	"DISCOVERY.json": true,
+}
+
+// corpusDecoders maps the payload files to the function that decodes them.
+var corpusDecoders = map[string]func([]byte) (any, error){
+	"STATUS0.json":   decodeCorpusFile(UnmarshalStatus),
+	"STATUS.json":    decodeCorpusFile(UnmarshalStatusZero),
+	"STATUS1.json":   decodeCorpusFile(UnmarshalStatusOne),
+	"STATUS2.json":   decodeCorpusFile(UnmarshalStatusTwo),
+	"STATUS3.json":   decodeCorpusFile(UnmarshalStatusThree),
+	"STATUS4.json":   decodeCorpusFile(UnmarshalStatusFour),
+	"STATUS5.json":   decodeCorpusFile(UnmarshalStatusFive),
+	"STATUS6.json":   decodeCorpusFile(UnmarshalStatusSix),
+	"STATUS7.json":   decodeCorpusFile(UnmarshalStatusSeven),
+	"STATUS8.json":   decodeCorpusFile(UnmarshalStatusEight),
+	"STATUS10.json":  decodeCorpusFile(UnmarshalStatusEight),
+	"STATUS11.json":  decodeCorpusFile(UnmarshalStatusEleven),
+	"STATE.json":     decodeCorpusFile(UnmarshalTeleState),
+	"DISCOVERY.json": decodeCorpusFile(UnmarshalDiscoveryConfig),
+}
+
+func decodeCorpusFile[T any](unmarshal func([]byte) (*T, error)) func([]byte) (any, error) {
+	return func(data []byte) (any, error) {
+		return unmarshal(data)
+	}
+}
+
+func getCorpusVersions(t *testing.T) []string {
+	entries, err := os.ReadDir(tasmotaCorpusPath)
+
+	require.NoError(t, err)
+
+	versions := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+
+	return versions
+}
+
+func readCorpusFile(t *testing.T, version string, name string) []byte {
+	data, err := os.ReadFile(filepath.Join(tasmotaCorpusPath, version, name))
+
+	require.NoError(t, err)
+
+	return bytes.TrimSpace(data)
+}
+
+func TestCorpus_Versions(t *testing.T) {
+	majors := make([]int, 0)
+
+	for _, version := range getCorpusVersions(t) {
+		major, err := strconv.Atoi(strings.Split(version, ".")[0])
+
+		require.NoError(t, err)
+
+		majors = append(majors, major)
+	}
+
+	sort.Ints(majors)
+
+	assert.Equal(t, []int{8, 9, 10, 11, 12, 13, 14}, majors)
+}
+
+func TestCorpus_Golden(t *testing.T) {
+	names := make([]string, 0, len(corpusDecoders))
+
+	for name := range corpusDecoders {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, version := range getCorpusVersions(t) {
+		t.Run(version, func(t *testing.T) {
+			for _, name := range names {
+				path := filepath.Join(tasmotaCorpusPath, version, name)
+				data, err := os.ReadFile(path)
+
+				if os.IsNotExist(err) && optionalCorpusFiles[name] {
+					continue
+				}
+
+				require.NoError(t, err)
+
+				result, err := corpusDecoders[name](data)
+
+				if !assert.NoError(t, err, path) {
+					continue
+				}
+
+				actual, err := json.MarshalIndent(result, "", "  ")
+
+				require.NoError(t, err)
+
+				actual = append(actual, '\n')
+				goldenPath := filepath.Join(tasmotaCorpusPath, version, "golden", name)
+
+				if *updateGolden {
+					require.NoError(t, os.MkdirAll(filepath.Dir(goldenPath), 0o755))
+					require.NoError(t, os.WriteFile(goldenPath, actual, 0o644))
+				}
+
+				expected, err := os.ReadFile(goldenPath)
+
+				require.NoError(t, err)
+				assert.Equal(t, string(expected), string(actual), goldenPath)
+			}
+		})
+	}
+}
+
+func TestCorpus_Compatibility(t *testing.T) {
+	for _, version := range getCorpusVersions(t) {
+		t.Run(version, func(t *testing.T) {
+			status, err := UnmarshalStatus(readCorpusFile(t, version, "STATUS0.json"))
+
+			require.NoError(t, err)
+
+			// Version dependent fields are mapped to the current names and types
+			assert.True(t, strings.HasPrefix(status.StatusFWR.Version, version+"("), status.StatusFWR.Version)
+			assert.Equal(t, map[string]string{"ON": "1", "OFF": "0"}[status.StatusSTS.POWER], status.Status.Power)
+			assert.Equal(t, "DOUT", status.StatusMEM.FlashMode)
+			assert.Equal(t, "192.168.1.1", status.StatusNET.DNSServer1)
+			assert.Contains(t, []time.Duration{time.Hour, 2 * time.Hour}, status.StatusTIM.Local.ToTime().Sub(status.StatusTIM.UTC))
+			assert.Equal(t, time.UTC, status.StatusTIM.UTC.Location())
+
+			// The single status commands return the parts of STATUS 0
+			statusZero, err := UnmarshalStatusZero(readCorpusFile(t, version, "STATUS.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.Status, *statusZero)
+
+			statusOne, err := UnmarshalStatusOne(readCorpusFile(t, version, "STATUS1.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusPRM, *statusOne)
+
+			statusTwo, err := UnmarshalStatusTwo(readCorpusFile(t, version, "STATUS2.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusFWR, *statusTwo)
+
+			statusThree, err := UnmarshalStatusThree(readCorpusFile(t, version, "STATUS3.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusLOG, *statusThree)
+
+			statusFour, err := UnmarshalStatusFour(readCorpusFile(t, version, "STATUS4.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusMEM, *statusFour)
+
+			statusFive, err := UnmarshalStatusFive(readCorpusFile(t, version, "STATUS5.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusNET, *statusFive)
+
+			statusSix, err := UnmarshalStatusSix(readCorpusFile(t, version, "STATUS6.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusMQT, *statusSix)
+
+			statusSeven, err := UnmarshalStatusSeven(readCorpusFile(t, version, "STATUS7.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusTIM, *statusSeven)
+
+			statusEight, err := UnmarshalStatusEight(readCorpusFile(t, version, "STATUS8.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusSNS, *statusEight)
+
+			statusTen, err := UnmarshalStatusEight(readCorpusFile(t, version, "STATUS10.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusSNS, *statusTen)
+
+			statusEleven, err := UnmarshalStatusEleven(readCorpusFile(t, version, "STATUS11.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusSTS, *statusEleven)
+
+			state, err := UnmarshalTeleState(readCorpusFile(t, version, "STATE.json"))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusSTS, *state)
+
+			// RESULT and LWT payloads
+			power, err := decodePower(string(readCorpusFile(t, version, "RESULT_POWER.json")))
+
+			assert.NoError(t, err)
+			assert.Equal(t, status.StatusSTS.POWER, power)
+
+			physicalButton, err := decodePhysicalButton(string(readCorpusFile(t, version, "RESULT_SETOPTION73.json")))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "OFF", physicalButton)
+
+			assert.Equal(t, TasmotaTeleTopicLWTResponseOnline, string(readCorpusFile(t, version, "LWT_ONLINE.txt")))
+			assert.Equal(t, TasmotaTeleTopicLWTResponseOffline, string(readCorpusFile(t, version, "LWT_OFFLINE.txt")))
+		})
+	}
+}
+
+func TestCorpus_Discovery(t *testing.T) {
+	for _, version := range getCorpusVersions(t) {
+		data, err := os.ReadFile(filepath.Join(tasmotaCorpusPath, version, "DISCOVERY.json"))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		require.NoError(t, err)
+
+		config, err := UnmarshalDiscoveryConfig(data)
+
+		assert.NoError(t, err)
+		assert.Equal(t, version, config.SoftwareVersion)
+		assert.Equal(t, 1, config.RelayCount())
+		assert.Equal(t, true, config.IsDefaultLayout())
+		assert.Equal(t, TasmotaTeleTopicLWTResponseOnline, config.OnlinePayload)
+		assert.Equal(t, TasmotaTeleTopicLWTResponseOffline, config.OfflinePayload)
+	}
+}
+
+func TestCorpus_TypeChanges(t *testing.T) {
+	var statusZero StatusZero
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"Power":1}`), &statusZero))
+	assert.Equal(t, "1", statusZero.Power)
+	assert.NoError(t, json.Unmarshal([]byte(`{"Power":"0"}`), &statusZero))
+	assert.Equal(t, "0", statusZero.Power)
+	assert.Error(t, json.Unmarshal([]byte(`{"Power":true}`), &statusZero))
+
+	var statusFour StatusFour
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"FlashMode":2}`), &statusFour))
+	assert.Equal(t, "DIO", statusFour.FlashMode)
+	assert.NoError(t, json.Unmarshal([]byte(`{"FlashMode":7}`), &statusFour))
+	assert.Equal(t, "7", statusFour.FlashMode)
+
+	var statusFive StatusFive
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"DNSServer1":"1.1.1.1","DNSServer":"8.8.8.8"}`), &statusFive))
+	assert.Equal(t, "1.1.1.1", statusFive.DNSServer1)
+
+	var statusSeven StatusSeven
+
+	assert.Error(t, json.Unmarshal([]byte(`{"UTC":5}`), &statusSeven))
+	assert.Error(t, json.Unmarshal([]byte(`{"UTC":"Mon Oct 05 09:12:07 2020"}`), &statusSeven))
+
+	// Round trip of the current format
+	status, err := UnmarshalStatus([]byte(JsonData))
+
+	require.NoError(t, err)
+
+	data, err := json.Marshal(status)
+
+	require.NoError(t, err)
+
+	decoded, err := UnmarshalStatus(data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, status, decoded)
+}
@@ -13,7 +13,11 @@ type TasmotaTime time.Time
 
 // UnmarshalJSON handles parsing the Tasmota-specific time format when unmarshaling JSON data.
 func (tasmotaTime *TasmotaTime) UnmarshalJSON(value []byte) error {
-	str := string(value[1 : len(value)-1]) // Removing the enclosing quotes
+	var str string
+
+	if err := json.Unmarshal(value, &str); err != nil {
+		return err
+	}
 
 	t, err := time.Parse("2006-01-02T15:04:05", str) // Parse the string using Tasmota's format
 
@@ -340,6 +344,18 @@ func UnmarshalStatusEleven(data []byte) (*StatusEleven, error) {
 	return &result, nil
 }
 
+// UnmarshalTeleState unmarshals the periodic telemetry message (tele/<id>/STATE) from JSON data.
+// The message has the same content as STATUS 11, but without the StatusSTS wrapper.
+func UnmarshalTeleState(data []byte) (*StatusEleven, error) {
+	var result StatusEleven
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 // Status combines various status commands into one structure.
 // It represents the entire set of status information returned by a Tasmota device, including system, network, and sensor data.
 // See the full Tasmota documentation: https://tasmota.github.io/docs/Commands/#management
@@ -486,6 +486,27 @@ func Test_UnmarshalStatusEleven(t *testing.T) {
 	assert.Equal(t, expectedStatusEleven, *statusEleven)
 }
 
+func Test_UnmarshalTeleState(t *testing.T) {
+	jsonData := `{"Time":"2024-08-31T14:17:41","Uptime":"0T00:27:03","UptimeSec":1623,"Heap":22,"SleepMode":"Dynamic","Sleep":50,"LoadAvg":19,"MqttCount":1,"POWER":"ON","Wifi":{"AP":1,"SSId":"ALHN-ED72","BSSId":"EC:84:B4:0C:86:09","Channel":3,"Mode":"11n","RSSI":68,"Signal":-66,"LinkCount":1,"Downtime":"0T00:00:04"}}`
+
+	state, err := UnmarshalTeleState([]byte(jsonData))
+
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, TasmotaTime(time.Date(2024, 8, 31, 14, 17, 41, 0, time.UTC)), state.Time)
+	assert.Equal(t, 1623, state.UptimeSec)
+	assert.Equal(t, 22, state.Heap)
+	assert.Equal(t, "ON", state.POWER)
+	assert.Equal(t, 68, state.Wifi.RSSI)
+	assert.Equal(t, -66, state.Wifi.Signal)
+
+	_, err = UnmarshalTeleState([]byte("test"))
+
+	assert.Error(t, err)
+}
+
 func Test_UnmarshalStatus(t *testing.T) {
 	status, err := UnmarshalStatus([]byte(JsonData))
 
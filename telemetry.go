@@ -0,0 +1,97 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"strings"
+	"time"
+)
+
+// MQTT telemetry (tele) and status (stat) topics used for telemetry tracking
+const (
+	// TasmotaTeleTopicState is the periodic telemetry message with the same content as STATUS 11.
+	TasmotaTeleTopicState = "STATE"
+
+	// TasmotaTeleTopicValueAll subscribes to the telemetry topics of all devices.
+	TasmotaTeleTopicValueAll = "+"
+
+	// TasmotaStatTopicPower is the message a device publishes whenever its power state changes.
+	TasmotaStatTopicPower = "POWER"
+)
+
+// subscribeTelemetry subscribes to the telemetry (tele/+/STATE) and power (stat/+/POWER) messages of all devices.
+func (sonoffBasicR2 SonoffBasicR2) subscribeTelemetry() error {
+	topicTeleState := sonoffBasicR2.getFullTeleTopic(TasmotaTeleTopicValueAll, TasmotaTeleTopicState)
+	subscribeTeleState := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		id := strings.Split(pk.TopicName, "/")[1]
+		state, err := UnmarshalTeleState(pk.Payload)
+
+		if err != nil {
+			sonoffBasicR2.logDecodeFailed(id, pk.TopicName, err)
+
+			return
+		}
+
+		sonoffBasicR2.updateStateFromStatusEleven(id, state)
+	}
+
+	err := sonoffBasicR2.server.Subscribe(topicTeleState, sonoffBasicR2.generateSubscriptionId(), subscribeTeleState)
+
+	if err != nil {
+		return err
+	}
+
+	topicStatPower := sonoffBasicR2.getFullStatTopic(TasmotaStatTopicValueAll, TasmotaStatTopicPower)
+	subscribeStatPower := func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		sonoffBasicR2.updateStatePower(strings.Split(pk.TopicName, "/")[1], string(pk.Payload))
+	}
+
+	return sonoffBasicR2.server.Subscribe(topicStatPower, sonoffBasicR2.generateSubscriptionId(), subscribeStatPower)
+}
+
+// updateStatePower records the power state reported by the device.
+func (sonoffBasicR2 SonoffBasicR2) updateStatePower(id string, power string) {
+	sonoffBasicR2.registry.update(id, DeviceEventStateUpdated, func(device *Device) {
+		device.State.Power = power
+		device.State.UpdatedAt = time.Now()
+	})
+}
+
+// updateStateFromStatusEleven records the runtime state from a STATUS 11 response or a tele STATE message.
+func (sonoffBasicR2 SonoffBasicR2) updateStateFromStatusEleven(id string, status *StatusEleven) {
+	sonoffBasicR2.registry.update(id, DeviceEventStateUpdated, func(device *Device) {
+		applyStatusEleven(&device.State, status)
+
+		device.State.UpdatedAt = time.Now()
+	})
+}
+
+// updateStateFromStatusOne records the boot count from a STATUS 1 response.
+func (sonoffBasicR2 SonoffBasicR2) updateStateFromStatusOne(id string, status *StatusOne) {
+	sonoffBasicR2.registry.update(id, DeviceEventStateUpdated, func(device *Device) {
+		device.State.BootCount = status.BootCount
+		device.State.UpdatedAt = time.Now()
+	})
+}
+
+// updateStateFromStatus records the runtime state and the boot count from a STATUS 0 response.
+func (sonoffBasicR2 SonoffBasicR2) updateStateFromStatus(id string, status *Status) {
+	sonoffBasicR2.registry.update(id, DeviceEventStateUpdated, func(device *Device) {
+		applyStatusEleven(&device.State, &status.StatusSTS)
+
+		device.State.BootCount = status.StatusPRM.BootCount
+		device.State.UpdatedAt = time.Now()
+	})
+}
+
+// applyStatusEleven copies the runtime values of STATUS 11 into the device state.
+func applyStatusEleven(state *DeviceState, status *StatusEleven) {
+	if status.POWER != "" {
+		state.Power = status.POWER
+	}
+
+	state.RSSI = status.Wifi.RSSI
+	state.Signal = status.Wifi.Signal
+	state.Heap = status.Heap
+	state.UptimeSec = status.UptimeSec
+}
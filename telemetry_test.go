@@ -0,0 +1,106 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func WithMockTelemetryTracking() MockOption {
+	return func(sonoffServer *SonoffBasicR2, mockServer *MockMQTTServer) {
+		mockServer.subscribeChan = make(chan mqtt.InlineSubFn, 2)
+		sonoffServer.SetTelemetryTracking(true)
+	}
+}
+
+func TestSonoffBasicR2_TelemetryTracking(t *testing.T) {
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockTelemetryTracking())
+
+	assert.NoError(t, err)
+	assert.Equal(t, true, sonoffServer.GetTelemetryTracking())
+
+	events := make([]DeviceEvent, 0)
+
+	sonoffServer.OnDeviceEvent(func(event DeviceEvent) {
+		events = append(events, event)
+	})
+
+	handlerTeleState := <-mockServer.subscribeChan
+	handlerStatPower := <-mockServer.subscribeChan
+
+	assert.Equal(t, sonoffServer.getFullTeleTopic(TasmotaTeleTopicValueAll, TasmotaTeleTopicState), mockServer.Calls[2].Arguments.Get(0).(string))
+	assert.Equal(t, sonoffServer.getFullStatTopic(TasmotaStatTopicValueAll, TasmotaStatTopicPower), mockServer.Calls[3].Arguments.Get(0).(string))
+
+	handlerTeleState(nil, packets.Subscription{}, packets.Packet{
+		TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicState),
+		Payload:   []byte(`{"UptimeSec":1623,"Heap":22,"POWER":"OFF","Wifi":{"RSSI":68,"Signal":-66}}`),
+	})
+
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, "OFF", device.State.Power)
+	assert.Equal(t, 68, device.State.RSSI)
+	assert.Equal(t, -66, device.State.Signal)
+	assert.Equal(t, 22, device.State.Heap)
+	assert.Equal(t, 1623, device.State.UptimeSec)
+
+	handlerStatPower(nil, packets.Subscription{}, packets.Packet{
+		TopicName: sonoffServer.getFullStatTopic("1", TasmotaStatTopicPower),
+		Payload:   []byte(TasmotaCmndTopicPowerValueOn),
+	})
+
+	device, _ = sonoffServer.Device("1")
+
+	assert.Equal(t, "ON", device.State.Power)
+	assert.Equal(t, 68, device.State.RSSI)
+
+	handlerTeleState(nil, packets.Subscription{}, packets.Packet{
+		TopicName: sonoffServer.getFullTeleTopic("1", TasmotaTeleTopicState),
+		Payload:   []byte("test"),
+	})
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, DeviceEventStateUpdated, events[0].Type)
+	assert.Equal(t, DeviceEventStateUpdated, events[1].Type)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_updateStateFromStatus(t *testing.T) {
+	sonoffServer, _, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+
+	status, err := UnmarshalStatus([]byte(JsonData))
+
+	assert.NoError(t, err)
+
+	sonoffServer.updateStateFromStatus("1", status)
+
+	device, _ := sonoffServer.Device("1")
+
+	assert.Equal(t, "OFF", device.State.Power)
+	assert.Equal(t, 68, device.State.RSSI)
+	assert.Equal(t, 14, device.State.BootCount)
+	assert.Equal(t, false, device.State.UpdatedAt.IsZero())
+
+	statusOne, err := UnmarshalStatusOne([]byte(JsonData))
+
+	assert.NoError(t, err)
+
+	statusOne.BootCount = 15
+
+	sonoffServer.updateStateFromStatusOne("1", statusOne)
+
+	device, _ = sonoffServer.Device("1")
+
+	assert.Equal(t, 15, device.State.BootCount)
+	assert.Equal(t, "OFF", device.State.Power)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
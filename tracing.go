@@ -0,0 +1,113 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracerName is the instrumentation name of the tracer used for command spans.
+const TracerName = "github.com/fromsi/mqtt_sonoff_basic_r2"
+
+// Span attributes set on command spans
+const (
+	// TraceAttributeDeviceID is the ID (topic) of the device the command is sent to.
+	TraceAttributeDeviceID = "sonoff.device.id"
+
+	// TraceAttributeCommand is the Tasmota command, e.g. POWER or STATUS11.
+	TraceAttributeCommand = "sonoff.command"
+
+	// TraceAttributeTopic is the MQTT topic a span publishes to or subscribes to.
+	TraceAttributeTopic = "sonoff.topic"
+
+	// TraceAttributeOutcome is the outcome of the command (see TraceOutcome constants).
+	TraceAttributeOutcome = "sonoff.outcome"
+
+	// TraceAttributeAttempts is the number of times the command was sent according to the retry policy.
+	TraceAttributeAttempts = "sonoff.attempts"
+)
+
+// Outcomes of a command reported in TraceAttributeOutcome
+const (
+	TraceOutcomeSuccess         = "success"
+	TraceOutcomeSubscribeFailed = "subscribe_failed"
+	TraceOutcomePublishFailed   = "publish_failed"
+	TraceOutcomeTimeout         = "timeout"
+	TraceOutcomeCanceled        = "canceled"
+	TraceOutcomeClosed          = "closed"
+	TraceOutcomeOffline         = "offline"
+	TraceOutcomeCircuitOpen     = "circuit_open"
+	TraceOutcomeQueued          = "queued"
+	TraceOutcomeDecodeFailed    = "decode_failed"
+)
+
+// Names of the spans created for the steps of a command round-trip
+const (
+	traceSpanSubscribe = "subscribe"
+	traceSpanPublish   = "publish"
+	traceSpanWait      = "wait"
+	traceSpanDecode    = "decode"
+)
+
+// GetTracerProvider returns the tracer provider used for command spans.
+func (sonoffBasicR2 SonoffBasicR2) GetTracerProvider() trace.TracerProvider {
+	return sonoffBasicR2.getSettings().tracerProvider
+}
+
+// SetTracerProvider sets the tracer provider used for command spans.
+// Every command gets a span with child spans for subscribe, publish, wait and decode. Without a provider no spans are recorded.
+func (sonoffBasicR2 *SonoffBasicR2) SetTracerProvider(value trace.TracerProvider) {
+	sonoffBasicR2.settings.update(func(settings *settings) {
+		settings.tracerProvider = value
+	})
+}
+
+// tracer returns the tracer of the configured provider or a no-op tracer.
+func (sonoffBasicR2 SonoffBasicR2) tracer() trace.Tracer {
+	if tracerProvider := sonoffBasicR2.getSettings().tracerProvider; tracerProvider != nil {
+		return tracerProvider.Tracer(TracerName)
+	}
+
+	return noop.NewTracerProvider().Tracer(TracerName)
+}
+
+// startCommandSpan starts the span that covers the whole command sent to the device.
+func (sonoffBasicR2 SonoffBasicR2) startCommandSpan(ctx context.Context, id string, command string) (context.Context, trace.Span) {
+	return sonoffBasicR2.tracer().Start(
+		ctx,
+		"sonoff "+command,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String(TraceAttributeDeviceID, id),
+			attribute.String(TraceAttributeCommand, command),
+		),
+	)
+}
+
+// startStepSpan starts the span of a single step (subscribe, publish, wait, decode) of a command.
+func (sonoffBasicR2 SonoffBasicR2) startStepSpan(ctx context.Context, name string, topic string) (context.Context, trace.Span) {
+	options := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindInternal)}
+
+	if topic != "" {
+		options = append(options, trace.WithAttributes(attribute.String(TraceAttributeTopic, topic)))
+	}
+
+	return sonoffBasicR2.tracer().Start(ctx, name, options...)
+}
+
+// endSpan records the error (if any) on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// setSpanOutcome sets the outcome of the command on the span.
+func setSpanOutcome(span trace.Span, outcome string) {
+	span.SetAttributes(attribute.String(TraceAttributeOutcome, outcome))
+}
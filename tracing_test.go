@@ -0,0 +1,182 @@
+package mqtt_sonoff_basic_r2
+
+import (
+	"context"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func WithMockTracing(recorder *tracetest.SpanRecorder) MockOption {
+	return func(sonoffServer *SonoffBasicR2, _ *MockMQTTServer) {
+		sonoffServer.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	}
+}
+
+func getSpanNames(spans []sdktrace.ReadOnlySpan) []string {
+	result := make([]string, 0, len(spans))
+
+	for _, span := range spans {
+		result = append(result, span.Name())
+	}
+
+	return result
+}
+
+func getSpanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, value := range span.Attributes() {
+		if string(value.Key) == key {
+			return value.Value.AsString()
+		}
+	}
+
+	return ""
+}
+
+func TestSonoffBasicR2_TracerProvider(t *testing.T) {
+	sonoffServer, _, err := NewMockMQTTServer()
+
+	assert.NoError(t, err)
+	assert.Nil(t, sonoffServer.GetTracerProvider())
+
+	provider := sdktrace.NewTracerProvider()
+
+	sonoffServer.SetTracerProvider(provider)
+
+	assert.Equal(t, provider, sonoffServer.GetTracerProvider())
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_TracingStatus(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockTracing(recorder))
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusEleven("1")
+
+		responseChan <- err
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{"StatusSTS":{"POWER":"ON"}}`)})
+
+	assert.NoError(t, <-responseChan)
+
+	spans := recorder.Ended()
+
+	assert.Equal(t, []string{"subscribe", "publish", "wait", "decode", "sonoff STATUS11"}, getSpanNames(spans))
+
+	command := spans[4]
+
+	assert.Equal(t, "1", getSpanAttribute(command, TraceAttributeDeviceID))
+	assert.Equal(t, "STATUS11", getSpanAttribute(command, TraceAttributeCommand))
+	assert.Equal(t, TraceOutcomeSuccess, getSpanAttribute(command, TraceAttributeOutcome))
+	assert.Equal(t, "stat/1/STATUS11", getSpanAttribute(spans[0], TraceAttributeTopic))
+	assert.Equal(t, "cmnd/1/STATUS", getSpanAttribute(spans[1], TraceAttributeTopic))
+
+	for _, span := range spans[:4] {
+		assert.Equal(t, command.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_TracingDecodeFailed(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockTracing(recorder))
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusPhysicalButton("1")
+
+		responseChan <- err
+	}()
+
+	handler := <-mockServer.subscribeChan
+	handler(nil, packets.Subscription{}, packets.Packet{Payload: []byte(`{}`)})
+
+	assert.Error(t, <-responseChan)
+
+	spans := recorder.Ended()
+
+	assert.Equal(t, "decode", spans[3].Name())
+	assert.Equal(t, codes.Error, spans[3].Status().Code)
+	assert.Equal(t, TraceOutcomeDecodeFailed, getSpanAttribute(spans[4], TraceAttributeOutcome))
+	assert.Equal(t, codes.Error, spans[4].Status().Code)
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_TracingTimeout(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	sonoffServer, mockServer, err := NewMockMQTTServer(WithMockTracing(recorder))
+
+	assert.NoError(t, err)
+
+	responseChan := make(chan error, 1)
+
+	go func() {
+		_, err := sonoffServer.StatusTwo("1")
+
+		responseChan <- err
+	}()
+
+	<-mockServer.subscribeChan
+
+	assert.Error(t, <-responseChan)
+
+	spans := recorder.Ended()
+
+	assert.Equal(t, []string{"subscribe", "publish", "wait", "sonoff STATUS2"}, getSpanNames(spans))
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, TraceOutcomeTimeout, getSpanAttribute(spans[3], TraceAttributeOutcome))
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}
+
+func TestSonoffBasicR2_TracingPower(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	sonoffServer, _, err := NewMockMQTTServer(WithMockTracing(recorder))
+
+	assert.NoError(t, err)
+
+	tracer := sonoffServer.GetTracerProvider().Tracer("test")
+	ctx, parent := tracer.Start(context.Background(), "automation")
+
+	err = sonoffServer.PowerOnContext(ctx, "1")
+
+	assert.NoError(t, err)
+
+	parent.End()
+
+	spans := recorder.Ended()
+
+	assert.Equal(t, []string{"publish", "sonoff POWER", "automation"}, getSpanNames(spans))
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[1].Parent().SpanID())
+	assert.Equal(t, TraceOutcomeSuccess, getSpanAttribute(spans[1], TraceAttributeOutcome))
+	assert.Contains(t, spans[0].Attributes(), attribute.String(TraceAttributeTopic, "cmnd/1/POWER"))
+
+	err = sonoffServer.Close()
+
+	assert.NoError(t, err)
+}